@@ -0,0 +1,309 @@
+package client
+
+import (
+	"errors"
+	"github.com/nats-io/nats.go"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// 熔断器状态
+	BreakerState int
+
+	// 熔断器配置
+	BreakerConfig struct {
+		FailureThreshold int           // 关闭状态下连续失败次数达到该值后打开
+		SuccessThreshold int           // 半开状态下连续成功次数达到该值后关闭
+		OpenTimeout      time.Duration // 打开状态持续时间，超时后进入半开状态
+		HalfOpenMaxCalls int           // 半开状态下允许同时进行的探测请求数
+	}
+
+	// 熔断器快照，供健康检查展示
+	BreakerSnapshot struct {
+		Subject  string     `json:"subject"`
+		State    string     `json:"state"`
+		Failures int        `json:"failures"`
+		OpenedAt *time.Time `json:"opened_at,omitempty"` // 关闭状态下为空
+	}
+
+	// 单一主题熔断器
+	breaker struct {
+		config    BreakerConfig
+		mutex     sync.Mutex
+		state     BreakerState
+		failures  int       // 连续失败次数
+		successes int       // 半开状态下连续成功次数
+		inFlight  int       // 半开状态下进行中的探测请求数
+		openedAt  time.Time // 打开时间
+		lastUsed  time.Time // 最近一次请求时间，长期未使用的熔断器被回收
+	}
+
+	// 按主题划分的熔断器组
+	breakerGroup struct {
+		mutex    sync.Mutex
+		def      BreakerConfig            // 默认配置
+		configs  map[string]BreakerConfig // 特设配置 map[subject]BreakerConfig
+		breakers map[string]*breaker      // 熔断器 map[subject]*breaker
+		swept    time.Time                // 最近一次回收时间
+	}
+)
+
+const (
+	BreakerClosed   BreakerState = iota // 关闭，请求正常通过
+	BreakerOpen                         // 打开，请求直接失败
+	BreakerHalfOpen                     // 半开，允许少量探测请求通过
+)
+
+const (
+	DefaultBreakerFailureThreshold = 5                // 默认连续失败 5 次打开
+	DefaultBreakerSuccessThreshold = 1                // 默认半开状态成功 1 次关闭
+	DefaultBreakerOpenTimeout      = 10 * time.Second // 默认打开 10 秒后进入半开
+	DefaultBreakerHalfOpenMaxCalls = 1                // 默认半开状态只允许 1 个探测请求
+
+	// 熔断器数量上限，主题可能来自外部输入，超过上限时新主题不再保留熔断器
+	MaxBreakers = 10000
+	// 超过该时间未使用的熔断器被回收，再次使用时重新创建
+	BreakerIdleTimeout = 10 * time.Minute
+)
+
+var (
+	// 熔断器打开时快速返回的错误
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+func init() {}
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "undefined"
+	}
+}
+
+// 默认熔断器配置
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureThreshold: DefaultBreakerFailureThreshold,
+		SuccessThreshold: DefaultBreakerSuccessThreshold,
+		OpenTimeout:      DefaultBreakerOpenTimeout,
+		HalfOpenMaxCalls: DefaultBreakerHalfOpenMaxCalls,
+	}
+}
+
+// 补全未设置的配置项
+func (bc BreakerConfig) normalize() BreakerConfig {
+	if bc.FailureThreshold <= 0 {
+		bc.FailureThreshold = DefaultBreakerFailureThreshold
+	}
+	if bc.SuccessThreshold <= 0 {
+		bc.SuccessThreshold = DefaultBreakerSuccessThreshold
+	}
+	if bc.OpenTimeout <= 0 {
+		bc.OpenTimeout = DefaultBreakerOpenTimeout
+	}
+	if bc.HalfOpenMaxCalls <= 0 {
+		bc.HalfOpenMaxCalls = DefaultBreakerHalfOpenMaxCalls
+	}
+	return bc
+}
+
+// 是否为下游不可用导致的失败，只有这类错误才计入熔断
+func isBreakerFailure(err error) bool {
+	return err == nats.ErrTimeout || err == nats.ErrNoResponders
+}
+
+func newBreaker(config BreakerConfig) *breaker {
+	return &breaker{
+		config:   config.normalize(),
+		state:    BreakerClosed,
+		lastUsed: time.Now(),
+	}
+}
+
+// 请求前检查是否允许通过
+func (b *breaker) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastUsed = time.Now()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			return ErrCircuitOpen
+		}
+		// 打开超时，进入半开状态
+		b.state = BreakerHalfOpen
+		b.successes = 0
+		b.inFlight = 0
+		fallthrough
+	case BreakerHalfOpen:
+		if b.inFlight >= b.config.HalfOpenMaxCalls {
+			return ErrCircuitOpen
+		}
+		b.inFlight++
+	}
+
+	return nil
+}
+
+// 请求后报告结果
+func (b *breaker) report(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	failed := isBreakerFailure(err)
+
+	switch b.state {
+	case BreakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			b.trip()
+		}
+	case BreakerHalfOpen:
+		if b.inFlight > 0 {
+			b.inFlight--
+		}
+		if failed {
+			b.failures++
+			b.trip()
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.SuccessThreshold {
+			b.state = BreakerClosed
+			b.failures = 0
+			b.successes = 0
+		}
+	}
+}
+
+// 打开熔断器
+func (b *breaker) trip() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.successes = 0
+	b.inFlight = 0
+}
+
+func (b *breaker) snapshot(subject string) BreakerSnapshot {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s := BreakerSnapshot{
+		Subject:  subject,
+		State:    b.state.String(),
+		Failures: b.failures,
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+// 是否空闲，没有进行中的探测请求且超过空闲时间未使用
+func (b *breaker) idle(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.inFlight == 0 && now.Sub(b.lastUsed) > BreakerIdleTimeout
+}
+
+func newBreakerGroup() *breakerGroup {
+	return &breakerGroup{
+		def:      DefaultBreakerConfig(),
+		configs:  map[string]BreakerConfig{},
+		breakers: map[string]*breaker{},
+		swept:    time.Now(),
+	}
+}
+
+// 设置配置，subject 为空时设置默认配置
+// 已创建的熔断器按新配置重建
+func (bg *breakerGroup) set(subject string, config BreakerConfig) {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	if subject == "" {
+		bg.def = config.normalize()
+		for s := range bg.breakers {
+			if _, exist := bg.configs[s]; !exist {
+				bg.breakers[s] = newBreaker(bg.def)
+			}
+		}
+		return
+	}
+
+	bg.configs[subject] = config.normalize()
+	bg.breakers[subject] = newBreaker(config)
+}
+
+// 获取主题对应的熔断器，不存在时按配置创建
+// 达到数量上限时返回不保留的熔断器
+func (bg *breakerGroup) get(subject string) *breaker {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	if b, exist := bg.breakers[subject]; exist {
+		return b
+	}
+
+	config, exist := bg.configs[subject]
+	if !exist {
+		config = bg.def
+	}
+
+	b := newBreaker(config)
+	bg.sweep(b.lastUsed)
+	if len(bg.breakers) < MaxBreakers {
+		bg.breakers[subject] = b
+	}
+	return b
+}
+
+// 回收空闲的熔断器，调用方需持有锁
+// 每个空闲周期最多执行一次，数量达到上限时每秒最多执行一次
+func (bg *breakerGroup) sweep(now time.Time) {
+	elapsed := now.Sub(bg.swept)
+	if elapsed < BreakerIdleTimeout && (len(bg.breakers) < MaxBreakers || elapsed < time.Second) {
+		return
+	}
+	bg.swept = now
+
+	for s, b := range bg.breakers {
+		if b.idle(now) {
+			delete(bg.breakers, s)
+		}
+	}
+}
+
+// 所有熔断器快照，按主题排序
+func (bg *breakerGroup) snapshots() []BreakerSnapshot {
+	bg.mutex.Lock()
+	breakers := make(map[string]*breaker, len(bg.breakers))
+	for s, b := range bg.breakers {
+		breakers[s] = b
+	}
+	bg.mutex.Unlock()
+
+	list := make([]BreakerSnapshot, 0, len(breakers))
+	for s, b := range breakers {
+		list = append(list, b.snapshot(s))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Subject < list[j].Subject })
+
+	return list
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerTripsAndRecovers(t *testing.T) {
+	b := newBreaker(BreakerConfig{FailureThreshold: 2, OpenTimeout: 50 * time.Millisecond})
+
+	for i := 0; i < 2; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatal(err)
+		}
+		b.report(nats.ErrTimeout)
+	}
+	if err := b.allow(); err != ErrCircuitOpen {
+		t.Fatalf("allow = %v , want %v", err, ErrCircuitOpen)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatalf("half-open probe rejected : %v", err)
+	}
+	b.report(nil)
+	if s := b.snapshot("x"); s.State != BreakerClosed.String() {
+		t.Fatalf("state = %s , want closed", s.State)
+	}
+}
+
+func TestBreakerSnapshotOmitsOpenedAt(t *testing.T) {
+	b := newBreaker(DefaultBreakerConfig())
+	data, err := json.Marshal(b.snapshot("Lobby.Buy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "opened_at") {
+		t.Fatalf("closed breaker snapshot contains opened_at : %s", data)
+	}
+
+	b.trip()
+	if s := b.snapshot("Lobby.Buy"); s.OpenedAt == nil || s.OpenedAt.IsZero() {
+		t.Fatal("open breaker snapshot without opened_at")
+	}
+}
+
+func TestBreakerGroupBounded(t *testing.T) {
+	bg := newBreakerGroup()
+	for i := 0; i < MaxBreakers+100; i++ {
+		bg.get("Subject." + strconv.Itoa(i))
+	}
+	if n := len(bg.breakers); n > MaxBreakers {
+		t.Fatalf("%d breakers kept , want at most %d", n, MaxBreakers)
+	}
+
+	// 空闲的熔断器在下一次创建时被回收
+	for _, b := range bg.breakers {
+		b.lastUsed = time.Now().Add(-2 * BreakerIdleTimeout)
+	}
+	bg.swept = time.Now().Add(-2 * BreakerIdleTimeout)
+	bg.get("Subject.new")
+	if n := len(bg.breakers); n != 1 {
+		t.Fatalf("%d breakers kept after sweep , want 1", n)
+	}
+}
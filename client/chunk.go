@@ -0,0 +1,342 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// 大消息分片配置
+	ChunkConfig struct {
+		ChunkSize int           // 单片最大长度，默认为服务端 max_payload 减去消息头预留长度
+		Timeout   time.Duration // 分片保留及重组超时时间
+		MaxMemory int64         // 接收方同时重组的数据总长度上限
+		MaxSize   int64         // 接收方允许重组的单条消息最大长度
+		MaxPulls  int           // 发送方每条消息允许被拉取的次数，拉取完毕即释放分片，广播给多个订阅者时需调大
+	}
+
+	// 大消息分片者
+	// 超过单条消息上限的数据不直接发出，而是发出一条只携带分片信息的描述消息，
+	// 接收方收到描述消息后，通过专属收件箱从发送方拉取所有分片并重组。
+	// 拉取的方式保证了队列订阅和请求回复（单一回复）下分片不会被拆散到不同接收者。
+	chunker struct {
+		conn   *nats.Conn
+		mutex  sync.RWMutex
+		config ChunkConfig
+		memory int64 // 正在重组的数据总长度，原子操作
+	}
+)
+
+const (
+	// 分片消息 ID 头
+	ChunkIDHeader = "Sherlock-Chunk-Id"
+	// 分片拉取地址头，仅描述消息携带
+	ChunkSourceHeader = "Sherlock-Chunk-Source"
+	// 分片序号头，从 0 开始，仅分片携带
+	ChunkSeqHeader = "Sherlock-Chunk-Seq"
+	// 分片总数头
+	ChunkTotalHeader = "Sherlock-Chunk-Total"
+	// 完整数据长度头
+	ChunkSizeHeader = "Sherlock-Chunk-Size"
+	// 完整数据 SHA256 校验和头
+	ChunkChecksumHeader = "Sherlock-Chunk-Checksum"
+
+	// 为消息头预留的长度
+	ChunkHeaderReserve = 4 << 10
+	// 默认分片超时时间
+	DefaultChunkTimeout = 30 * time.Second
+	// 默认重组内存上限 256MB
+	DefaultChunkMaxMemory = 256 << 20
+	// 默认单条消息最大长度 64MB
+	DefaultChunkMaxSize = 64 << 20
+	// 默认拉取次数，队列订阅及请求只会有一个接收方拉取
+	DefaultChunkMaxPulls = 1
+
+	// 服务端无人订阅拉取地址时回复的状态
+	noRespondersStatus = "503"
+)
+
+var (
+	ErrChunkMemoryExceeded = errors.New("chunk reassembly memory exceeded")
+	ErrChunkChecksum       = errors.New("chunk checksum mismatch")
+	ErrChunkInvalid        = errors.New("invalid chunk message")
+	ErrChunkTooLarge       = errors.New("chunked message too large")
+)
+
+func init() {}
+
+func newChunker(conn *nats.Conn) *chunker {
+	return &chunker{
+		conn: conn,
+		config: ChunkConfig{
+			Timeout:   DefaultChunkTimeout,
+			MaxMemory: DefaultChunkMaxMemory,
+			MaxSize:   DefaultChunkMaxSize,
+			MaxPulls:  DefaultChunkMaxPulls,
+		},
+	}
+}
+
+// 设置分片配置
+func (ch *chunker) use(config ChunkConfig) {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultChunkTimeout
+	}
+	if config.MaxMemory <= 0 {
+		config.MaxMemory = DefaultChunkMaxMemory
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultChunkMaxSize
+	}
+	if config.MaxPulls <= 0 {
+		config.MaxPulls = DefaultChunkMaxPulls
+	}
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	ch.config = config
+}
+
+func (ch *chunker) getConfig() ChunkConfig {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+
+	return ch.config
+}
+
+// 单片长度上限
+func (ch *chunker) chunkSize() int {
+	limit := int(ch.conn.MaxPayload()) - ChunkHeaderReserve
+	if size := ch.getConfig().ChunkSize; size > 0 && size < limit {
+		return size
+	}
+	return limit
+}
+
+// 是否需要分片
+func (ch *chunker) need(msg *nats.Msg) bool {
+	return len(msg.Data) > ch.chunkSize()
+}
+
+// 准备分片：开启分片拉取订阅，返回用于替代原消息发出的描述消息
+func (ch *chunker) prepare(msg *nats.Msg) (*nats.Msg, error) {
+	// 分片依赖消息头，服务端不支持时维持原有的超限错误
+	if !ch.conn.HeadersSupported() {
+		return nil, nats.ErrMaxPayload
+	}
+
+	size := ch.chunkSize()
+	chunks := make([][]byte, 0, len(msg.Data)/size+1)
+	for start := 0; start < len(msg.Data); start += size {
+		end := start + size
+		if end > len(msg.Data) {
+			end = len(msg.Data)
+		}
+		chunks = append(chunks, msg.Data[start:end])
+	}
+
+	id := nats.NewInbox()
+	total := strconv.Itoa(len(chunks))
+	sum := sha256.Sum256(msg.Data)
+
+	// 接收方向拉取地址发送一条以其收件箱为回复地址的消息，发送方将所有分片依序发往该收件箱
+	// 拉取次数达到上限或超时后取消订阅，不再持有分片
+	config := ch.getConfig()
+	source := nats.NewInbox()
+	var (
+		sp    *nats.Subscription
+		timer *time.Timer
+		pulls int
+		once  sync.Once
+		ready = make(chan struct{})
+	)
+	release := func() {
+		once.Do(func() {
+			<-ready
+			timer.Stop()
+			if err := sp.Unsubscribe(); err != nil && err != nats.ErrConnectionClosed && err != nats.ErrBadSubscription {
+				log.Printf("unsubscribe chunk source [%s] error : %s", source, err.Error())
+			}
+		})
+	}
+	sp, err := ch.conn.Subscribe(source, func(pull *nats.Msg) {
+		if pull.Reply == "" {
+			return
+		}
+		// 回调在订阅协程中串行执行
+		pulls++
+		if pulls > config.MaxPulls {
+			return
+		}
+		for seq, chunk := range chunks {
+			m := &nats.Msg{
+				Subject: pull.Reply,
+				Header:  http.Header{},
+				Data:    chunk,
+			}
+			m.Header.Set(ChunkIDHeader, id)
+			m.Header.Set(ChunkSeqHeader, strconv.Itoa(seq))
+			m.Header.Set(ChunkTotalHeader, total)
+			if err := ch.conn.PublishMsg(m); err != nil {
+				log.Printf("publish chunk [%s] %d/%s error : %s", id, seq, total, err.Error())
+				break
+			}
+		}
+		if pulls == config.MaxPulls {
+			release()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	timer = time.AfterFunc(config.Timeout, release)
+	close(ready)
+
+	descriptor := &nats.Msg{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Header:  http.Header{},
+	}
+	for k, v := range msg.Header {
+		descriptor.Header[k] = v
+	}
+	descriptor.Header.Set(ChunkIDHeader, id)
+	descriptor.Header.Set(ChunkSourceHeader, source)
+	descriptor.Header.Set(ChunkTotalHeader, total)
+	descriptor.Header.Set(ChunkSizeHeader, strconv.Itoa(len(msg.Data)))
+	descriptor.Header.Set(ChunkChecksumHeader, hex.EncodeToString(sum[:]))
+
+	return descriptor, nil
+}
+
+// 是否为分片描述消息
+func isChunkDescriptor(msg *nats.Msg) bool {
+	return msg != nil && msg.Header != nil && msg.Header.Get(ChunkSourceHeader) != ""
+}
+
+// 重组：如果是描述消息，拉取全部分片并还原数据，否则不做处理
+// 描述消息中的长度及分片数来自发送方，先校验再分配内存，每个分片至少 1 字节
+// 消息携带截止时间时，重组等待不超过截止时间
+func (ch *chunker) assemble(msg *nats.Msg) error {
+	if !isChunkDescriptor(msg) {
+		return nil
+	}
+
+	config := ch.getConfig()
+
+	source := msg.Header.Get(ChunkSourceHeader)
+	id := msg.Header.Get(ChunkIDHeader)
+	size, err := strconv.ParseInt(msg.Header.Get(ChunkSizeHeader), 10, 64)
+	if err != nil || size <= 0 {
+		return ErrChunkInvalid
+	}
+	if size > config.MaxSize {
+		return ErrChunkTooLarge
+	}
+	total, err := strconv.Atoi(msg.Header.Get(ChunkTotalHeader))
+	if err != nil || total <= 0 || int64(total) > size {
+		return ErrChunkInvalid
+	}
+
+	// 预占重组内存
+	if atomic.AddInt64(&ch.memory, size) > config.MaxMemory {
+		atomic.AddInt64(&ch.memory, -size)
+		return ErrChunkMemoryExceeded
+	}
+	defer atomic.AddInt64(&ch.memory, -size)
+
+	inbox := nats.NewInbox()
+	sp, err := ch.conn.SubscribeSync(inbox)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := sp.Unsubscribe(); err != nil && err != nats.ErrConnectionClosed {
+			log.Printf("unsubscribe chunk inbox [%s] error : %s", inbox, err.Error())
+		}
+	}()
+	// 内存已由 MaxMemory 约束，不再限制待处理分片
+	if err := sp.SetPendingLimits(-1, -1); err != nil {
+		return err
+	}
+
+	if err := ch.conn.PublishRequest(source, inbox, nil); err != nil {
+		return err
+	}
+
+	parts := make([][]byte, total)
+	received, length := 0, int64(0)
+	deadline := time.Now().Add(config.Timeout)
+	if d, ok := MsgDeadline(msg); ok && d.Before(deadline) {
+		deadline = d
+	}
+	for received < total {
+		remain := time.Until(deadline)
+		if remain <= 0 {
+			return nats.ErrTimeout
+		}
+
+		m, err := sp.NextMsg(remain)
+		if err != nil {
+			return err
+		}
+		// 拉取地址已失效，无需等待到超时
+		if len(m.Data) == 0 && m.Header.Get("Status") == noRespondersStatus {
+			return nats.ErrNoResponders
+		}
+
+		if m.Header.Get(ChunkIDHeader) != id {
+			continue
+		}
+		seq, err := strconv.Atoi(m.Header.Get(ChunkSeqHeader))
+		if err != nil || seq < 0 || seq >= total {
+			return ErrChunkInvalid
+		}
+		if parts[seq] != nil {
+			continue
+		}
+		// 超出声明长度的分片不再接收
+		length += int64(len(m.Data))
+		if len(m.Data) == 0 || length > size {
+			return ErrChunkInvalid
+		}
+		parts[seq] = m.Data
+		received++
+	}
+
+	data := bytes.Join(parts, nil)
+	if int64(len(data)) != size {
+		return fmt.Errorf("chunk size mismatch : expect %d , got %d", size, len(data))
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != msg.Header.Get(ChunkChecksumHeader) {
+		return ErrChunkChecksum
+	}
+
+	msg.Data = data
+	for _, h := range []string{ChunkIDHeader, ChunkSourceHeader, ChunkTotalHeader, ChunkSizeHeader, ChunkChecksumHeader} {
+		msg.Header.Del(h)
+	}
+
+	return nil
+}
+
+// 订阅链路中的重组中间件，重组失败的消息直接丢弃
+func (ch *chunker) assembleMiddleware(msg *nats.Msg) bool {
+	if err := ch.assemble(msg); err != nil {
+		log.Printf("assemble chunked message of [%s] error : %s", msg.Subject, err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"bytes"
+	natsd "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 启动内嵌 NATS 服务并连接
+func newTestClient(t *testing.T) *client {
+	t.Helper()
+
+	server, err := natsd.NewServer(&natsd.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+	if !server.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(server.Shutdown)
+
+	c, err := NewClient(t.Name(), server.ClientURL(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c.(*client)
+}
+
+// 伪造的描述消息
+func descriptor(source, total, size string) *nats.Msg {
+	msg := &nats.Msg{Subject: "Chunk.Test", Header: http.Header{}}
+	msg.Header.Set(ChunkIDHeader, "id")
+	msg.Header.Set(ChunkSourceHeader, source)
+	msg.Header.Set(ChunkTotalHeader, total)
+	msg.Header.Set(ChunkSizeHeader, size)
+	return msg
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	c := newTestClient(t)
+	c.UseChunking(ChunkConfig{ChunkSize: 1024})
+
+	data := bytes.Repeat([]byte("sherlock"), 1000)
+	received := make(chan []byte, 1)
+	if _, err := c.Subscribe("Chunk.Test", "", func(msg *nats.Msg) { received <- msg.Data }); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish("Chunk.Test", "", data); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) {
+			t.Fatalf("reassembled %d bytes , want %d", len(got), len(data))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("chunked message not received")
+	}
+}
+
+func TestChunkRejectsInvalidDescriptor(t *testing.T) {
+	c := newTestClient(t)
+	c.UseChunking(ChunkConfig{Timeout: time.Second, MaxSize: 1 << 20})
+
+	cases := []struct {
+		total, size string
+		err         error
+	}{
+		// 分片数远大于长度，不能按分片数分配内存
+		{"2000000000", "10", ErrChunkInvalid},
+		{"0", "10", ErrChunkInvalid},
+		{"1", "0", ErrChunkInvalid},
+		{"1", strconv.Itoa(2 << 20), ErrChunkTooLarge},
+	}
+	for _, cs := range cases {
+		if err := c.chunker.assemble(descriptor(nats.NewInbox(), cs.total, cs.size)); err != cs.err {
+			t.Errorf("total %s size %s error = %v , want %v", cs.total, cs.size, err, cs.err)
+		}
+	}
+}
+
+func TestChunkRejectsOversizedChunks(t *testing.T) {
+	c := newTestClient(t)
+
+	// 声明 4 字节，实际发送 2 片共 8 字节
+	source := nats.NewInbox()
+	if _, err := c.conn.Subscribe(source, func(pull *nats.Msg) {
+		for seq := 0; seq < 2; seq++ {
+			m := &nats.Msg{Subject: pull.Reply, Header: http.Header{}, Data: []byte("abcd")}
+			m.Header.Set(ChunkIDHeader, "id")
+			m.Header.Set(ChunkSeqHeader, strconv.Itoa(seq))
+			c.conn.PublishMsg(m)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.chunker.assemble(descriptor(source, "2", "4")); err != ErrChunkInvalid {
+		t.Fatalf("error = %v , want %v", err, ErrChunkInvalid)
+	}
+}
+
+func TestChunkDeliveryKeepsOrder(t *testing.T) {
+	c := newTestClient(t)
+	c.UseChunking(ChunkConfig{ChunkSize: 1024})
+
+	received := make(chan string, 6)
+	if _, err := c.Subscribe("Chunk.Test", "", func(msg *nats.Msg) { received <- string(msg.Data[:1]) }); err != nil {
+		t.Fatal(err)
+	}
+
+	// 分片消息与普通消息交替发出
+	for i := 0; i < 6; i++ {
+		data := []byte(strconv.Itoa(i))
+		if i%2 == 0 {
+			data = append(data, bytes.Repeat([]byte("x"), 4096)...)
+		}
+		if err := c.Publish("Chunk.Test", "", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		select {
+		case got := <-received:
+			if got != strconv.Itoa(i) {
+				t.Fatalf("message %d received as %s", i, got)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("message %d not received", i)
+		}
+	}
+}
+
+func TestChunkAssemblyFailsFastWithoutSource(t *testing.T) {
+	c := newTestClient(t)
+	c.UseChunking(ChunkConfig{Timeout: 5 * time.Second})
+
+	start := time.Now()
+	if err := c.chunker.assemble(descriptor(nats.NewInbox(), "1", "10")); err != nats.ErrNoResponders {
+		t.Fatalf("error = %v , want %v", err, nats.ErrNoResponders)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("assembly waited %s for a missing source", elapsed)
+	}
+}
+
+func TestChunkSourceReleasedAfterPull(t *testing.T) {
+	c := newTestClient(t)
+	c.UseChunking(ChunkConfig{ChunkSize: 1024})
+
+	received := make(chan struct{}, 1)
+	if _, err := c.Subscribe("Chunk.Test", "", func(*nats.Msg) { received <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+	base := c.conn.NumSubscriptions()
+
+	if err := c.Publish("Chunk.Test", "", bytes.Repeat([]byte("x"), 4096)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(3 * time.Second):
+		t.Fatal("chunked message not received")
+	}
+
+	// 拉取完毕后拉取订阅及重组收件箱均已取消
+	deadline := time.Now().Add(time.Second)
+	for c.conn.NumSubscriptions() != base {
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriptions = %d , want %d", c.conn.NumSubscriptions(), base)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChunkAssemblyRespectsDeadline(t *testing.T) {
+	c := newTestClient(t)
+	c.UseChunking(ChunkConfig{Timeout: 5 * time.Second})
+
+	// 拉取地址有人订阅但不应答，重组一直等待
+	source := nats.NewInbox()
+	if _, err := c.conn.Subscribe(source, func(*nats.Msg) {}); err != nil {
+		t.Fatal(err)
+	}
+	msg := descriptor(source, "1", "10")
+	msg.Header.Set(DeadlineBudgetHeader, "100")
+	if !DeadlineMiddleware(msg) {
+		t.Fatal("message dropped before assembly")
+	}
+
+	start := time.Now()
+	if err := c.chunker.assemble(msg); err != nats.ErrTimeout {
+		t.Fatalf("error = %v , want %v", err, nats.ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("assembly waited %s beyond the deadline budget", elapsed)
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"github.com/nats-io/nats.go"
 	"log"
 	"time"
@@ -19,11 +20,25 @@ type (
 		// subject , reply , data
 		Publish(string, string, []byte) error
 
+		// 发布完整消息，可携带消息头
+		PublishMsg(*nats.Msg) error
+
 		// 同步请求
 		// subject , reply , data , timeout
 		// 当 reply 为空时，由内部自动生成一个回复地址
+		// 在处理函数中调用时，实际超时时间取 timeout 与所处理消息剩余时间中较小者
+		// 处理函数另起协程发出的请求不会继承，应通过 MsgContext 获取上下文并调用 RequestWithContext
 		Request(string, string, []byte, time.Duration) (*nats.Msg, error)
 
+		// 携带上下文的同步请求
+		// context , subject , reply , data , timeout
+		// 实际超时时间取 timeout 与上下文剩余时间中较小者，剩余时间通过消息头传递给下游
+		RequestWithContext(context.Context, string, string, []byte, time.Duration) (*nats.Msg, error)
+
+		// 携带上下文的完整消息同步请求，可携带消息头
+		// context , msg , timeout
+		RequestMsg(context.Context, *nats.Msg, time.Duration) (*nats.Msg, error)
+
 		// 响应(其实就是订阅)
 		// subject , queue , handler
 		Response(string, string, nats.MsgHandler, ...HandleFunc) (*nats.Subscription, error)
@@ -34,13 +49,52 @@ type (
 
 		// 加入中间件
 		UseMiddleware(HandleFunc)
+
+		// 加入全局钩子，作用于所有发出的消息
+		// 钩子看到的始终是原始数据：数据转换在发布前、请求前钩子之后执行，在回复钩子之前还原
+		// 发布前(Publish/Reply)
+		UseBeforePublish(BeforePublishHook)
+		// 发布后(Publish/Reply)
+		UseAfterPublish(AfterPublishHook)
+		// 请求前(Request)
+		UseBeforeRequest(BeforeRequestHook)
+		// 收到回复(Request)
+		UseOnReply(ReplyHook)
+
+		// 设置熔断器配置
+		// subject 为空时设置所有主题的默认配置
+		UseCircuitBreaker(string, BreakerConfig)
+
+		// 设置重试策略，只应为幂等请求的主题设置
+		// subject , policy
+		UseRetryPolicy(string, RetryPolicy)
+
+		// 所有熔断器状态快照
+		BreakerStates() []BreakerSnapshot
+
+		// 设置主题数据转换（压缩、加密）
+		// subject 支持 NATS 通配符，按设置顺序匹配，先设置者优先
+		// 对请求的回复使用与请求相同的转换配置
+		// 接收方根据消息头在订阅链路中自动还原数据
+		UseTransform(string, TransformConfig) error
+
+		// 注册加密密钥，轮换密钥时注册新密钥并保留旧密钥用于解密
+		// keyID , key
+		SetEncryptionKey(string, []byte) error
+
+		// 设置大消息分片配置
+		// 超过服务端 max_payload 的数据自动分片发出，接收方在订阅链路及请求回复中自动重组
+		UseChunking(ChunkConfig)
 	}
 
 	client struct {
-		conn         *nats.Conn
-		rmw          nats.MsgHandler
-		handlerMaker func(nats.MsgHandler, nats.MsgHandler) nats.MsgHandler
-		mw           Middleware
+		conn     *nats.Conn
+		mw       Middleware
+		hooks    *hooks
+		trans    *transformer
+		chunker  *chunker
+		breakers *breakerGroup
+		retries  *retryGroup
 	}
 )
 
@@ -72,16 +126,25 @@ func NewClient(name, address, token string) (Client, error) {
 		return nil, err
 	}
 
+	trans := newTransformer()
+	chunker := newChunker(conn)
+
+	// 首先由截止时间中间件换算截止时间，过期消息不会进入任何处理函数
+	// 分片消息随后重组，重组等待计入截止时间
+	// 最后还原经过压缩、加密的数据
+	mw := NewMiddleware()
+	mw.Use(DeadlineMiddleware)
+	mw.Use(chunker.assembleMiddleware)
+	mw.Use(trans.decodeMiddleware)
+
 	return &client{
-		conn: conn,
-		rmw:  func(msg *nats.Msg) {},
-		handlerMaker: func(front nats.MsgHandler, back nats.MsgHandler) nats.MsgHandler {
-			return func(msg *nats.Msg) {
-				front(msg)
-				back(msg)
-			}
-		},
-		mw: NewMiddleware(),
+		conn:     conn,
+		mw:       mw,
+		hooks:    newHooks(),
+		trans:    trans,
+		chunker:  chunker,
+		breakers: newBreakerGroup(),
+		retries:  newRetryGroup(),
 	}, nil
 }
 
@@ -98,34 +161,145 @@ func (c *client) Subscribe(subject, queue string, handler nats.MsgHandler, middl
 		nmw.Use(mw)
 	}
 
+	// 链路出最终执行函数
+	// 分片描述消息在订阅回调中同步重组，保持该订阅消息串行、有序地交给处理函数，
+	// 重组期间该订阅的后续消息排队等待，等待时间不超过分片超时时间及消息截止时间
+	// 处理函数中的嵌套请求自动继承所处理消息的截止时间
+	cb := nmw.End(withHandlingDeadline(handler))
+
 	if queue == "" {
-		//								  链路出最终执行函数
-		return c.conn.Subscribe(subject, nmw.End(handler))
+		return c.conn.Subscribe(subject, cb)
 	}
 
-	return c.conn.QueueSubscribe(subject, queue, nmw.End(handler))
+	return c.conn.QueueSubscribe(subject, queue, cb)
 }
 
 func (c *client) Publish(subject, reply string, data []byte) error {
-	return c.conn.PublishMsg(&nats.Msg{
+	return c.PublishMsg(&nats.Msg{
 		Subject: subject,
 		Reply:   reply,
 		Data:    data,
 	})
 }
 
-func (c *client) Request(subject, reply string, data []byte, timeout time.Duration) (*nats.Msg, error) {
-	if reply == "" {
-		return c.conn.Request(subject, data, timeout)
+func (c *client) PublishMsg(msg *nats.Msg) error {
+	err := c.hooks.runBeforePublish(msg)
+	if err == nil {
+		var out *nats.Msg
+		if out, err = c.trans.encode(msg); err == nil {
+			err = c.publish(out)
+		}
+	}
+
+	c.hooks.runAfterPublish(msg, err)
+
+	return err
+}
+
+// 发布，超过单条消息上限时以分片方式发出
+func (c *client) publish(msg *nats.Msg) error {
+	if !c.chunker.need(msg) {
+		return c.conn.PublishMsg(msg)
 	}
 
-	return c.conn.RequestMsg(&nats.Msg{
+	descriptor, err := c.chunker.prepare(msg)
+	if err != nil {
+		return err
+	}
+
+	return c.conn.PublishMsg(descriptor)
+}
+
+func (c *client) Request(subject, reply string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+	return c.RequestWithContext(context.Background(), subject, reply, data, timeout)
+}
+
+func (c *client) RequestWithContext(ctx context.Context, subject, reply string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+	return c.RequestMsg(ctx, &nats.Msg{
 		Subject: subject,
 		Reply:   reply,
 		Data:    data,
 	}, timeout)
 }
 
+func (c *client) RequestMsg(ctx context.Context, msg *nats.Msg, timeout time.Duration) (*nats.Msg, error) {
+	ctx, cancel := inheritDeadline(ctx)
+	defer cancel()
+
+	// 请求前钩子只执行一次，重试时不重复修改消息
+	if err := c.hooks.runBeforeRequest(msg); err != nil {
+		return nil, err
+	}
+
+	out, err := c.trans.encode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// 超过单条消息上限时以描述消息代替原消息发出
+	if c.chunker.need(out) {
+		descriptor, err := c.chunker.prepare(out)
+		if err != nil {
+			return nil, err
+		}
+		out = descriptor
+	}
+
+	// 未设置重试策略的主题只请求一次
+	policy, exist := c.retries.get(msg.Subject)
+	if !exist {
+		policy.MaxAttempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		response, err := c.request(ctx, out, timeout)
+		if err == nil {
+			// 回复可能同样经过分片
+			if err := c.chunker.assemble(response); err != nil {
+				return nil, err
+			}
+			if err := c.trans.decode(response); err != nil {
+				return nil, err
+			}
+			if err := c.hooks.runOnReply(msg, response); err != nil {
+				return nil, err
+			}
+			return response, nil
+		}
+		if attempt >= policy.MaxAttempts || !isRetryable(err) {
+			return nil, err
+		}
+
+		// 等待期间上下文结束，返回最后一次请求的错误
+		if sleepContext(ctx, policy.backoff(attempt)) != nil {
+			return nil, err
+		}
+	}
+}
+
+// 单次请求，经过熔断器检查
+func (c *client) request(ctx context.Context, msg *nats.Msg, timeout time.Duration) (*nats.Msg, error) {
+	timeout, err := effectiveTimeout(ctx, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	b := c.breakers.get(msg.Subject)
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+
+	// 服务端支持消息头时，将剩余预算传递给下游
+	if c.conn.HeadersSupported() {
+		SetDeadlineBudget(msg, timeout)
+	}
+
+	response, err := c.conn.RequestMsg(msg, timeout)
+	b.report(err)
+
+	return response, err
+}
+
 func (c *client) Response(subject, queue string, handler nats.MsgHandler, middleware ...HandleFunc) (*nats.Subscription, error) {
 	return c.Subscribe(subject, queue, handler, middleware...)
 }
@@ -137,3 +311,43 @@ func (c *client) Reply(subject, reply string, data []byte) error {
 func (c *client) UseMiddleware(mw HandleFunc) {
 	c.mw.Use(mw)
 }
+
+func (c *client) UseBeforePublish(hook BeforePublishHook) {
+	c.hooks.useBeforePublish(hook)
+}
+
+func (c *client) UseAfterPublish(hook AfterPublishHook) {
+	c.hooks.useAfterPublish(hook)
+}
+
+func (c *client) UseBeforeRequest(hook BeforeRequestHook) {
+	c.hooks.useBeforeRequest(hook)
+}
+
+func (c *client) UseOnReply(hook ReplyHook) {
+	c.hooks.useOnReply(hook)
+}
+
+func (c *client) UseCircuitBreaker(subject string, config BreakerConfig) {
+	c.breakers.set(subject, config)
+}
+
+func (c *client) UseRetryPolicy(subject string, policy RetryPolicy) {
+	c.retries.set(subject, policy)
+}
+
+func (c *client) BreakerStates() []BreakerSnapshot {
+	return c.breakers.snapshots()
+}
+
+func (c *client) UseTransform(subject string, config TransformConfig) error {
+	return c.trans.use(subject, config)
+}
+
+func (c *client) SetEncryptionKey(keyID string, key []byte) error {
+	return c.trans.setKey(keyID, key)
+}
+
+func (c *client) UseChunking(config ChunkConfig) {
+	c.chunker.use(config)
+}
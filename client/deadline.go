@@ -0,0 +1,188 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"github.com/nats-io/nats.go"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ()
+
+const (
+	// 剩余时间预算头，单位毫秒，由发送方根据自身剩余时间写入
+	// 预算本身是相对时间，接收方换算出的截止时间不会晚于收到时刻加上预算
+	DeadlineBudgetHeader = "Sherlock-Deadline-Budget"
+	// 发送时间头，UnixNano ，与预算一同写入
+	// 接收方据此扣除传输及排队耗时，时钟偏差会使扣除量偏大或偏小
+	DeadlineSentHeader = "Sherlock-Deadline-Sent"
+	// 本地截止时间头，UnixNano，由订阅链路在接收时根据剩余预算换算写入，仅在本进程内有效
+	DeadlineHeader = "Sherlock-Deadline"
+)
+
+var (
+	// 正在处理携带截止时间的消息的协程 map[goroutineID]time.Time
+	// Go 没有协程局部存储，处理函数中的嵌套请求据此继承所处理消息的截止时间
+	handlingDeadlines sync.Map
+	// 正在处理的数量，为 0 时请求无需获取协程 ID
+	handlingCount int64
+)
+
+func init() {}
+
+// 截止时间中间件，位于订阅链路的最前端
+// 将剩余预算扣除传输及排队耗时后换算为本地截止时间，已经过期的消息直接丢弃，不再执行后续处理
+func DeadlineMiddleware(msg *nats.Msg) bool {
+	if msg.Header == nil {
+		return true
+	}
+
+	budget := msg.Header.Get(DeadlineBudgetHeader)
+	if budget == "" {
+		return true
+	}
+
+	ms, err := strconv.ParseInt(budget, 10, 64)
+	if err != nil {
+		log.Printf("parse deadline budget [%s] of [%s] error : %s", budget, msg.Subject, err.Error())
+		return true
+	}
+
+	now := time.Now()
+	deadline := now.Add(time.Duration(ms) * time.Millisecond)
+	if sent, err := strconv.ParseInt(msg.Header.Get(DeadlineSentHeader), 10, 64); err == nil {
+		if d := time.Unix(0, sent).Add(time.Duration(ms) * time.Millisecond); d.Before(deadline) {
+			deadline = d
+		}
+	}
+
+	if !deadline.After(now) {
+		log.Printf("drop expired message of [%s]", msg.Subject)
+		return false
+	}
+
+	msg.Header.Set(DeadlineHeader, strconv.FormatInt(deadline.UnixNano(), 10))
+
+	return true
+}
+
+// 获取消息的本地截止时间
+func MsgDeadline(msg *nats.Msg) (time.Time, bool) {
+	if msg == nil || msg.Header == nil {
+		return time.Time{}, false
+	}
+
+	v := msg.Header.Get(DeadlineHeader)
+	if v == "" {
+		return time.Time{}, false
+	}
+
+	ns, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, ns), true
+}
+
+// 从消息中派生上下文，消息携带截止时间时，上下文具有相同的截止时间
+// 处理函数另起协程发出的嵌套请求应使用该上下文调用 RequestWithContext
+func MsgContext(msg *nats.Msg) (context.Context, context.CancelFunc) {
+	if deadline, ok := MsgDeadline(msg); ok {
+		return context.WithDeadline(context.Background(), deadline)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// 包装处理函数，处理携带截止时间的消息期间登记截止时间，同一协程中发出的请求自动继承
+// 处理函数另起协程发出的请求无法继承，应通过 MsgContext 获取上下文并调用 RequestWithContext
+func withHandlingDeadline(handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		deadline, ok := MsgDeadline(msg)
+		if !ok {
+			handler(msg)
+			return
+		}
+
+		id := goroutineID()
+		handlingDeadlines.Store(id, deadline)
+		atomic.AddInt64(&handlingCount, 1)
+		defer func() {
+			handlingDeadlines.Delete(id)
+			atomic.AddInt64(&handlingCount, -1)
+		}()
+
+		handler(msg)
+	}
+}
+
+// 当前协程正在处理的消息的截止时间
+func handlingDeadline() (time.Time, bool) {
+	if atomic.LoadInt64(&handlingCount) == 0 {
+		return time.Time{}, false
+	}
+	if v, ok := handlingDeadlines.Load(goroutineID()); ok {
+		return v.(time.Time), true
+	}
+	return time.Time{}, false
+}
+
+// 在上下文上叠加当前协程所处理消息的截止时间，取两者中较早者
+func inheritDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := handlingDeadline(); ok {
+		return context.WithDeadline(ctx, deadline)
+	}
+	return ctx, func() {}
+}
+
+// 当前协程 ID ，解析自栈信息首行 "goroutine 123 [running]:"
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
+
+// 计算实际超时时间，取自身超时时间与上下文剩余时间中较小者
+func effectiveTimeout(ctx context.Context, timeout time.Duration) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout, nil
+	}
+
+	remain := time.Until(deadline)
+	if remain <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	if timeout <= 0 || remain < timeout {
+		return remain, nil
+	}
+
+	return timeout, nil
+}
+
+// 将剩余预算及发送时间写入消息头
+// 不经过 Request 系列方法发出的请求（例如网关转发）可以自行调用
+func SetDeadlineBudget(msg *nats.Msg, timeout time.Duration) {
+	if msg.Header == nil {
+		msg.Header = http.Header{}
+	}
+
+	msg.Header.Set(DeadlineBudgetHeader, strconv.FormatInt(int64(timeout/time.Millisecond), 10))
+	msg.Header.Set(DeadlineSentHeader, strconv.FormatInt(time.Now().UnixNano(), 10))
+}
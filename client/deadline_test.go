@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeadlineMiddlewareDropsExpired(t *testing.T) {
+	msg := &nats.Msg{Subject: "Lobby.Buy", Header: http.Header{}}
+	msg.Header.Set(DeadlineBudgetHeader, "100")
+	msg.Header.Set(DeadlineSentHeader, strconv.FormatInt(time.Now().Add(-200*time.Millisecond).UnixNano(), 10))
+
+	if DeadlineMiddleware(msg) {
+		t.Fatal("message spent longer than its budget in transit was not dropped")
+	}
+}
+
+func TestDeadlineMiddlewareSubtractsTransit(t *testing.T) {
+	msg := &nats.Msg{Subject: "Lobby.Buy", Header: http.Header{}}
+	msg.Header.Set(DeadlineBudgetHeader, "1000")
+	msg.Header.Set(DeadlineSentHeader, strconv.FormatInt(time.Now().Add(-600*time.Millisecond).UnixNano(), 10))
+
+	if !DeadlineMiddleware(msg) {
+		t.Fatal("message dropped within its budget")
+	}
+	deadline, ok := MsgDeadline(msg)
+	if !ok {
+		t.Fatal("deadline not set")
+	}
+	if remain := time.Until(deadline); remain > 500*time.Millisecond {
+		t.Fatalf("remaining %s , transit time not subtracted", remain)
+	}
+}
+
+func TestDeadlinePropagatesThroughRequest(t *testing.T) {
+	c := newTestClient(t)
+
+	remains := make(chan time.Duration, 1)
+	if _, err := c.Subscribe("Lobby.Buy", "", func(msg *nats.Msg) {
+		deadline, ok := MsgDeadline(msg)
+		if !ok {
+			remains <- -1
+		} else {
+			remains <- time.Until(deadline)
+		}
+		_ = c.Reply(msg.Reply, "", nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := c.RequestWithContext(ctx, "Lobby.Buy", "", nil, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if remain := <-remains; remain <= 0 || remain > 300*time.Millisecond {
+		t.Fatalf("remaining %s , want within the context budget", remain)
+	}
+}
+
+func TestNestedRequestInheritsDeadline(t *testing.T) {
+	c := newTestClient(t)
+
+	remains := make(chan time.Duration, 1)
+	if _, err := c.Subscribe("Lobby.Stock", "", func(msg *nats.Msg) {
+		deadline, _ := MsgDeadline(msg)
+		remains <- time.Until(deadline)
+		_ = c.Reply(msg.Reply, "", nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// 处理函数中使用普通 Request 发出嵌套请求
+	if _, err := c.Subscribe("Lobby.Buy", "", func(msg *nats.Msg) {
+		if _, err := c.Request("Lobby.Stock", "", nil, 5*time.Second); err != nil {
+			t.Error(err)
+		}
+		_ = c.Reply(msg.Reply, "", nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Request("Lobby.Buy", "", nil, 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if remain := <-remains; remain <= 0 || remain > 300*time.Millisecond {
+		t.Fatalf("nested request remaining %s , want within the caller budget", remain)
+	}
+
+	// 处理结束后不再影响其他请求
+	if _, ok := handlingDeadline(); ok {
+		t.Fatal("deadline leaked out of the handler")
+	}
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"github.com/nats-io/nats.go"
+	"sync"
+)
+
+type (
+	// 发布前钩子，可修改即将发出的消息，返回错误时中断发布
+	BeforePublishHook func(*nats.Msg) error
+
+	// 发布后钩子，参数为已发出的消息及发布结果
+	AfterPublishHook func(*nats.Msg, error)
+
+	// 请求前钩子，可修改即将发出的请求消息，返回错误时中断请求
+	BeforeRequestHook func(*nats.Msg) error
+
+	// 收到回复钩子，参数为请求消息及回复消息，可修改回复消息，返回错误时请求以该错误结束
+	ReplyHook func(*nats.Msg, *nats.Msg) error
+
+	// 全局钩子链路，作用于客户端发出的每一条消息
+	hooks struct {
+		mutex         sync.RWMutex
+		beforePublish []BeforePublishHook
+		afterPublish  []AfterPublishHook
+		beforeRequest []BeforeRequestHook
+		onReply       []ReplyHook
+	}
+)
+
+const ()
+
+var ()
+
+func init() {}
+
+func newHooks() *hooks {
+	return &hooks{
+		beforePublish: []BeforePublishHook{},
+		afterPublish:  []AfterPublishHook{},
+		beforeRequest: []BeforeRequestHook{},
+		onReply:       []ReplyHook{},
+	}
+}
+
+func (h *hooks) useBeforePublish(hook BeforePublishHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.beforePublish = append(h.beforePublish, hook)
+}
+
+func (h *hooks) useAfterPublish(hook AfterPublishHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.afterPublish = append(h.afterPublish, hook)
+}
+
+func (h *hooks) useBeforeRequest(hook BeforeRequestHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.beforeRequest = append(h.beforeRequest, hook)
+}
+
+func (h *hooks) useOnReply(hook ReplyHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.onReply = append(h.onReply, hook)
+}
+
+// 按注册顺序执行发布前钩子，任一钩子返回错误即中断
+func (h *hooks) runBeforePublish(msg *nats.Msg) error {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for _, hook := range h.beforePublish {
+		if err := hook(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按注册顺序执行发布后钩子
+func (h *hooks) runAfterPublish(msg *nats.Msg, err error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for _, hook := range h.afterPublish {
+		hook(msg, err)
+	}
+}
+
+// 按注册顺序执行请求前钩子，任一钩子返回错误即中断
+func (h *hooks) runBeforeRequest(msg *nats.Msg) error {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for _, hook := range h.beforeRequest {
+		if err := hook(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按注册的逆序执行回复钩子，与请求前钩子形成对称（例如先加密后压缩的请求，回复先解压后解密）
+func (h *hooks) runOnReply(request, reply *nats.Msg) error {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for i := len(h.onReply) - 1; i >= 0; i-- {
+		if err := h.onReply[i](request, reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
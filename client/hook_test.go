@@ -0,0 +1,85 @@
+package client
+
+import (
+	"errors"
+	"github.com/nats-io/nats.go"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHooksOrder(t *testing.T) {
+	h := newHooks()
+	order := []string{}
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		h.useBeforeRequest(func(*nats.Msg) error {
+			order = append(order, "request "+name)
+			return nil
+		})
+		h.useOnReply(func(*nats.Msg, *nats.Msg) error {
+			order = append(order, "reply "+name)
+			return nil
+		})
+	}
+
+	if err := h.runBeforeRequest(&nats.Msg{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.runOnReply(&nats.Msg{}, &nats.Msg{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 回复钩子按注册的逆序执行
+	want := []string{"request first", "request second", "request third", "reply third", "reply second", "reply first"}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("order = %v , want %v", order, want)
+	}
+}
+
+func TestHooksStopOnError(t *testing.T) {
+	h := newHooks()
+	errStop := errors.New("stop")
+	calls := 0
+	h.useBeforePublish(func(*nats.Msg) error { calls++; return errStop })
+	h.useBeforePublish(func(*nats.Msg) error { calls++; return nil })
+	h.useOnReply(func(*nats.Msg, *nats.Msg) error { calls++; return nil })
+	h.useOnReply(func(*nats.Msg, *nats.Msg) error { calls++; return errStop })
+
+	if err := h.runBeforePublish(&nats.Msg{}); err != errStop {
+		t.Fatalf("before publish error = %v , want %v", err, errStop)
+	}
+	if err := h.runOnReply(&nats.Msg{}, &nats.Msg{}); err != errStop {
+		t.Fatalf("on reply error = %v , want %v", err, errStop)
+	}
+	if calls != 2 {
+		t.Fatalf("hooks called %d times after error , want 2", calls)
+	}
+}
+
+func TestOnReplyHookModifiesReply(t *testing.T) {
+	c := newTestClient(t)
+	if _, err := c.Subscribe("Hook.Echo", "", func(msg *nats.Msg) {
+		_ = c.Reply(msg.Reply, "", msg.Data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 先注册的钩子后执行，看到后注册钩子修改后的回复
+	c.UseOnReply(func(request, reply *nats.Msg) error {
+		reply.Data = append(reply.Data, " outer"...)
+		return nil
+	})
+	c.UseOnReply(func(request, reply *nats.Msg) error {
+		reply.Data = append(reply.Data, " inner"...)
+		return nil
+	})
+
+	response, err := c.Request("Hook.Echo", "", []byte("ping"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response.Data) != "ping inner outer" {
+		t.Fatalf("reply = %q , want %q", response.Data, "ping inner outer")
+	}
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"sherlock/util/rand"
+	"sync"
+	"time"
+)
+
+type (
+	// 重试策略，只应用于幂等请求
+	RetryPolicy struct {
+		MaxAttempts    int           // 最大尝试次数（包含首次请求）
+		InitialBackoff time.Duration // 首次重试前的等待时间
+		MaxBackoff     time.Duration // 最大等待时间
+		Multiplier     float64       // 等待时间增长倍数
+		Jitter         bool          // 是否在等待时间上增加随机抖动，避免重试风暴
+	}
+
+	// 按主题划分的重试策略组
+	retryGroup struct {
+		mutex    sync.RWMutex
+		policies map[string]RetryPolicy // map[subject]RetryPolicy
+	}
+)
+
+const (
+	DefaultRetryMaxAttempts    = 3                      // 默认最多尝试 3 次
+	DefaultRetryInitialBackoff = 100 * time.Millisecond // 默认首次重试等待 100 毫秒
+	DefaultRetryMaxBackoff     = 2 * time.Second        // 默认最大等待 2 秒
+	DefaultRetryMultiplier     = 2.0                    // 默认等待时间翻倍增长
+)
+
+var ()
+
+func init() {}
+
+// 默认重试策略
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    DefaultRetryMaxAttempts,
+		InitialBackoff: DefaultRetryInitialBackoff,
+		MaxBackoff:     DefaultRetryMaxBackoff,
+		Multiplier:     DefaultRetryMultiplier,
+		Jitter:         true,
+	}
+}
+
+// 补全未设置的策略项
+func (rp RetryPolicy) normalize() RetryPolicy {
+	if rp.MaxAttempts <= 0 {
+		rp.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if rp.InitialBackoff <= 0 {
+		rp.InitialBackoff = DefaultRetryInitialBackoff
+	}
+	if rp.MaxBackoff <= 0 {
+		rp.MaxBackoff = DefaultRetryMaxBackoff
+	}
+	if rp.Multiplier < 1 {
+		rp.Multiplier = DefaultRetryMultiplier
+	}
+	return rp
+}
+
+// 第 attempt 次重试前的等待时间，attempt 从 1 开始
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(rp.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= rp.Multiplier
+		if d >= float64(rp.MaxBackoff) {
+			d = float64(rp.MaxBackoff)
+			break
+		}
+	}
+
+	wait := time.Duration(d)
+	if rp.Jitter && wait > 0 {
+		// 在 [wait/2, wait) 区间内随机
+		wait = wait/2 + time.Duration(rand.Int64(int64(wait/2)+1))
+	}
+	return wait
+}
+
+// 是否值得重试，熔断打开等快速失败不再重试
+func isRetryable(err error) bool {
+	return err == nats.ErrTimeout || err == nats.ErrNoResponders
+}
+
+// 在上下文允许的范围内等待
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func newRetryGroup() *retryGroup {
+	return &retryGroup{policies: map[string]RetryPolicy{}}
+}
+
+func (rg *retryGroup) set(subject string, policy RetryPolicy) {
+	rg.mutex.Lock()
+	defer rg.mutex.Unlock()
+
+	rg.policies[subject] = policy.normalize()
+}
+
+// 获取主题对应的重试策略，未注册的主题不重试
+func (rg *retryGroup) get(subject string) (RetryPolicy, bool) {
+	rg.mutex.RLock()
+	defer rg.mutex.RUnlock()
+
+	policy, exist := rg.policies[subject]
+	return policy, exist
+}
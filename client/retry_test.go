@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}.normalize()
+	if policy.MaxAttempts != DefaultRetryMaxAttempts {
+		t.Fatalf("max attempts = %d , want default %d", policy.MaxAttempts, DefaultRetryMaxAttempts)
+	}
+
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if got := policy.backoff(attempt + 1); got != want {
+			t.Errorf("backoff(%d) = %s , want %s", attempt+1, got, want)
+		}
+	}
+
+	// 抖动后的等待时间在 [wait/2, wait] 之间
+	policy.Jitter = true
+	for i := 0; i < 100; i++ {
+		if got := policy.backoff(3); got < 200*time.Millisecond || got > 400*time.Millisecond {
+			t.Fatalf("jittered backoff = %s", got)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nats.ErrTimeout, true},
+		{nats.ErrNoResponders, true},
+		{ErrCircuitOpen, false},
+		{context.DeadlineExceeded, false},
+		{nats.ErrConnectionClosed, false},
+		{errors.New("reply hook"), false},
+	}
+
+	for _, test := range tests {
+		if got := isRetryable(test.err); got != test.want {
+			t.Errorf("isRetryable(%v) = %v , want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// 订阅主题，前 fails 次请求不回复
+func flakyResponder(t *testing.T, c *client, subject string, fails int32) *int32 {
+	t.Helper()
+
+	calls := int32(0)
+	if _, err := c.Subscribe(subject, "", func(msg *nats.Msg) {
+		if atomic.AddInt32(&calls, 1) > fails {
+			_ = c.Reply(msg.Reply, "", []byte("ok"))
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return &calls
+}
+
+func TestRetryOnlyWithPolicy(t *testing.T) {
+	c := newTestClient(t)
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	c.UseRetryPolicy("Retry.Get", policy)
+
+	calls := flakyResponder(t, c, "Retry.Get", 2)
+	response, err := c.Request("Retry.Get", "", nil, 50*time.Millisecond)
+	if err != nil || string(response.Data) != "ok" {
+		t.Fatalf("request = %v , %v", response, err)
+	}
+	if n := atomic.LoadInt32(calls); n != 3 {
+		t.Fatalf("service called %d times , want 3", n)
+	}
+
+	// 未注册策略的主题只请求一次
+	calls = flakyResponder(t, c, "Retry.Post", 2)
+	if _, err := c.Request("Retry.Post", "", nil, 50*time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("request error = %v , want %v", err, nats.ErrTimeout)
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Fatalf("service called %d times , want 1", n)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	c := newTestClient(t)
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	// 重试次数用尽后返回最后一次的错误
+	c.UseRetryPolicy("Retry.None", policy)
+	if _, err := c.Request("Retry.None", "", nil, 50*time.Millisecond); err != nats.ErrNoResponders {
+		t.Fatalf("request error = %v , want %v", err, nats.ErrNoResponders)
+	}
+
+	// 熔断打开等不可重试的错误立即返回
+	c.UseRetryPolicy("Retry.Breaker", policy)
+	c.UseCircuitBreaker("Retry.Breaker", BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	calls := flakyResponder(t, c, "Retry.Breaker", 3)
+	if _, err := c.Request("Retry.Breaker", "", nil, 50*time.Millisecond); err != ErrCircuitOpen {
+		t.Fatalf("request error = %v , want %v", err, ErrCircuitOpen)
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Fatalf("service called %d times , want 1", n)
+	}
+
+	// 上下文结束时不再等待重试
+	c.UseRetryPolicy("Retry.Slow", RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Minute, MaxBackoff: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.RequestWithContext(ctx, "Retry.Slow", "", nil, time.Second); err != nats.ErrNoResponders {
+		t.Fatalf("request error = %v , want %v", err, nats.ErrNoResponders)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("retry waited past the context deadline")
+	}
+}
@@ -0,0 +1,39 @@
+package client
+
+import "strings"
+
+type ()
+
+const (
+	// 主题分隔符
+	SubjectSeparator = "."
+	// 匹配单个层级的通配符
+	SubjectWildcardSingle = "*"
+	// 匹配剩余所有层级的通配符
+	SubjectWildcardFull = ">"
+)
+
+var ()
+
+func init() {}
+
+// 按 NATS 通配符规则判断主题是否匹配模式
+// 例如 Lobby.*.Room 匹配 Lobby.A.Room ，Lobby.> 匹配 Lobby.A.Room
+func MatchSubject(pattern, subject string) bool {
+	p := strings.Split(pattern, SubjectSeparator)
+	s := strings.Split(subject, SubjectSeparator)
+
+	for i, token := range p {
+		if token == SubjectWildcardFull {
+			return len(s) > i
+		}
+		if i >= len(s) {
+			return false
+		}
+		if token != SubjectWildcardSingle && token != s[i] {
+			return false
+		}
+	}
+
+	return len(p) == len(s)
+}
@@ -0,0 +1,419 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	// 压缩算法
+	CompressionAlgorithm string
+
+	// 压缩配置
+	CompressionConfig struct {
+		Algorithm CompressionAlgorithm // 压缩算法
+		Threshold int                  // 数据长度超过该值时才压缩，默认 DefaultCompressionThreshold
+	}
+
+	// 加密配置
+	EncryptionConfig struct {
+		KeyID string // 加密使用的密钥 ID ，密钥需先通过 SetEncryptionKey 注册
+	}
+
+	// 主题数据转换配置，先压缩后加密，接收方先解密后解压
+	TransformConfig struct {
+		Compression *CompressionConfig // 为 nil 时不压缩
+		Encryption  *EncryptionConfig  // 为 nil 时不加密
+	}
+
+	// 主题数据转换规则
+	transformRule struct {
+		pattern string // 主题模式，支持 NATS 通配符
+		config  TransformConfig
+	}
+
+	// 回复主题的转换配置，收到请求时按请求主题记录
+	replyTransform struct {
+		config TransformConfig
+		expire time.Time
+	}
+
+	// 数据转换者
+	transformer struct {
+		mutex   sync.RWMutex
+		rules   []transformRule           // 按注册顺序匹配，先注册者优先
+		keys    map[string][]byte         // 密钥环 map[keyID]key ，轮换后旧密钥保留用于解密
+		replies map[string]replyTransform // map[回复主题]转换配置，回复主题（如 _INBOX.*）不匹配任何规则
+		swept   time.Time                 // 上次清理过期回复配置的时间
+		encoder *zstd.Encoder
+		decoder *zstd.Decoder
+	}
+)
+
+const (
+	CompressionGzip   CompressionAlgorithm = "gzip"
+	CompressionSnappy CompressionAlgorithm = "snappy"
+	CompressionZstd   CompressionAlgorithm = "zstd"
+)
+
+const (
+	// 压缩算法头
+	ContentEncodingHeader = "Sherlock-Content-Encoding"
+	// 加密算法头
+	EncryptionHeader = "Sherlock-Encryption"
+	// 加密密钥 ID 头
+	EncryptionKeyIDHeader = "Sherlock-Encryption-Key-Id"
+
+	// 加密算法
+	EncryptionAESGCM = "aes-gcm"
+
+	// 默认压缩阈值 1KB
+	DefaultCompressionThreshold = 1 << 10
+	// 解压后数据最大长度 64MB ，防止解压炸弹
+	MaxDecodedSize = 64 << 20
+	// 请求未携带截止时间时，回复转换配置的保留时间
+	DefaultReplyTransformTTL = time.Minute
+	// 过期回复转换配置的清理间隔
+	ReplyTransformSweepInterval = 10 * time.Second
+)
+
+var (
+	ErrUnknownCompression = errors.New("unknown compression algorithm")
+	ErrUnknownEncryption  = errors.New("unknown encryption algorithm")
+	ErrUnknownKeyID       = errors.New("unknown encryption key id")
+	ErrDecodedTooLarge    = errors.New("decoded data too large")
+)
+
+func init() {}
+
+func newTransformer() *transformer {
+	encoder, _ := zstd.NewWriter(nil)
+	decoder, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxDecodedSize))
+
+	return &transformer{
+		rules:   []transformRule{},
+		keys:    map[string][]byte{},
+		replies: map[string]replyTransform{},
+		encoder: encoder,
+		decoder: decoder,
+	}
+}
+
+// 注册主题转换配置
+func (t *transformer) use(pattern string, config TransformConfig) error {
+	if config.Compression != nil {
+		switch config.Compression.Algorithm {
+		case CompressionGzip, CompressionSnappy, CompressionZstd:
+		default:
+			return ErrUnknownCompression
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if config.Encryption != nil {
+		if _, exist := t.keys[config.Encryption.KeyID]; !exist {
+			return ErrUnknownKeyID
+		}
+	}
+
+	t.rules = append(t.rules, transformRule{pattern: pattern, config: config})
+	return nil
+}
+
+// 注册密钥，AES 密钥长度必须为 16 、24 或 32 字节
+func (t *transformer) setKey(keyID string, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.keys[keyID] = key
+	return nil
+}
+
+// 查找主题对应的转换配置
+func (t *transformer) match(subject string) (TransformConfig, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for _, rule := range t.rules {
+		if MatchSubject(rule.pattern, subject) {
+			return rule.config, true
+		}
+	}
+	return TransformConfig{}, false
+}
+
+// 记录请求的回复主题，回复时使用与请求相同的转换配置
+// 保留到请求的截止时间，同一请求的多次回复都经过转换
+func (t *transformer) recordReply(msg *nats.Msg) {
+	if msg.Reply == "" {
+		return
+	}
+	config, exist := t.match(msg.Subject)
+	if !exist {
+		return
+	}
+
+	now := time.Now()
+	expire, ok := MsgDeadline(msg)
+	if !ok {
+		expire = now.Add(DefaultReplyTransformTTL)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if now.Sub(t.swept) > ReplyTransformSweepInterval {
+		for reply, rt := range t.replies {
+			if now.After(rt.expire) {
+				delete(t.replies, reply)
+			}
+		}
+		t.swept = now
+	}
+	t.replies[msg.Reply] = replyTransform{config: config, expire: expire}
+}
+
+// 查找回复主题对应的转换配置
+func (t *transformer) matchReply(subject string) (TransformConfig, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	rt, exist := t.replies[subject]
+	if !exist || time.Now().After(rt.expire) {
+		return TransformConfig{}, false
+	}
+	return rt.config, true
+}
+
+func (t *transformer) key(keyID string) ([]byte, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	key, exist := t.keys[keyID]
+	if !exist {
+		return nil, ErrUnknownKeyID
+	}
+	return key, nil
+}
+
+// 发送前编码，在全局发布前及请求前钩子之后执行
+// 不修改原消息，需要编码时返回携带编码后数据的副本，否则返回原消息
+// 回复主题使用所回复请求的转换配置
+func (t *transformer) encode(msg *nats.Msg) (*nats.Msg, error) {
+	config, exist := t.match(msg.Subject)
+	if !exist {
+		config, exist = t.matchReply(msg.Subject)
+	}
+	if !exist {
+		return msg, nil
+	}
+
+	// 已经压缩或加密过的数据不重复处理，仍按规则完成其余步骤，预先压缩的数据同样需要加密
+	compressed := msg.Header.Get(ContentEncodingHeader) != ""
+	if msg.Header.Get(EncryptionHeader) != "" {
+		return msg, nil
+	}
+	if config.Encryption == nil && (config.Compression == nil || compressed) {
+		return msg, nil
+	}
+
+	data := msg.Data
+	header := http.Header{}
+	for k, v := range msg.Header {
+		header[k] = append([]string(nil), v...)
+	}
+
+	if c := config.Compression; c != nil && !compressed {
+		threshold := c.Threshold
+		if threshold <= 0 {
+			threshold = DefaultCompressionThreshold
+		}
+		if len(data) > threshold {
+			compressed, err := t.compress(c.Algorithm, data)
+			if err != nil {
+				return nil, err
+			}
+			// 压缩后没有变小则保持原样
+			if len(compressed) < len(data) {
+				data = compressed
+				header.Set(ContentEncodingHeader, string(c.Algorithm))
+			}
+		}
+	}
+
+	if e := config.Encryption; e != nil {
+		key, err := t.key(e.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := seal(key, data)
+		if err != nil {
+			return nil, err
+		}
+		data = sealed
+		header.Set(EncryptionHeader, EncryptionAESGCM)
+		header.Set(EncryptionKeyIDHeader, e.KeyID)
+	}
+
+	return &nats.Msg{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Header:  header,
+		Data:    data,
+	}, nil
+}
+
+// 接收后解码，根据消息头自动还原数据
+func (t *transformer) decode(msg *nats.Msg) error {
+	if msg == nil || msg.Header == nil {
+		return nil
+	}
+
+	if algorithm := msg.Header.Get(EncryptionHeader); algorithm != "" {
+		if algorithm != EncryptionAESGCM {
+			return ErrUnknownEncryption
+		}
+		key, err := t.key(msg.Header.Get(EncryptionKeyIDHeader))
+		if err != nil {
+			return err
+		}
+		data, err := open(key, msg.Data)
+		if err != nil {
+			return err
+		}
+		msg.Data = data
+		msg.Header.Del(EncryptionHeader)
+		msg.Header.Del(EncryptionKeyIDHeader)
+	}
+
+	if algorithm := msg.Header.Get(ContentEncodingHeader); algorithm != "" {
+		data, err := t.decompress(CompressionAlgorithm(algorithm), msg.Data)
+		if err != nil {
+			return err
+		}
+		msg.Data = data
+		msg.Header.Del(ContentEncodingHeader)
+	}
+
+	return nil
+}
+
+// 订阅链路中的解码中间件，解码失败的消息直接丢弃
+func (t *transformer) decodeMiddleware(msg *nats.Msg) bool {
+	t.recordReply(msg)
+	if err := t.decode(msg); err != nil {
+		log.Printf("decode message of [%s] error : %s", msg.Subject, err.Error())
+		return false
+	}
+	return true
+}
+
+func (t *transformer) compress(algorithm CompressionAlgorithm, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionGzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, data), nil
+	case CompressionZstd:
+		return t.encoder.EncodeAll(data, nil), nil
+	default:
+		return nil, ErrUnknownCompression
+	}
+}
+
+func (t *transformer) decompress(algorithm CompressionAlgorithm, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out, err := ioutil.ReadAll(io.LimitReader(r, MaxDecodedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > MaxDecodedSize {
+			return nil, ErrDecodedTooLarge
+		}
+		return out, nil
+	case CompressionSnappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > MaxDecodedSize {
+			return nil, ErrDecodedTooLarge
+		}
+		return snappy.Decode(nil, data)
+	case CompressionZstd:
+		return t.decoder.DecodeAll(data, nil)
+	default:
+		return nil, ErrUnknownCompression
+	}
+}
+
+// AES-GCM 加密，随机 nonce 置于密文之前
+func seal(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// AES-GCM 解密
+func open(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("cipher text too short : %d", len(data))
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"bytes"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTransformClient(t *testing.T) *client {
+	t.Helper()
+
+	c := newTestClient(t)
+	if err := c.SetEncryptionKey("k1", bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UseTransform("Secret.>", TransformConfig{
+		Compression: &CompressionConfig{Algorithm: CompressionZstd, Threshold: 16},
+		Encryption:  &EncryptionConfig{KeyID: "k1"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTransformRoundTrip(t *testing.T) {
+	c := newTransformClient(t)
+	data := bytes.Repeat([]byte("sherlock"), 64)
+
+	received := make(chan []byte, 1)
+	if _, err := c.Subscribe("Secret.Buy", "", func(msg *nats.Msg) {
+		received <- msg.Data
+		_ = c.Reply(msg.Reply, "", msg.Data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := c.Request("Secret.Buy", "", data, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Fatal("subscriber received undecoded data")
+	}
+	if !bytes.Equal(response.Data, data) {
+		t.Fatal("reply not decoded")
+	}
+}
+
+func TestTransformRunsAfterUserHooks(t *testing.T) {
+	c := newTransformClient(t)
+	data := bytes.Repeat([]byte("sherlock"), 64)
+
+	// 发布前、请求前及回复钩子看到的都是原始数据
+	seen := map[string][]byte{}
+	c.UseBeforePublish(func(msg *nats.Msg) error {
+		seen["publish"] = msg.Data
+		return nil
+	})
+	c.UseBeforeRequest(func(msg *nats.Msg) error {
+		seen["request"] = msg.Data
+		return nil
+	})
+	c.UseOnReply(func(_ *nats.Msg, reply *nats.Msg) error {
+		seen["reply"] = reply.Data
+		return nil
+	})
+
+	if _, err := c.Subscribe("Secret.Buy", "", func(msg *nats.Msg) {
+		_ = c.Reply(msg.Reply, "", msg.Data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Request("Secret.Buy", "", data, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, hook := range []string{"publish", "request", "reply"} {
+		if !bytes.Equal(seen[hook], data) {
+			t.Errorf("%s hook saw transformed data", hook)
+		}
+	}
+}
+
+func TestTransformKeepsCallerMsg(t *testing.T) {
+	c := newTransformClient(t)
+	data := bytes.Repeat([]byte("sherlock"), 64)
+
+	msg := &nats.Msg{Subject: "Secret.Notify", Data: data}
+	if err := c.PublishMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.Data, data) {
+		t.Fatal("caller message data modified")
+	}
+	if msg.Header.Get(EncryptionHeader) != "" || msg.Header.Get(ContentEncodingHeader) != "" {
+		t.Fatal("caller message header modified")
+	}
+}
+
+func TestTransformEncryptsPreCompressedData(t *testing.T) {
+	c := newTransformClient(t)
+	data := []byte("pre-compressed personal data")
+
+	raw := make(chan *nats.Msg, 1)
+	sp, err := c.conn.Subscribe("Secret.Notify", func(msg *nats.Msg) {
+		raw <- msg
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Unsubscribe()
+
+	msg := &nats.Msg{Subject: "Secret.Notify", Header: http.Header{}, Data: data}
+	msg.Header.Set(ContentEncodingHeader, string(CompressionSnappy))
+	if err := c.PublishMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-raw
+	if got.Header.Get(EncryptionHeader) != EncryptionAESGCM || bytes.Contains(got.Data, data) {
+		t.Fatal("pre-compressed data sent in plaintext")
+	}
+	if got.Header.Get(ContentEncodingHeader) != string(CompressionSnappy) {
+		t.Fatal("content encoding header lost")
+	}
+}
+
+func TestTransformAppliesToReply(t *testing.T) {
+	c := newTransformClient(t)
+	data := []byte("reply with personal data")
+
+	if _, err := c.Subscribe("Secret.Buy", "", func(msg *nats.Msg) {
+		_ = c.Reply(msg.Reply, "", data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 绕过客户端直接请求，取得未解码的回复
+	response, err := c.conn.Request("Secret.Buy", nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.Get(EncryptionHeader) != EncryptionAESGCM || bytes.Contains(response.Data, data) {
+		t.Fatal("reply sent in plaintext")
+	}
+	if err := c.trans.decode(response); err != nil || !bytes.Equal(response.Data, data) {
+		t.Fatalf("decode reply error : %v", err)
+	}
+}
@@ -16,6 +16,24 @@ func Del(keys ...string) (int, error) {
 
 	v, err := redisGo.Int(conn.Do("del", args...))
 	if err != nil {
+		_ = conn.Close()
+		return 0, err
+	}
+
+	return v, conn.Close()
+}
+
+// 以毫秒为单位设置键的过期时间
+// 设置成功返回 1 ，键不存在时返回 0
+func PExpire(key string, milliseconds int64) (int, error) {
+	conn, err := GetRedisConn()
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := redisGo.Int(conn.Do("pexpire", key, milliseconds))
+	if err != nil {
+		_ = conn.Close()
 		return 0, err
 	}
 
@@ -18,6 +18,7 @@ func HSet(key string, field string, value interface{}) (int, error) {
 
 	v, err := redisGo.Int(conn.Do("hset", key, field, value))
 	if err != nil {
+		_ = conn.Close()
 		return 0, err
 	}
 
@@ -184,6 +185,7 @@ func HMSet(key string, fv map[string]interface{}) error {
 
 	_, err = conn.Do("hmset", args...)
 	if err != nil {
+		_ = conn.Close()
 		return err
 	}
 
@@ -276,6 +278,7 @@ func HGetAll(key string) (map[string]string, error) {
 
 	data, err := redisGo.ByteSlices(conn.Do("hgetall", key))
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 
@@ -71,6 +71,7 @@ func RPush(key string, values ...interface{}) (int, error) {
 
 	v, err := redisGo.Int(conn.Do("rpush", values...))
 	if err != nil {
+		_ = conn.Close()
 		return 0, err
 	}
 
@@ -254,6 +255,7 @@ func LRange(key string, start, end int) ([]string, error) {
 
 	data, err := redisGo.ByteSlices(conn.Do("lrange", key, start, end))
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 
@@ -278,6 +280,7 @@ func LTrim(key string, start, end int) error {
 
 	_, err = conn.Do("ltrim", key, start, end)
 	if err != nil {
+		_ = conn.Close()
 		return err
 	}
 
@@ -36,6 +36,8 @@ func Set(key, value string, timeoutType TimeoutType, timeoutValue int64, existTy
 	// 失败 nil
 	_, err = redisGo.String(conn.Do("set", key, value, timeoutType, timeoutValue, existType))
 	if err != nil {
+		// 键存在条件不满足时返回 redisGo.ErrNil
+		_ = conn.Close()
 		return err
 	}
 
@@ -53,6 +55,8 @@ func Get(key string) (string, error) {
 	// 失败 nil
 	v, err := redisGo.String(conn.Do("get", key))
 	if err != nil {
+		// 键不存在时返回 redisGo.ErrNil
+		_ = conn.Close()
 		return "", err
 	}
 
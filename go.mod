@@ -7,10 +7,13 @@ require (
 	github.com/golang/protobuf v1.5.1 // indirect
 	github.com/gomodule/redigo v1.8.4
 	github.com/gorilla/websocket v1.4.2
-	github.com/nats-io/nats-server/v2 v2.2.0 // indirect
+	github.com/klauspost/compress v1.11.12
+	github.com/nats-io/nats-server/v2 v2.2.0
 	github.com/nats-io/nats.go v1.10.1-0.20210228004050-ed743748acac
+	github.com/xeipuuv/gojsonschema v1.2.0
 	golang.org/x/sys v0.0.0-20210225134936-a50acf3fe073 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	google.golang.org/protobuf v1.26.0
 	gorm.io/driver/mysql v1.0.5
 	gorm.io/gorm v1.21.6
 )
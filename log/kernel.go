@@ -160,7 +160,8 @@ func (k *kernel) SetHook(hook io.WriteCloser) {
 	k.mutex.Lock()
 	defer k.mutex.Unlock()
 
-	if k.hook != nil {
+	// 标准输出可能被其他日志核心共用，不关闭
+	if k.hook != nil && k.hook != StandardOutputHook {
 		_ = k.hook.Close()
 	}
 
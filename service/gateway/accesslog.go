@@ -0,0 +1,252 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io"
+	"math/rand"
+	nHttp "net/http"
+	"regexp"
+	"sherlock/log"
+	"strings"
+	"time"
+)
+
+type (
+	// 访问日志配置
+	AccessLogConfig struct {
+		// 成功请求的采样率，(0, 1) 之间按比例记录，其他值全部记录，失败的请求（状态码 >= 400）总是记录
+		SampleRate float64
+		// 是否记录请求体，记录前按以下规则脱敏
+		Body bool
+		// 记录的请求体最大字节数，默认 1024
+		MaxBodySize int
+		// JSON 请求体中需要脱敏的字段名，任意层级匹配，不区分大小写，例如 password 、token
+		RedactFields []string
+		// 需要脱敏的内容正则，匹配的内容替换为 ***
+		RedactPatterns []string
+		// 输出钩子，默认为标准输出，可以使用 log.NewFileHook
+		Hook io.WriteCloser
+	}
+
+	// 访问日志项
+	AccessLogEntry struct {
+		Protocol  string  `json:"protocol"` // http websocket sse
+		ClientIP  string  `json:"client_ip"`
+		UserID    string  `json:"user_id,omitempty"`
+		Route     string  `json:"route,omitempty"`   // HTTP 路由 METHOD 路径
+		Subject   string  `json:"subject,omitempty"` // NATS 主题
+		Status    int     `json:"status"`            // HTTP 状态码，WebSocket 消息使用同样语义的状态码
+		BytesIn   int64   `json:"bytes_in"`
+		BytesOut  int64   `json:"bytes_out"`
+		LatencyMS float64 `json:"latency_ms"`
+		RequestID string  `json:"request_id,omitempty"`
+		Error     string  `json:"error,omitempty"`
+		Body      string  `json:"body,omitempty"` // 无法脱敏时不记录，长度见 bytes_in
+	}
+
+	// 访问日志记录者
+	accessLogger struct {
+		config   AccessLogConfig
+		kernel   log.Kernel
+		fields   map[string]struct{}
+		patterns []*regexp.Regexp
+	}
+
+	// 统计读取字节数并按需保留请求体的读取者
+	countingReader struct {
+		io.ReadCloser
+		count int64
+		keep  int // 保留的最大字节数
+		body  []byte
+	}
+)
+
+const (
+	// 上下文中的键
+	SubjectKey   = "Sherlock-Subject"
+	UserIDKey    = "Sherlock-User-ID"
+	RequestIDKey = "Sherlock-Request-ID"
+
+	// 客户端未指定 Sherlock-Request-Id 时也采用该请求头
+	XRequestIDHeader = "X-Request-Id"
+
+	// 默认记录的请求体最大字节数
+	DefaultAccessLogBodySize = 1024
+	// 脱敏替换内容
+	redactedValue = "***"
+)
+
+func newAccessLogger(config AccessLogConfig) *accessLogger {
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = DefaultAccessLogBodySize
+	}
+
+	al := &accessLogger{
+		config: config,
+		kernel: log.NewKernel(),
+		fields: make(map[string]struct{}, len(config.RedactFields)),
+	}
+	// 访问日志不需要调用位置
+	al.kernel.SetFlag(log.FlagMTime)
+	al.kernel.SetFormatter(log.NewJSONFormatter())
+	if config.Hook != nil {
+		al.kernel.SetHook(config.Hook)
+	}
+
+	for _, field := range config.RedactFields {
+		al.fields[strings.ToLower(field)] = struct{}{}
+	}
+	for _, pattern := range config.RedactPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.ErrorF("Ignore access log redact pattern [%s] : %s", pattern, err.Error())
+			continue
+		}
+		al.patterns = append(al.patterns, re)
+	}
+	return al
+}
+
+// 写入访问日志，成功的请求按采样率记录
+func (al *accessLogger) write(entry *AccessLogEntry, body []byte) {
+	if entry.Status < nHttp.StatusBadRequest && al.config.SampleRate > 0 && al.config.SampleRate < 1 &&
+		rand.Float64() >= al.config.SampleRate {
+		return
+	}
+	// 请求体被截断时无法按字段脱敏，不记录
+	if al.config.Body && len(body) > 0 && (len(al.fields) == 0 || int64(len(body)) >= entry.BytesIn) {
+		entry.Body = al.redact(body)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.ErrorF("Marshal access log entry error : %s", err.Error())
+		return
+	}
+	al.kernel.Print(log.LevelInfo, string(data))
+}
+
+// 请求体脱敏，JSON 请求体按字段脱敏，再按正则脱敏，最后截断
+// 设置了脱敏字段时，无法解析的请求体（包括超过保留长度被截断的请求体）不记录，返回空
+func (al *accessLogger) redact(body []byte) string {
+	text := string(body)
+	if len(al.fields) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return ""
+		}
+		data, err := json.Marshal(al.redactValue(v))
+		if err != nil {
+			return ""
+		}
+		text = string(data)
+	}
+	for _, re := range al.patterns {
+		text = re.ReplaceAllString(text, redactedValue)
+	}
+	if len(text) > al.config.MaxBodySize {
+		text = text[:al.config.MaxBodySize] + "..."
+	}
+	return text
+}
+
+func (al *accessLogger) redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			if _, exist := al.fields[strings.ToLower(key)]; exist {
+				value[key] = redactedValue
+			} else {
+				value[key] = al.redactValue(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = al.redactValue(item)
+		}
+	}
+	return v
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.count += int64(n)
+	if remain := cr.keep - len(cr.body); remain > 0 && n > 0 {
+		if remain > n {
+			remain = n
+		}
+		cr.body = append(cr.body, p[:remain]...)
+	}
+	return n, err
+}
+
+// 访问日志中间件，请求结束后记录，长连接的升级请求在连接关闭后记录
+// 同时为请求分配请求 ID ，客户端已指定时沿用，并通过响应头返回
+func (bg *baseGateway) AccessLogMiddleware(context *gin.Context) {
+	requestID := context.GetHeader(RequestIDHeader)
+	if requestID == "" {
+		requestID = context.GetHeader(XRequestIDHeader)
+	}
+	if requestID == "" {
+		requestID = newConnID(context.Request.RemoteAddr)
+	}
+	context.Set(RequestIDKey, requestID)
+	context.Header(RequestIDHeader, requestID)
+
+	al := bg.accessLog
+	if al == nil {
+		return
+	}
+
+	start := time.Now()
+	reader := &countingReader{ReadCloser: context.Request.Body}
+	if al.config.Body {
+		// 脱敏需要完整的 JSON ，这里多保留一些
+		reader.keep = al.config.MaxBodySize * 4
+	}
+	context.Request.Body = reader
+
+	context.Next()
+
+	entry := &AccessLogEntry{
+		Protocol:  ProtocolHTTP,
+		ClientIP:  context.GetString(ClientIPKey),
+		UserID:    context.GetString(UserIDKey),
+		Route:     context.Request.Method + " " + context.FullPath(),
+		Subject:   context.GetString(SubjectKey),
+		Status:    context.Writer.Status(),
+		BytesIn:   reader.count,
+		LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+		RequestID: requestID,
+		Error:     context.Errors.String(),
+	}
+	// 未匹配路由的请求使用请求路径
+	if context.FullPath() == "" {
+		entry.Route = context.Request.Method + " " + context.Request.URL.Path
+	}
+	if size := context.Writer.Size(); size > 0 {
+		entry.BytesOut = int64(size)
+	}
+	switch context.FullPath() {
+	case WebSocketPath:
+		entry.Protocol = ProtocolWebSocket
+		// 升级成功后连接被劫持，状态码不再更新
+		if entry.Status == nHttp.StatusOK {
+			entry.Status = nHttp.StatusSwitchingProtocols
+		}
+	case SSEPath:
+		entry.Protocol = ProtocolSSE
+	}
+	al.write(entry, reader.body)
+}
+
+// 记录 WebSocket 消息
+func (bg *baseGateway) logMessage(entry *AccessLogEntry, start time.Time, body []byte) {
+	if bg.accessLog == nil {
+		return
+	}
+	entry.Protocol = ProtocolWebSocket
+	entry.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+	bg.accessLog.write(entry, body)
+}
@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type bufferHook struct {
+	bytes.Buffer
+}
+
+func (bh *bufferHook) Close() error { return nil }
+
+func TestAccessLogRedact(t *testing.T) {
+	al := newAccessLogger(AccessLogConfig{
+		Body:           true,
+		MaxBodySize:    64,
+		RedactFields:   []string{"password"},
+		RedactPatterns: []string{`\d{11}`},
+	})
+
+	cases := []struct {
+		body string
+		want string
+	}{
+		{`{"user":"alice","password":"secret"}`, `{"password":"***","user":"alice"}`},
+		{`{"profile":{"Password":"secret"},"phone":"13800000000"}`, `{"phone":"***","profile":{"Password":"***"}}`},
+		// 无法解析的请求体不记录
+		{`password=secret`, ``},
+		{`{"password":"secret"`, ``},
+	}
+	for _, c := range cases {
+		if got := al.redact([]byte(c.body)); got != c.want {
+			t.Errorf("redact(%s) = %s , want %s", c.body, got, c.want)
+		}
+	}
+}
+
+func TestAccessLogDropsTruncatedBody(t *testing.T) {
+	hook := &bufferHook{}
+	al := newAccessLogger(AccessLogConfig{Body: true, MaxBodySize: 16, RedactFields: []string{"password"}, Hook: hook})
+
+	// 请求体超过保留长度，只保留了包含密码的前缀
+	body := `{"password":"secret","payload":"` + strings.Repeat("x", 1024) + `"}`
+	kept := []byte(body[:64])
+	al.write(&AccessLogEntry{Status: 200, BytesIn: int64(len(body))}, kept)
+
+	if strings.Contains(hook.String(), "secret") {
+		t.Fatalf("password logged in clear : %s", hook.String())
+	}
+
+	line := struct {
+		Log string `json:"log"`
+	}{}
+	if err := json.Unmarshal(hook.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	entry := &AccessLogEntry{}
+	if err := json.Unmarshal([]byte(line.Log), entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Body != "" || entry.BytesIn != int64(len(body)) {
+		t.Fatalf("entry body %q bytes_in %d", entry.Body, entry.BytesIn)
+	}
+}
@@ -0,0 +1,430 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"os"
+	"sherlock/client"
+	"sherlock/log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// 管理命令的确认回复
+	AdminAck struct {
+		Instance string          `json:"instance"`        // 网关实例 ID
+		Command  string          `json:"command"`         // 命令
+		OK       bool            `json:"ok"`              // 是否执行成功
+		Error    string          `json:"error,omitempty"` // 失败原因
+		Data     json.RawMessage `json:"data,omitempty"`  // 命令结果
+	}
+
+	// 网关实例，发现命令的回复
+	AdminInstance struct {
+		Instance  string    `json:"instance"`
+		Gateway   string    `json:"gateway"`
+		Address   string    `json:"address"`
+		StartedAt time.Time `json:"started_at"`
+		Draining  bool      `json:"draining"`
+	}
+
+	// 长连接信息
+	ConnectionInfo struct {
+		ID          string    `json:"id"`
+		Protocol    string    `json:"protocol"`
+		ClientIP    string    `json:"client_ip"`
+		UserID      string    `json:"user_id,omitempty"`
+		Subprotocol string    `json:"subprotocol,omitempty"`
+		Since       time.Time `json:"since"`
+	}
+
+	// 查询连接命令，指定用户时只返回该用户的连接
+	AdminConnections struct {
+		UserID string `json:"user_id"`
+	}
+
+	// 踢出命令，按连接 ID 或用户 ID 断开连接
+	AdminKick struct {
+		ConnID string `json:"conn_id"`
+		UserID string `json:"user_id"`
+		Reason string `json:"reason"`
+	}
+
+	// 排空命令，排空期间健康检查回复 503 ，不再接受新的长连接，已有的 HTTP 请求及新请求照常处理
+	AdminDrain struct {
+		Enable           bool `json:"enable"`            // 开启或取消排空
+		CloseConnections bool `json:"close_connections"` // 是否同时断开已有的长连接，客户端重连到其他实例
+	}
+
+	// 日志级别命令
+	AdminLogLevel struct {
+		Level string `json:"level"` // TRACE DEBUG INFO WARN ERROR FATAL OFF
+	}
+
+	// 网关统计
+	GatewayStats struct {
+		Instance     string                   `json:"instance"`
+		Gateway      string                   `json:"gateway"`
+		StartedAt    time.Time                `json:"started_at"`
+		Uptime       string                   `json:"uptime"`
+		Draining     bool                     `json:"draining"`
+		Requests     uint64                   `json:"requests"`      // HTTP 请求数
+		ClientErrors uint64                   `json:"client_errors"` // 4xx 回复数
+		ServerErrors uint64                   `json:"server_errors"` // 5xx 回复数
+		Messages     uint64                   `json:"messages"`      // WebSocket 及 TCP 收到的消息数
+		Connections  map[string]int           `json:"connections"`   // 各协议的当前连接数
+		Breakers     []client.BreakerSnapshot `json:"breakers"`
+	}
+
+	// 网关计数
+	gatewayCounter struct {
+		requests     uint64
+		clientErrors uint64
+		serverErrors uint64
+		messages     uint64
+	}
+
+	// 管理命令处理者，HTTP 类网关与 TCP 网关共用
+	adminHandler struct {
+		bg    *baseGateway
+		name  string         // 网关名称
+		label string         // 日志中的网关名称
+		conns []connProtocol // 持有长连接的协议
+	}
+
+	// 持有长连接的协议
+	connProtocol interface {
+		// 当前连接
+		connections() []ConnectionInfo
+		// 断开匹配的连接，返回断开的连接数
+		disconnect(match func(*ConnectionInfo) bool, code int, reason string) int
+	}
+)
+
+const (
+	// 发现主题，所有网关实例都会回复 AdminInstance
+	AdminDiscoverSubject = "Gateway.Admin.Discover"
+	// 实例管理主题前缀 Gateway.Admin.<instance>.<command>
+	AdminSubjectPrefix = "Gateway.Admin"
+
+	// 管理命令
+	AdminCommandDiscover    = "Discover"
+	AdminCommandConnections = "Connections"
+	AdminCommandKick        = "Kick"
+	AdminCommandDrain       = "Drain"
+	AdminCommandLogLevel    = "LogLevel"
+	AdminCommandStats       = "Stats"
+
+	// 协议
+	ProtocolHTTP      = "http"
+	ProtocolWebSocket = "websocket"
+	ProtocolSSE       = "sse"
+	ProtocolSocket    = "socket"
+)
+
+var (
+	ErrUnknownCommand   = errors.New("unknown command")
+	ErrInvalidCommand   = errors.New("invalid command payload")
+	ErrInvalidLogLevel  = errors.New("invalid log level")
+	ErrGatewayDraining  = errors.New("gateway draining")
+	ErrInvalidInstance  = errors.New("invalid instance id")
+	ErrKickTargetNeeded = errors.New("conn_id or user_id is required")
+)
+
+// 实例管理主题
+func AdminSubject(instance, command string) string {
+	return strings.Join([]string{AdminSubjectPrefix, instance, command}, client.SubjectSeparator)
+}
+
+// 发现所有网关实例，在超时时间内收集回复
+func DiscoverGateways(c client.Client, timeout time.Duration) ([]AdminInstance, error) {
+	replies := make(chan *nats.Msg, 64)
+	inbox := nats.NewInbox()
+	sp, err := c.Subscribe(inbox, "", func(msg *nats.Msg) {
+		select {
+		case replies <- msg:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := sp.Unsubscribe(); err != nil {
+			log.ErrorF("Unsubscribe [%s] error : %s", inbox, err.Error())
+		}
+	}()
+
+	if err := c.Publish(AdminDiscoverSubject, inbox, nil); err != nil {
+		return nil, err
+	}
+
+	instances := make([]AdminInstance, 0)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-replies:
+			ack := &AdminAck{}
+			if err := json.Unmarshal(msg.Data, ack); err != nil || !ack.OK {
+				continue
+			}
+			instance := AdminInstance{}
+			if err := json.Unmarshal(ack.Data, &instance); err == nil {
+				instances = append(instances, instance)
+			}
+		case <-timer.C:
+			return instances, nil
+		}
+	}
+}
+
+// 向网关实例发送管理命令，payload 为 nil 时不携带数据
+func AdminRequest(c client.Client, instance, command string, payload interface{}, timeout time.Duration) (*AdminAck, error) {
+	if !validSubjectToken(instance) {
+		return nil, ErrInvalidInstance
+	}
+
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := c.Request(AdminSubject(instance, command), "", data, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	ack := &AdminAck{}
+	if err := json.Unmarshal(response.Data, ack); err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+// 默认实例 ID ，主机名加随机后缀
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	host = strings.ReplaceAll(host, ".", "-")
+	if err != nil || !validSubjectToken(host) {
+		host = "gateway"
+	}
+	return fmt.Sprintf("%s-%s", host, newConnID(host)[:8])
+}
+
+func (gc *gatewayCounter) message() { atomic.AddUint64(&gc.messages, 1) }
+
+// 统计中间件，按回复状态码计数
+func (bg *baseGateway) StatsMiddleware(context *gin.Context) {
+	context.Next()
+
+	atomic.AddUint64(&bg.stats.requests, 1)
+	if status := context.Writer.Status(); status >= 500 {
+		atomic.AddUint64(&bg.stats.serverErrors, 1)
+	} else if status >= 400 {
+		atomic.AddUint64(&bg.stats.clientErrors, 1)
+	}
+}
+
+func (bg *baseGateway) isDraining() bool {
+	return atomic.LoadInt32(&bg.draining) == 1
+}
+
+// 订阅发现主题及实例管理主题，conns 为网关上持有长连接的协议
+func (bg *baseGateway) subscribeAdmin(name, label string, c client.Client, conns ...connProtocol) {
+	ah := &adminHandler{bg: bg, name: name, label: label, conns: conns}
+
+	handlers := []struct {
+		subject string
+		handler nats.MsgHandler
+	}{
+		{AdminDiscoverSubject, func(msg *nats.Msg) {
+			ah.reply(c, msg, AdminCommandDiscover, ah.instance(), nil)
+		}},
+		{AdminSubject(bg.instanceID, client.SubjectWildcardSingle), func(msg *nats.Msg) {
+			command := msg.Subject[strings.LastIndex(msg.Subject, client.SubjectSeparator)+1:]
+			data, err := ah.execute(c, command, msg.Data)
+			ah.reply(c, msg, command, data, err)
+		}},
+	}
+
+	for _, h := range handlers {
+		if sp, err := c.Subscribe(h.subject, "", h.handler); err != nil {
+			log.ErrorF("%s gateway subscribe [%s] error : %s", label, h.subject, err.Error())
+		} else {
+			bg.subscriptions = append(bg.subscriptions, sp)
+			log.DebugF("%s gateway subscribe [%s] success", label, sp.Subject)
+		}
+	}
+}
+
+// 执行管理命令
+func (ah *adminHandler) execute(c client.Client, command string, data []byte) (interface{}, error) {
+	log.InfoF("%s gateway execute admin command [%s] : %s", ah.label, command, string(data))
+
+	switch command {
+	case AdminCommandConnections:
+		args := &AdminConnections{}
+		if err := unmarshalCommand(data, args); err != nil {
+			return nil, err
+		}
+		infos := make([]ConnectionInfo, 0)
+		for _, cp := range ah.conns {
+			for _, info := range cp.connections() {
+				if args.UserID == "" || args.UserID == info.UserID {
+					infos = append(infos, info)
+				}
+			}
+		}
+		return infos, nil
+
+	case AdminCommandKick:
+		args := &AdminKick{}
+		if err := unmarshalCommand(data, args); err != nil {
+			return nil, err
+		}
+		if args.ConnID == "" && args.UserID == "" {
+			return nil, ErrKickTargetNeeded
+		}
+		kicked := ah.disconnect(func(info *ConnectionInfo) bool {
+			return (args.ConnID == "" || args.ConnID == info.ID) && (args.UserID == "" || args.UserID == info.UserID)
+		}, websocket.ClosePolicyViolation, args.Reason)
+		return map[string]int{"kicked": kicked}, nil
+
+	case AdminCommandDrain:
+		args := &AdminDrain{}
+		if err := unmarshalCommand(data, args); err != nil {
+			return nil, err
+		}
+		state := int32(0)
+		if args.Enable {
+			state = 1
+		}
+		atomic.StoreInt32(&ah.bg.draining, state)
+
+		closed := 0
+		if args.Enable && args.CloseConnections {
+			closed = ah.disconnect(func(*ConnectionInfo) bool { return true }, websocket.CloseGoingAway, ErrGatewayDraining.Error())
+		}
+		return map[string]interface{}{"draining": args.Enable, "closed": closed}, nil
+
+	case AdminCommandLogLevel:
+		args := &AdminLogLevel{}
+		if err := unmarshalCommand(data, args); err != nil {
+			return nil, err
+		}
+		level, err := parseLogLevel(args.Level)
+		if err != nil {
+			return nil, err
+		}
+		log.SetFilterLevel(level)
+		return map[string]string{"level": level.String()}, nil
+
+	case AdminCommandStats:
+		return ah.statistics(c), nil
+
+	default:
+		return nil, ErrUnknownCommand
+	}
+}
+
+// 回复确认，未指定回复主题时不回复
+func (ah *adminHandler) reply(c client.Client, msg *nats.Msg, command string, data interface{}, err error) {
+	if msg.Reply == "" {
+		return
+	}
+
+	ack := &AdminAck{Instance: ah.bg.instanceID, Command: command, OK: err == nil}
+	if err != nil {
+		ack.Error = err.Error()
+	} else if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			log.ErrorF("%s gateway marshal admin result of [%s] error : %s", ah.label, command, err.Error())
+			ack.OK, ack.Error = false, err.Error()
+		} else {
+			ack.Data = raw
+		}
+	}
+
+	response, err := json.Marshal(ack)
+	if err != nil {
+		log.ErrorF("%s gateway marshal admin ack of [%s] error : %s", ah.label, command, err.Error())
+		return
+	}
+	if err := c.Reply(msg.Reply, "", response); err != nil {
+		log.ErrorF("%s gateway reply admin ack of [%s] error : %s", ah.label, command, err.Error())
+	}
+}
+
+// 断开所有协议上匹配的连接
+func (ah *adminHandler) disconnect(match func(*ConnectionInfo) bool, code int, reason string) int {
+	n := 0
+	for _, cp := range ah.conns {
+		n += cp.disconnect(match, code, reason)
+	}
+	log.InfoF("%s gateway disconnect %d connections : %s", ah.label, n, reason)
+	return n
+}
+
+func (ah *adminHandler) instance() *AdminInstance {
+	return &AdminInstance{
+		Instance:  ah.bg.instanceID,
+		Gateway:   ah.name,
+		Address:   ah.bg.address,
+		StartedAt: ah.bg.startedAt,
+		Draining:  ah.bg.isDraining(),
+	}
+}
+
+func (ah *adminHandler) statistics(c client.Client) *GatewayStats {
+	stats := &GatewayStats{
+		Instance:     ah.bg.instanceID,
+		Gateway:      ah.name,
+		StartedAt:    ah.bg.startedAt,
+		Uptime:       time.Since(ah.bg.startedAt).Truncate(time.Second).String(),
+		Draining:     ah.bg.isDraining(),
+		Requests:     atomic.LoadUint64(&ah.bg.stats.requests),
+		ClientErrors: atomic.LoadUint64(&ah.bg.stats.clientErrors),
+		ServerErrors: atomic.LoadUint64(&ah.bg.stats.serverErrors),
+		Messages:     atomic.LoadUint64(&ah.bg.stats.messages),
+		Connections:  map[string]int{},
+		Breakers:     c.BreakerStates(),
+	}
+	for _, cp := range ah.conns {
+		for _, info := range cp.connections() {
+			stats.Connections[info.Protocol]++
+		}
+	}
+	return stats
+}
+
+// 解析命令数据，数据为空时使用零值
+func unmarshalCommand(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrInvalidCommand
+	}
+	return nil
+}
+
+// 解析日志级别
+func parseLogLevel(level string) (log.Level, error) {
+	for l := log.LevelAll; l <= log.LevelOff; l++ {
+		if strings.EqualFold(l.String(), level) {
+			return l, nil
+		}
+	}
+	return 0, ErrInvalidLogLevel
+}
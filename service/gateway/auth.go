@@ -0,0 +1,325 @@
+package gateway
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"sherlock/client"
+	"strings"
+	"time"
+)
+
+type (
+	// 已认证的身份
+	Identity struct {
+		UserID    string   `json:"user_id"`    // 用户 ID
+		Roles     []string `json:"roles"`      // 角色
+		SessionID string   `json:"session_id"` // 会话 ID ，认证方未提供时由网关生成
+	}
+
+	// 认证者，在 WebSocket 升级时执行，认证失败则拒绝升级
+	Authenticator interface {
+		// 校验令牌并返回身份
+		// client , token
+		Authenticate(client.Client, string) (*Identity, error)
+	}
+
+	// JWT 认证配置
+	JWTConfig struct {
+		Algorithm string         // 签名算法 HS256 或 RS256
+		Secret    []byte         // HS256 密钥
+		PublicKey *rsa.PublicKey // RS256 公钥
+		Issuer    string         // 不为空时校验 iss
+		Audience  string         // 不为空时校验 aud
+		Leeway    time.Duration  // 校验 exp 、nbf 时允许的时钟偏差
+		// 是否接受不携带 exp 的令牌，默认拒绝，此类令牌永不过期
+		AllowMissingExpiry bool
+	}
+
+	// JWT 认证者，sub 为用户 ID ，roles 为角色，sid 为会话 ID
+	jwtAuthenticator struct {
+		config JWTConfig
+	}
+
+	// JWT 载荷
+	jwtClaims struct {
+		Subject   string          `json:"sub"`
+		Roles     []string        `json:"roles"`
+		SessionID string          `json:"sid"`
+		Issuer    string          `json:"iss"`
+		Audience  json.RawMessage `json:"aud"` // 字符串或字符串数组
+		ExpiresAt int64           `json:"exp"`
+		NotBefore int64           `json:"nbf"`
+	}
+
+	// 不透明令牌认证者，通过 NATS 请求认证主题校验令牌
+	// 请求数据为 AuthRequest ，回复数据为 Identity ，user_id 为空表示认证失败
+	natsAuthenticator struct {
+		subject string
+		timeout time.Duration
+	}
+
+	// 不透明令牌认证请求
+	AuthRequest struct {
+		Token string `json:"token"`
+	}
+)
+
+const (
+	JWTAlgorithmHS256 = "HS256"
+	JWTAlgorithmRS256 = "RS256"
+
+	// 令牌请求参数，浏览器无法为 WebSocket 设置请求头，可通过该参数传递令牌
+	TokenQueryKey = "token"
+	// 令牌请求头前缀
+	BearerPrefix = "Bearer "
+
+	// 身份消息头，网关转发每一条消息时携带
+	UserIDHeader    = "Sherlock-User-Id"
+	UserRolesHeader = "Sherlock-User-Roles"
+	SessionIDHeader = "Sherlock-Session-Id"
+
+	// 默认认证请求超时时间
+	DefaultAuthTimeout = 3 * time.Second
+)
+
+var (
+	ErrMissingToken = errors.New("missing token")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrUnauthorized = errors.New("unauthorized")
+
+	ErrJWTAlgorithm = errors.New("unsupported jwt algorithm")
+	ErrJWTSecret    = errors.New("jwt secret required for HS256")
+	ErrJWTPublicKey = errors.New("jwt public key required for RS256")
+)
+
+// 新建 JWT 认证者，校验算法与密钥配置
+func NewJWTAuthenticator(config JWTConfig) (Authenticator, error) {
+	switch config.Algorithm {
+	case JWTAlgorithmHS256:
+		// 空密钥签名的令牌任何人都能伪造
+		if len(config.Secret) == 0 {
+			return nil, ErrJWTSecret
+		}
+	case JWTAlgorithmRS256:
+		if config.PublicKey == nil {
+			return nil, ErrJWTPublicKey
+		}
+	default:
+		return nil, ErrJWTAlgorithm
+	}
+
+	return &jwtAuthenticator{config: config}, nil
+}
+
+// 新建不透明令牌认证者
+func NewNATSAuthenticator(subject string, timeout time.Duration) Authenticator {
+	if timeout <= 0 {
+		timeout = DefaultAuthTimeout
+	}
+	return &natsAuthenticator{subject: subject, timeout: timeout}
+}
+
+func (ja *jwtAuthenticator) Authenticate(_ client.Client, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	header := struct {
+		Algorithm string `json:"alg"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	// 只接受配置的算法，防止算法替换攻击
+	if header.Algorithm != ja.config.Algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := ja.verify(parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := &jwtClaims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := ja.validate(claims); err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		UserID:    claims.Subject,
+		Roles:     claims.Roles,
+		SessionID: claims.SessionID,
+	}, nil
+}
+
+// 校验签名
+func (ja *jwtAuthenticator) verify(signed string, signature []byte) error {
+	switch ja.config.Algorithm {
+	case JWTAlgorithmHS256:
+		mac := hmac.New(sha256.New, ja.config.Secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return ErrInvalidToken
+		}
+		return nil
+	case JWTAlgorithmRS256:
+		digest := sha256.Sum256([]byte(signed))
+		if err := rsa.VerifyPKCS1v15(ja.config.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return ErrInvalidToken
+		}
+		return nil
+	default:
+		return ErrInvalidToken
+	}
+}
+
+// 校验载荷
+func (ja *jwtAuthenticator) validate(claims *jwtClaims) error {
+	now := time.Now()
+
+	// 用户 ID 用作推送主题片段
+	if !validSubjectToken(claims.Subject) {
+		return ErrInvalidToken
+	}
+	if claims.ExpiresAt <= 0 {
+		if !ja.config.AllowMissingExpiry {
+			return ErrInvalidToken
+		}
+	} else if now.After(time.Unix(claims.ExpiresAt, 0).Add(ja.config.Leeway)) {
+		return ErrTokenExpired
+	}
+	if claims.NotBefore > 0 && now.Add(ja.config.Leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return ErrInvalidToken
+	}
+	if ja.config.Issuer != "" && claims.Issuer != ja.config.Issuer {
+		return ErrInvalidToken
+	}
+	if ja.config.Audience != "" && !containsAudience(claims.Audience, ja.config.Audience) {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+func (na *natsAuthenticator) Authenticate(c client.Client, token string) (*Identity, error) {
+	data, err := json.Marshal(&AuthRequest{Token: token})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.Request(na.subject, "", data, na.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{}
+	if err := json.Unmarshal(response.Data, identity); err != nil {
+		return nil, err
+	}
+	if identity.UserID == "" {
+		return nil, ErrUnauthorized
+	}
+
+	return identity, nil
+}
+
+// 解码 JWT 片段
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// aud 可以是字符串或字符串数组
+func containsAudience(raw json.RawMessage, audience string) bool {
+	if len(raw) == 0 {
+		return false
+	}
+
+	single := ""
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == audience
+	}
+
+	list := make([]string, 0)
+	if err := json.Unmarshal(raw, &list); err == nil {
+		for _, a := range list {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 从请求中获取令牌，优先 Authorization 请求头，其次 token 请求参数
+func tokenFromRequest(r *nHttp.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, BearerPrefix) {
+		return strings.TrimSpace(strings.TrimPrefix(auth, BearerPrefix))
+	}
+	return r.URL.Query().Get(TokenQueryKey)
+}
+
+// 是否拥有任一角色
+func (i *Identity) hasAnyRole(roles []string) bool {
+	if i == nil {
+		return false
+	}
+	for _, role := range roles {
+		for _, r := range i.Roles {
+			if r == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 将身份写入消息头
+func (i *Identity) setHeader(msg *nats.Msg) {
+	if i == nil {
+		return
+	}
+	if msg.Header == nil {
+		msg.Header = nHttp.Header{}
+	}
+
+	msg.Header.Set(UserIDHeader, i.UserID)
+	msg.Header.Set(UserRolesHeader, strings.Join(i.Roles, ","))
+	msg.Header.Set(SessionIDHeader, i.SessionID)
+}
+
+// 从网关转发的消息中获取身份，未携带身份时返回 nil
+func IdentityFromMsg(msg *nats.Msg) *Identity {
+	if msg == nil || msg.Header == nil || msg.Header.Get(UserIDHeader) == "" {
+		return nil
+	}
+
+	identity := &Identity{
+		UserID:    msg.Header.Get(UserIDHeader),
+		Roles:     []string{},
+		SessionID: msg.Header.Get(SessionIDHeader),
+	}
+	if roles := msg.Header.Get(UserRolesHeader); roles != "" {
+		identity.Roles = strings.Split(roles, ",")
+	}
+
+	return identity
+}
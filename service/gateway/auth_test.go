@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// 签发 HS256 令牌
+func signTestJWT(t *testing.T, secret []byte, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": JWTAlgorithmHS256, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTSubjectMustBeSubjectToken(t *testing.T) {
+	secret := []byte("secret")
+	auth, err := NewJWTAuthenticator(JWTConfig{Algorithm: JWTAlgorithmHS256, Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+
+	identity, err := auth.Authenticate(nil, signTestJWT(t, secret, map[string]interface{}{"sub": "alice", "exp": exp}))
+	if err != nil || identity.UserID != "alice" {
+		t.Fatalf("valid token rejected : %v", err)
+	}
+
+	for _, sub := range []string{"", "alice.bob", "*", ">", "a b"} {
+		if _, err := auth.Authenticate(nil, signTestJWT(t, secret, map[string]interface{}{"sub": sub, "exp": exp})); err != ErrInvalidToken {
+			t.Errorf("sub %q error = %v , want %v", sub, err, ErrInvalidToken)
+		}
+	}
+}
+
+func TestJWTConfigValidation(t *testing.T) {
+	tests := []struct {
+		config JWTConfig
+		err    error
+	}{
+		{JWTConfig{Algorithm: JWTAlgorithmHS256}, ErrJWTSecret},
+		{JWTConfig{Algorithm: JWTAlgorithmHS256, Secret: []byte{}}, ErrJWTSecret},
+		{JWTConfig{Algorithm: JWTAlgorithmRS256}, ErrJWTPublicKey},
+		{JWTConfig{Algorithm: "none", Secret: []byte("secret")}, ErrJWTAlgorithm},
+		{JWTConfig{Secret: []byte("secret")}, ErrJWTAlgorithm},
+		{JWTConfig{Algorithm: JWTAlgorithmHS256, Secret: []byte("secret")}, nil},
+	}
+
+	for _, test := range tests {
+		if _, err := NewJWTAuthenticator(test.config); err != test.err {
+			t.Errorf("config %+v error = %v , want %v", test.config, err, test.err)
+		}
+	}
+}
+
+func TestJWTMissingExpiry(t *testing.T) {
+	secret := []byte("secret")
+	token := signTestJWT(t, secret, map[string]interface{}{"sub": "alice"})
+
+	auth, err := NewJWTAuthenticator(JWTConfig{Algorithm: JWTAlgorithmHS256, Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authenticate(nil, token); err != ErrInvalidToken {
+		t.Errorf("token without exp error = %v , want %v", err, ErrInvalidToken)
+	}
+
+	auth, err = NewJWTAuthenticator(JWTConfig{Algorithm: JWTAlgorithmHS256, Secret: secret, AllowMissingExpiry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authenticate(nil, token); err != nil {
+		t.Errorf("token without exp rejected with opt-out : %v", err)
+	}
+
+	expired := signTestJWT(t, secret, map[string]interface{}{"sub": "alice", "exp": time.Now().Add(-time.Minute).Unix()})
+	if _, err := auth.Authenticate(nil, expired); err != ErrTokenExpired {
+		t.Errorf("expired token error = %v , want %v", err, ErrTokenExpired)
+	}
+}
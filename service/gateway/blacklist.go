@@ -3,31 +3,81 @@ package gateway
 import (
 	"encoding/json"
 	"github.com/nats-io/nats.go"
+	"net"
+	"sherlock/database/redis"
 	"sherlock/log"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
 	// 黑名单 , 单独对网关提供黑名单封锁功能，以订阅方式支持启动、关闭、热更新、封禁时间等
+	// 名单项可以是 IPv4/IPv6 地址或 CIDR 网段，白名单优先于黑名单
 	BlackList interface {
-		// 在线订阅更新
+		// 在线订阅更新（全量替换）
 		OnlineUpdate(*nats.Msg)
 		// 在线订阅开关
 		OnlineSwitch(*nats.Msg)
+		// 在线订阅添加（增量）
+		OnlineAdd(*nats.Msg)
+		// 在线订阅移除（增量）
+		OnlineRemove(*nats.Msg)
+		// 在线订阅白名单更新（全量替换）
+		OnlineAllowUpdate(*nats.Msg)
 		// 过滤
 		Filter(string) bool
+		// 从持久化存储中恢复名单
+		Load() error
+	}
+
+	// 黑名单项
+	// 更新及添加的数据格式为 map[IP或CIDR]BlackListEntry ，兼容旧格式 map[IP]struct{}
+	BlackListEntry struct {
+		Expire int64 `json:"expire,omitempty"` // 到期时间（Unix 秒），0 表示永久封禁
+	}
+
+	// 开关数据，兼容旧格式 1/0
+	BlackListSwitch struct {
+		Open bool `json:"open"`
+	}
+
+	// 名单内部项
+	listEntry struct {
+		network *net.IPNet
+		expire  time.Time // 零值表示永久
 	}
 
 	blackList struct {
-		open  bool
-		mutex sync.Mutex
-		list  map[string]struct{}
+		open      bool
+		mutex     sync.RWMutex
+		list      map[string]listEntry // 黑名单 map[规范化的 CIDR]listEntry
+		allow     map[string]listEntry // 白名单 map[规范化的 CIDR]listEntry
+		persist   bool                 // 是否持久化到 Redis
+		lastSweep int64                // 上次清理到期项的时间（UnixNano）
+		pending   []func()             // 待执行的持久化操作，按变更顺序执行
+		notify    chan struct{}        // 通知持久化协程
 	}
 )
 
 const (
 	BlackListUpdateSubject = "Gateway.BlackList.Update"
 	BlackListSwitchSubject = "Gateway.BlackList.Switch"
+	BlackListAddSubject    = "Gateway.BlackList.Add"
+	BlackListRemoveSubject = "Gateway.BlackList.Remove"
+	AllowListUpdateSubject = "Gateway.AllowList.Update"
+)
+
+const (
+	// 黑名单持久化 Redis 键，哈希表 field 为 CIDR ，value 为到期时间
+	BlackListRedisKey = "Sherlock:Gateway:BlackList"
+	// 白名单持久化 Redis 键，哈希表 field 为 CIDR ，value 固定为 0
+	AllowListRedisKey = "Sherlock:Gateway:AllowList"
+
+	// 到期项清理间隔
+	BlackListSweepInterval = time.Minute
 )
 
 var ()
@@ -37,63 +87,341 @@ func init() {}
 // 新建黑名单
 func NewBlackList() BlackList {
 	return &blackList{
-		open:  true,
-		mutex: sync.Mutex{},
-		list:  map[string]struct{}{},
+		open:      true,
+		list:      map[string]listEntry{},
+		allow:     map[string]listEntry{},
+		lastSweep: time.Now().UnixNano(),
 	}
 }
 
-func (bl *blackList) OnlineUpdate(order *nats.Msg) {
-	log.InfoF("Black list before update : %+v", bl.list)
+// 新建持久化黑名单，所有变更由独立协程按顺序写入 Redis ，重启后通过 Load 恢复
+// 使用前需先调用 redis.InitializeRedis
+func NewPersistentBlackList() BlackList {
+	bl := NewBlackList().(*blackList)
+	bl.persist = true
+	bl.notify = make(chan struct{}, 1)
+	go bl.persistLoop()
+	return bl
+}
 
-	newList := new(map[string]struct{})
+// 将 IP 或 CIDR 解析为网段
+func parseTarget(target string) (*net.IPNet, error) {
+	if strings.Contains(target, "/") {
+		_, network, err := net.ParseCIDR(target)
+		return network, err
+	}
 
-	if err := json.Unmarshal(order.Data, newList); err != nil {
-		log.ErrorF("Unmarshal data to []string error : %s", err.Error())
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: target}
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}, nil
+}
+
+// 构建名单，无法解析的项记录日志后忽略
+func buildEntries(entries map[string]BlackListEntry) map[string]listEntry {
+	list := make(map[string]listEntry, len(entries))
+	for target, entry := range entries {
+		network, err := parseTarget(target)
+		if err != nil {
+			log.ErrorF("Parse black list target [%s] error : %s", target, err.Error())
+			continue
+		}
+
+		e := listEntry{network: network}
+		if entry.Expire > 0 {
+			e.expire = time.Unix(entry.Expire, 0)
+		}
+		list[network.String()] = e
+	}
+	return list
+}
+
+// 是否已经到期
+func (e listEntry) expired(now time.Time) bool {
+	return !e.expire.IsZero() && now.After(e.expire)
+}
+
+func (bl *blackList) OnlineUpdate(order *nats.Msg) {
+	entries := map[string]BlackListEntry{}
+	if err := json.Unmarshal(order.Data, &entries); err != nil {
+		log.ErrorF("Unmarshal data to map[string]BlackListEntry error : %s", err.Error())
 		return
 	}
 
 	bl.mutex.Lock()
 	defer bl.mutex.Unlock()
 
-	bl.list = *newList
+	log.InfoF("Black list before update : %d entries", len(bl.list))
+	bl.list = buildEntries(entries)
+	log.InfoF("Black list after update : %d entries", len(bl.list))
 
-	log.InfoF("Black list after update : %+v", bl.list)
+	bl.save(BlackListRedisKey, bl.list, true)
 }
 
 func (bl *blackList) OnlineSwitch(order *nats.Msg) {
+	open := false
+	state, sw := new(int), &BlackListSwitch{}
+	if err := json.Unmarshal(order.Data, state); err == nil {
+		open = *state == 1
+	} else if err := json.Unmarshal(order.Data, sw); err == nil {
+		open = sw.Open
+	} else {
+		log.ErrorF("Unmarshal data to BlackListSwitch error : %s", err.Error())
+		return
+	}
+
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
 	log.InfoF("Black list before open : %v", bl.open)
+	bl.open = open
+	log.InfoF("Black list after open : %v", bl.open)
+}
 
-	state := new(int)
-	if err := json.Unmarshal(order.Data, state); err != nil {
-		log.ErrorF("Unmarshal data to int error : %s", err.Error())
+func (bl *blackList) OnlineAdd(order *nats.Msg) {
+	entries := map[string]BlackListEntry{}
+	if err := json.Unmarshal(order.Data, &entries); err != nil {
+		log.ErrorF("Unmarshal data to map[string]BlackListEntry error : %s", err.Error())
 		return
 	}
 
 	bl.mutex.Lock()
 	defer bl.mutex.Unlock()
 
-	bl.open = *state == 1
+	added := buildEntries(entries)
+	for target, entry := range added {
+		bl.list[target] = entry
+	}
+	log.InfoF("Black list add %d entries", len(added))
 
-	log.InfoF("Black list after open : %v", bl.open)
+	bl.save(BlackListRedisKey, added, false)
 }
 
-func (bl *blackList) Filter(ip string) bool {
-	if !bl.open {
-		return true
+func (bl *blackList) OnlineRemove(order *nats.Msg) {
+	targets := make([]string, 0)
+	if err := json.Unmarshal(order.Data, &targets); err != nil {
+		log.ErrorF("Unmarshal data to []string error : %s", err.Error())
+		return
 	}
 
 	bl.mutex.Lock()
 	defer bl.mutex.Unlock()
 
-	// 名单为空，直接放行
-	if len(bl.list) == 0 {
+	removed := make([]string, 0, len(targets))
+	for _, target := range targets {
+		network, err := parseTarget(target)
+		if err != nil {
+			log.ErrorF("Parse black list target [%s] error : %s", target, err.Error())
+			continue
+		}
+		delete(bl.list, network.String())
+		removed = append(removed, network.String())
+	}
+	log.InfoF("Black list remove %d entries", len(removed))
+
+	bl.delete(BlackListRedisKey, removed)
+}
+
+func (bl *blackList) OnlineAllowUpdate(order *nats.Msg) {
+	targets := make([]string, 0)
+	if err := json.Unmarshal(order.Data, &targets); err != nil {
+		log.ErrorF("Unmarshal data to []string error : %s", err.Error())
+		return
+	}
+
+	entries := make(map[string]BlackListEntry, len(targets))
+	for _, target := range targets {
+		entries[target] = BlackListEntry{}
+	}
+
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	bl.allow = buildEntries(entries)
+	log.InfoF("Allow list after update : %d entries", len(bl.allow))
+
+	bl.save(AllowListRedisKey, bl.allow, true)
+}
+
+// 过滤只持有读锁，到期项由独立协程清理
+func (bl *blackList) Filter(ip string) bool {
+	now := time.Now()
+	bl.trySweep(now)
+
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+
+	// 关闭或名单为空，直接放行
+	if !bl.open || len(bl.list) == 0 {
 		return true
 	}
 
-	if _, exist := bl.list[ip]; exist {
-		return false
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return true
+	}
+
+	// 白名单优先
+	for _, entry := range bl.allow {
+		if entry.network.Contains(parsed) {
+			return true
+		}
+	}
+
+	for _, entry := range bl.list {
+		if entry.network.Contains(parsed) && !entry.expired(now) {
+			return false
+		}
 	}
 
 	return true
 }
+
+func (bl *blackList) Load() error {
+	if !bl.persist {
+		return nil
+	}
+
+	list, err := redis.HGetAll(BlackListRedisKey)
+	if err != nil {
+		return err
+	}
+	allow, err := redis.HGetAll(AllowListRedisKey)
+	if err != nil {
+		return err
+	}
+
+	blackEntries := make(map[string]BlackListEntry, len(list))
+	for target, expire := range list {
+		e, err := strconv.ParseInt(expire, 10, 64)
+		if err != nil {
+			log.ErrorF("Parse expire [%s] of [%s] error : %s", expire, target, err.Error())
+			continue
+		}
+		blackEntries[target] = BlackListEntry{Expire: e}
+	}
+	allowEntries := make(map[string]BlackListEntry, len(allow))
+	for target := range allow {
+		allowEntries[target] = BlackListEntry{}
+	}
+
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	bl.list = buildEntries(blackEntries)
+	bl.allow = buildEntries(allowEntries)
+	bl.sweep(time.Now())
+
+	log.InfoF("Black list load %d entries , allow list load %d entries", len(bl.list), len(bl.allow))
+	return nil
+}
+
+// 到达清理间隔时在独立协程中清理到期项，同一时间只有一个调用方能够触发
+func (bl *blackList) trySweep(now time.Time) {
+	last := atomic.LoadInt64(&bl.lastSweep)
+	if now.Sub(time.Unix(0, last)) < BlackListSweepInterval {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&bl.lastSweep, last, now.UnixNano()) {
+		return
+	}
+
+	go func() {
+		bl.mutex.Lock()
+		defer bl.mutex.Unlock()
+
+		bl.sweep(now)
+	}()
+}
+
+// 清理到期项，调用方需持有锁
+func (bl *blackList) sweep(now time.Time) {
+	expired := make([]string, 0)
+	for target, entry := range bl.list {
+		if entry.expired(now) {
+			delete(bl.list, target)
+			expired = append(expired, target)
+		}
+	}
+
+	if len(expired) > 0 {
+		log.InfoF("Black list remove %d expired entries", len(expired))
+		bl.delete(BlackListRedisKey, expired)
+	}
+}
+
+// 加入持久化操作，调用方需持有锁，操作在持久化协程中按加入顺序执行，不占用锁
+func (bl *blackList) enqueue(op func()) {
+	bl.pending = append(bl.pending, op)
+	select {
+	case bl.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 持久化协程
+func (bl *blackList) persistLoop() {
+	for range bl.notify {
+		bl.mutex.Lock()
+		ops := bl.pending
+		bl.pending = nil
+		bl.mutex.Unlock()
+
+		for _, op := range ops {
+			op()
+		}
+	}
+}
+
+// 持久化名单，replace 为 true 时先清空原有名单，调用方需持有锁
+func (bl *blackList) save(key string, entries map[string]listEntry, replace bool) {
+	if !bl.persist {
+		return
+	}
+
+	// 在锁内复制数据，名单随后可能被替换或修改
+	fv := make(map[string]interface{}, len(entries))
+	for target, entry := range entries {
+		expire := int64(0)
+		if !entry.expire.IsZero() {
+			expire = entry.expire.Unix()
+		}
+		fv[target] = expire
+	}
+
+	bl.enqueue(func() { persistEntries(key, fv, replace) })
+}
+
+// 写入 Redis
+func persistEntries(key string, fv map[string]interface{}, replace bool) {
+	if replace {
+		if _, err := redis.Del(key); err != nil {
+			log.ErrorF("Redis del [%s] error : %s", key, err.Error())
+			return
+		}
+	}
+	if len(fv) == 0 {
+		return
+	}
+
+	if err := redis.HMSet(key, fv); err != nil {
+		log.ErrorF("Redis hmset [%s] error : %s", key, err.Error())
+	}
+}
+
+// 删除持久化的名单项，调用方需持有锁
+func (bl *blackList) delete(key string, targets []string) {
+	if !bl.persist || len(targets) == 0 {
+		return
+	}
+
+	bl.enqueue(func() {
+		if _, err := redis.HDel(key, targets...); err != nil {
+			log.ErrorF("Redis hdel [%s] error : %s", key, err.Error())
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlackListFilter(t *testing.T) {
+	bl := NewBlackList()
+	bl.OnlineAdd(&nats.Msg{Data: []byte(fmt.Sprintf(`{"10.0.0.0/8":{},"192.0.2.7":{"expire":%d}}`, time.Now().Add(-time.Second).Unix()))})
+	bl.OnlineAllowUpdate(&nats.Msg{Data: []byte(`["10.1.0.0/16"]`)})
+
+	cases := map[string]bool{
+		"10.2.3.4":  false, // 黑名单网段
+		"10.1.3.4":  true,  // 白名单优先
+		"192.0.2.7": true,  // 已到期
+		"192.0.2.8": true,
+		"not-an-ip": true,
+	}
+	for ip, want := range cases {
+		if got := bl.Filter(ip); got != want {
+			t.Errorf("Filter(%s) = %v , want %v", ip, got, want)
+		}
+	}
+
+	bl.OnlineSwitch(&nats.Msg{Data: []byte(`{"open":false}`)})
+	if !bl.Filter("10.2.3.4") {
+		t.Error("closed black list still blocks")
+	}
+}
+
+func TestBlackListConcurrentUpdate(t *testing.T) {
+	bl := NewBlackList()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				bl.Filter(fmt.Sprintf("10.0.%d.%d", i, j))
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			bl.OnlineAdd(&nats.Msg{Data: []byte(fmt.Sprintf(`{"10.0.%d.0/24":{}}`, i))})
+		}(i)
+	}
+	wg.Wait()
+
+	if bl.Filter("10.0.3.1") {
+		t.Error("added entry not applied")
+	}
+}
+
+func TestFilterIPMiddlewareForbidden(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0"))
+	// httptest 请求的客户端地址为 192.0.2.1
+	eg.bl.OnlineAdd(&nats.Msg{Data: []byte(`{"192.0.2.1":{}}`)})
+
+	recorder := serve(eg, nHttp.MethodPost, "/Lobby/Buy", nil)
+	if recorder.Code != nHttp.StatusForbidden {
+		t.Fatalf("status = %d , want %d", recorder.Code, nHttp.StatusForbidden)
+	}
+	response := &ErrorResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil || !strings.Contains(response.Error.Message, ErrBlocked.Error()) {
+		t.Fatalf("body = %s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,343 @@
+package gateway
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"sherlock/log"
+	"sync"
+	"time"
+)
+
+type (
+	// WebSocket 连接配置
+	ConnectionConfig struct {
+		MaxConnections int           // 最大连接数，0 表示不限制
+		MaxMessageSize int64         // 客户端单条消息最大字节数，超过时断开连接
+		SendQueueSize  int           // 发送队列长度，队列写满视为慢速连接并断开
+		WriteTimeout   time.Duration // 单次写入超时时间
+		PongTimeout    time.Duration // 读超时时间，期间未收到任何消息或 pong 即驱逐连接
+		PingInterval   time.Duration // ping 间隔，必须小于 PongTimeout
+		Compression    bool          // 是否协商 permessage-deflate 压缩
+	}
+
+	// 受管理的 WebSocket 连接
+	// 所有写入都经由发送队列交给写协程完成，gorilla 不允许并发写入
+	wsConn struct {
+		id       string
+		clientIP string
+		userID   string    // 已认证的用户 ID ，匿名连接为空
+		since    time.Time // 建立时间
+		conn     *websocket.Conn
+		codec    frameCodec       // 按协商的子协议选择的帧编解码
+		pending  *pendingRequests // 等待回复的请求
+		config   ConnectionConfig
+		send     chan outFrame
+		done     chan struct{}
+		once     sync.Once
+	}
+
+	// 待写出的帧
+	outFrame struct {
+		messageType int
+		data        []byte
+	}
+
+	// 连接管理者
+	connManager struct {
+		config ConnectionConfig
+		mutex  sync.RWMutex
+		conns  map[string]*wsConn
+		closed bool
+	}
+)
+
+const (
+	DefaultMaxMessageSize = 64 << 10
+	DefaultSendQueueSize  = 256
+	DefaultWriteTimeout   = 10 * time.Second
+	DefaultPongTimeout    = 60 * time.Second
+)
+
+var (
+	ErrTooManyConnections = errors.New("too many connections")
+	ErrSendQueueFull      = errors.New("send queue full")
+	ErrConnClosed         = errors.New("connection closed")
+	ErrGatewayClosed      = errors.New("gateway closed")
+)
+
+// 默认连接配置
+func DefaultConnectionConfig() ConnectionConfig {
+	return ConnectionConfig{
+		MaxConnections: 0,
+		MaxMessageSize: DefaultMaxMessageSize,
+		SendQueueSize:  DefaultSendQueueSize,
+		WriteTimeout:   DefaultWriteTimeout,
+		PongTimeout:    DefaultPongTimeout,
+		PingInterval:   DefaultPongTimeout * 9 / 10,
+	}
+}
+
+func newConnManager(config ConnectionConfig) *connManager {
+	d := DefaultConnectionConfig()
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = d.MaxMessageSize
+	}
+	if config.SendQueueSize <= 0 {
+		config.SendQueueSize = d.SendQueueSize
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = d.WriteTimeout
+	}
+	if config.PongTimeout <= 0 {
+		config.PongTimeout = d.PongTimeout
+	}
+	if config.PingInterval <= 0 || config.PingInterval >= config.PongTimeout {
+		config.PingInterval = config.PongTimeout * 9 / 10
+	}
+
+	return &connManager{
+		config: config,
+		conns:  map[string]*wsConn{},
+	}
+}
+
+// 是否已达到最大连接数，升级前预先检查，避免无谓的升级
+func (cm *connManager) full() bool {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	return cm.closed || (cm.config.MaxConnections > 0 && len(cm.conns) >= cm.config.MaxConnections)
+}
+
+// 当前连接数
+func (cm *connManager) count() int {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	return len(cm.conns)
+}
+
+// 登记已升级的连接并启动写协程
+func (cm *connManager) add(conn *websocket.Conn, clientIP, userID string) (*wsConn, error) {
+	wc := &wsConn{
+		id:       newConnID(clientIP + "|" + conn.RemoteAddr().String()),
+		clientIP: clientIP,
+		userID:   userID,
+		since:    time.Now(),
+		conn:     conn,
+		codec:    codecOf(conn.Subprotocol()),
+		pending:  newPendingRequests(),
+		config:   cm.config,
+		send:     make(chan outFrame, cm.config.SendQueueSize),
+		done:     make(chan struct{}),
+	}
+
+	cm.mutex.Lock()
+	if cm.closed {
+		cm.mutex.Unlock()
+		wc.close(websocket.CloseGoingAway, ErrGatewayClosed.Error())
+		return nil, ErrGatewayClosed
+	}
+	// 预先检查与登记之间可能有其他连接完成升级，这里再次检查
+	if cm.config.MaxConnections > 0 && len(cm.conns) >= cm.config.MaxConnections {
+		cm.mutex.Unlock()
+		wc.close(websocket.CloseTryAgainLater, ErrTooManyConnections.Error())
+		return nil, ErrTooManyConnections
+	}
+	cm.conns[wc.id] = wc
+	cm.mutex.Unlock()
+
+	wc.conn.SetReadLimit(cm.config.MaxMessageSize)
+	wc.extendReadDeadline()
+	wc.conn.SetPongHandler(func(string) error {
+		wc.extendReadDeadline()
+		return nil
+	})
+
+	go wc.writePump()
+
+	return wc, nil
+}
+
+// 注销并关闭连接
+func (cm *connManager) remove(wc *wsConn) {
+	cm.mutex.Lock()
+	delete(cm.conns, wc.id)
+	cm.mutex.Unlock()
+
+	wc.close(websocket.CloseNormalClosure, "")
+}
+
+// 关闭所有连接，之后不再接受新连接
+// 升级后的连接已被 HTTP 服务劫持，Shutdown 不会关闭它们
+func (cm *connManager) closeAll() {
+	cm.mutex.Lock()
+	cm.closed = true
+	conns := make([]*wsConn, 0, len(cm.conns))
+	for _, wc := range cm.conns {
+		conns = append(conns, wc)
+	}
+	cm.mutex.Unlock()
+
+	for _, wc := range conns {
+		wc.close(websocket.CloseGoingAway, ErrGatewayClosed.Error())
+	}
+}
+
+// 断开匹配的连接，返回断开的连接数
+func (cm *connManager) disconnect(match func(*ConnectionInfo) bool, code int, reason string) int {
+	cm.mutex.RLock()
+	conns := make([]*wsConn, 0)
+	for _, wc := range cm.conns {
+		if info := wc.info(); match(&info) {
+			conns = append(conns, wc)
+		}
+	}
+	cm.mutex.RUnlock()
+
+	// 读协程随即返回错误并完成注销
+	for _, wc := range conns {
+		wc.close(code, reason)
+	}
+	return len(conns)
+}
+
+// 所有连接的信息
+func (cm *connManager) connections() []ConnectionInfo {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	infos := make([]ConnectionInfo, 0, len(cm.conns))
+	for _, wc := range cm.conns {
+		infos = append(infos, wc.info())
+	}
+	return infos
+}
+
+// 连接信息
+func (wc *wsConn) info() ConnectionInfo {
+	return ConnectionInfo{
+		ID:          wc.id,
+		Protocol:    ProtocolWebSocket,
+		ClientIP:    wc.clientIP,
+		UserID:      wc.userID,
+		Subprotocol: wc.codec.subprotocol(),
+		Since:       wc.since,
+	}
+}
+
+// 推送原始数据
+func (wc *wsConn) push(data []byte) error {
+	return wc.pushMessage(&Message{Data: data})
+}
+
+// 按连接的帧格式编码后放入发送队列，队列写满时断开连接，避免慢速连接拖累推送
+// 调用方可能是订阅回调，不能在此阻塞写入，关闭连接异步完成
+func (wc *wsConn) pushMessage(message *Message) error {
+	messageType, data, err := wc.codec.encode(message)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-wc.done:
+		return ErrConnClosed
+	default:
+	}
+
+	select {
+	case wc.send <- outFrame{messageType: messageType, data: data}:
+		return nil
+	case <-wc.done:
+		return ErrConnClosed
+	default:
+		log.ErrorF("WebSocket connection [%s] send queue full , close it", wc.clientIP)
+		wc.closeAsync(websocket.ClosePolicyViolation, ErrSendQueueFull.Error())
+		return ErrSendQueueFull
+	}
+}
+
+// 读取一条帧，收到帧即视为连接存活
+func (wc *wsConn) read() ([]byte, error) {
+	_, data, err := wc.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	wc.extendReadDeadline()
+	return data, nil
+}
+
+func (wc *wsConn) extendReadDeadline() {
+	if err := wc.conn.SetReadDeadline(time.Now().Add(wc.config.PongTimeout)); err != nil {
+		log.DebugF("WebSocket connection [%s] set read deadline error : %s", wc.clientIP, err.Error())
+	}
+}
+
+// 写协程，串行写出发送队列中的消息并定时 ping
+func (wc *wsConn) writePump() {
+	ticker := time.NewTicker(wc.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case frame := <-wc.send:
+			if err := wc.write(frame.messageType, frame.data); err != nil {
+				log.ErrorF("Write message to [%s] error : %s", wc.clientIP, err.Error())
+				wc.close(websocket.CloseInternalServerErr, "")
+				return
+			}
+		case <-ticker.C:
+			if err := wc.write(websocket.PingMessage, nil); err != nil {
+				log.DebugF("Ping [%s] error : %s", wc.clientIP, err.Error())
+				wc.close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-wc.done:
+			return
+		}
+	}
+}
+
+func (wc *wsConn) write(messageType int, data []byte) error {
+	if err := wc.conn.SetWriteDeadline(time.Now().Add(wc.config.WriteTimeout)); err != nil {
+		return err
+	}
+	return wc.conn.WriteMessage(messageType, data)
+}
+
+// 发送关闭帧后关闭底层连接，读循环随之返回
+// WriteControl 及 Close 可以与其他写入并发调用
+func (wc *wsConn) close(code int, reason string) {
+	if wc.markClosed() {
+		wc.closeConn(code, reason)
+	}
+}
+
+// 标记关闭后在新协程中关闭底层连接，供推送等不能被慢速连接阻塞的路径调用
+func (wc *wsConn) closeAsync(code int, reason string) {
+	if wc.markClosed() {
+		go wc.closeConn(code, reason)
+	}
+}
+
+// 标记连接已关闭，只有首次调用返回 true
+func (wc *wsConn) markClosed() bool {
+	marked := false
+	wc.once.Do(func() {
+		marked = true
+		close(wc.done)
+		wc.pending.clear()
+	})
+	return marked
+}
+
+// 写出关闭帧并关闭底层连接，最长阻塞 WriteTimeout
+func (wc *wsConn) closeConn(code int, reason string) {
+	deadline := time.Now().Add(wc.config.WriteTimeout)
+	if err := wc.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline); err != nil {
+		log.DebugF("WebSocket connection [%s] write close message error : %s", wc.clientIP, err.Error())
+	}
+	if err := wc.conn.Close(); err != nil {
+		log.ErrorF("WebSocket connection [%s] close error : %s", wc.clientIP, err.Error())
+	}
+}
@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"github.com/gorilla/websocket"
+	nHttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 建立一对 WebSocket 连接，返回服务端连接，客户端连接不读取任何数据
+func newTestConnPair(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(nHttp.HandlerFunc(func(w nHttp.ResponseWriter, r *nHttp.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	dialTest(t, "ws"+strings.TrimPrefix(server.URL, "http"))
+	select {
+	case conn := <-conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(time.Second):
+		t.Fatal("upgrade timeout")
+		return nil
+	}
+}
+
+func TestPushToFullQueueDoesNotBlock(t *testing.T) {
+	conn := newTestConnPair(t)
+	config := DefaultConnectionConfig()
+	config.WriteTimeout = 5 * time.Second
+	wc := &wsConn{
+		clientIP: "127.0.0.1",
+		conn:     conn,
+		codec:    codecOf(""),
+		pending:  newPendingRequests(),
+		config:   config,
+		send:     make(chan outFrame, 1),
+		done:     make(chan struct{}),
+	}
+
+	// 对端不读取，大消息写满缓冲区后持有写锁，关闭帧需要等待写入超时
+	go func() {
+		_ = conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+		_ = conn.WriteMessage(websocket.BinaryMessage, make([]byte, 64<<20))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := wc.push([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := wc.push([]byte("2")); err != ErrSendQueueFull {
+		t.Fatalf("error = %v , want %v", err, ErrSendQueueFull)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("push blocked for %s", elapsed)
+	}
+	if err := wc.push([]byte("3")); err != ErrConnClosed {
+		t.Fatalf("error = %v , want %v", err, ErrConnClosed)
+	}
+}
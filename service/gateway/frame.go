@@ -0,0 +1,279 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type (
+	// WebSocket 帧编解码，按握手时协商的子协议选择
+	frameCodec interface {
+		// 子协议名称
+		subprotocol() string
+		// 解码客户端发送的帧
+		decode([]byte) (*Message, error)
+		// 编码发往客户端的帧，返回帧类型及数据
+		encode(*Message) (int, []byte, error)
+	}
+
+	// JSON 文本帧，未协商子协议时的默认格式
+	// 客户端发送 Message 的 JSON 编码，回复为服务回复的原始数据，
+	// 请求携带了请求 ID 时回复为 Message 的 JSON 编码
+	jsonCodec struct{}
+
+	// 二进制帧
+	// 1 字节版本 + 1 字节负载编码 + 1 字节主题长度 + 主题 + 1 字节请求 ID 长度 + 请求 ID + 原始负载
+	// 负载编码为 error 时负载为错误信息
+	// 携带会话序号的帧使用版本 2 ，在负载编码之后插入 8 字节大端序号
+	binaryCodec struct{}
+
+	// protobuf 信封二进制帧
+	// message Envelope {
+	//   string subject = 1;
+	//   string request_id = 2;
+	//   bytes data = 3;
+	//   string codec = 4;
+	//   string error = 5;
+	//   uint64 seq = 6;
+	// }
+	protoCodec struct{}
+)
+
+const (
+	// WebSocket 子协议
+	SubprotocolJSON   = "sherlock.json"
+	SubprotocolBinary = "sherlock.binary"
+	SubprotocolProto  = "sherlock.proto"
+
+	// 负载编码消息头，转发给服务，告知其负载的编码格式
+	PayloadCodecHeader = "Sherlock-Payload-Codec"
+
+	// 负载编码
+	PayloadCodecRaw      = ""
+	PayloadCodecJSON     = "json"
+	PayloadCodecProtobuf = "protobuf"
+	PayloadCodecError    = "error" // 仅用于二进制帧，表示负载为错误信息
+
+	// 二进制帧版本
+	BinaryFrameVersion    = 1
+	BinaryFrameVersionSeq = 2 // 携带会话序号
+	// 会话序号长度
+	binaryFrameSeqLength = 8
+	// 二进制帧固定头部长度：版本 + 负载编码 + 主题长度 + 请求 ID 长度
+	binaryFrameFixedLength = 4
+	// 主题及请求 ID 的最大长度
+	binaryFieldMaxLength = 255
+)
+
+const (
+	envelopeSubject protowire.Number = iota + 1
+	envelopeRequestID
+	envelopeData
+	envelopeCodec
+	envelopeError
+	envelopeSeq
+)
+
+var (
+	// 服务端支持的子协议，按优先顺序排列
+	subprotocols = []string{SubprotocolBinary, SubprotocolProto, SubprotocolJSON}
+
+	// 二进制帧中的负载编码
+	payloadCodecs = []string{PayloadCodecRaw, PayloadCodecJSON, PayloadCodecProtobuf, PayloadCodecError}
+
+	ErrInvalidFrame = errors.New("invalid frame")
+)
+
+// 根据协商的子协议选择编解码，未协商时使用 JSON
+func codecOf(subprotocol string) frameCodec {
+	switch subprotocol {
+	case SubprotocolBinary:
+		return binaryCodec{}
+	case SubprotocolProto:
+		return protoCodec{}
+	default:
+		return jsonCodec{}
+	}
+}
+
+func (jsonCodec) subprotocol() string { return SubprotocolJSON }
+func (jsonCodec) decode(data []byte) (*Message, error) {
+	message := &Message{}
+	if err := json.Unmarshal(data, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+func (jsonCodec) encode(message *Message) (int, []byte, error) {
+	// 未携带主题、请求 ID 、错误及会话序号时保持原始数据，兼容旧客户端
+	if message.Subject == "" && message.RequestID == "" && message.Error == "" && message.Seq == 0 {
+		return websocket.TextMessage, message.Data, nil
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, data, nil
+}
+
+func (binaryCodec) subprotocol() string { return SubprotocolBinary }
+func (binaryCodec) decode(data []byte) (*Message, error) {
+	if len(data) < binaryFrameFixedLength || int(data[1]) >= len(payloadCodecs) {
+		return nil, ErrInvalidFrame
+	}
+	message := &Message{Codec: payloadCodecs[data[1]]}
+
+	offset := 2
+	switch data[0] {
+	case BinaryFrameVersion:
+	case BinaryFrameVersionSeq:
+		if len(data) < binaryFrameFixedLength+binaryFrameSeqLength {
+			return nil, ErrInvalidFrame
+		}
+		message.Seq = binary.BigEndian.Uint64(data[offset:])
+		offset += binaryFrameSeqLength
+	default:
+		return nil, ErrInvalidFrame
+	}
+	subject, offset, err := readField(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	requestID, offset, err := readField(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	message.Subject = subject
+	message.RequestID = requestID
+	message.Data = data[offset:]
+	return message, nil
+}
+func (binaryCodec) encode(message *Message) (int, []byte, error) {
+	if len(message.Subject) > binaryFieldMaxLength || len(message.RequestID) > binaryFieldMaxLength {
+		return 0, nil, ErrInvalidFrame
+	}
+
+	codec, payload := 0, message.Data
+	for i, c := range payloadCodecs {
+		if c == message.Codec {
+			codec = i
+			break
+		}
+	}
+	if message.Error != "" {
+		codec, payload = len(payloadCodecs)-1, []byte(message.Error)
+	}
+
+	frame := make([]byte, 0, binaryFrameFixedLength+binaryFrameSeqLength+len(message.Subject)+len(message.RequestID)+len(payload))
+	if message.Seq == 0 {
+		frame = append(frame, BinaryFrameVersion, byte(codec))
+	} else {
+		seq := make([]byte, binaryFrameSeqLength)
+		binary.BigEndian.PutUint64(seq, message.Seq)
+		frame = append(frame, BinaryFrameVersionSeq, byte(codec))
+		frame = append(frame, seq...)
+	}
+	frame = append(frame, byte(len(message.Subject)))
+	frame = append(frame, message.Subject...)
+	frame = append(frame, byte(len(message.RequestID)))
+	frame = append(frame, message.RequestID...)
+	frame = append(frame, payload...)
+	return websocket.BinaryMessage, frame, nil
+}
+
+// 读取 1 字节长度 + 内容的字段
+func readField(data []byte, offset int) (string, int, error) {
+	if offset >= len(data) {
+		return "", offset, ErrInvalidFrame
+	}
+	length := int(data[offset])
+	offset++
+	if offset+length > len(data) {
+		return "", offset, ErrInvalidFrame
+	}
+	return string(data[offset : offset+length]), offset + length, nil
+}
+
+func (protoCodec) subprotocol() string { return SubprotocolProto }
+func (protoCodec) decode(data []byte) (*Message, error) {
+	message := &Message{}
+	for len(data) > 0 {
+		number, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, ErrInvalidFrame
+		}
+		data = data[n:]
+
+		if number == envelopeSeq && typ == protowire.VarintType {
+			value, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return nil, ErrInvalidFrame
+			}
+			data = data[n:]
+			message.Seq = value
+			continue
+		}
+		if typ != protowire.BytesType {
+			// 未知字段跳过，兼容信封扩展
+			n = protowire.ConsumeFieldValue(number, typ, data)
+			if n < 0 {
+				return nil, ErrInvalidFrame
+			}
+			data = data[n:]
+			continue
+		}
+
+		value, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return nil, ErrInvalidFrame
+		}
+		data = data[n:]
+
+		switch number {
+		case envelopeSubject:
+			message.Subject = string(value)
+		case envelopeRequestID:
+			message.RequestID = string(value)
+		case envelopeData:
+			message.Data = value
+		case envelopeCodec:
+			message.Codec = string(value)
+		case envelopeError:
+			message.Error = string(value)
+		}
+	}
+	return message, nil
+}
+func (protoCodec) encode(message *Message) (int, []byte, error) {
+	frame := make([]byte, 0, len(message.Subject)+len(message.RequestID)+len(message.Data)+len(message.Codec)+len(message.Error)+20)
+	if message.Subject != "" {
+		frame = protowire.AppendTag(frame, envelopeSubject, protowire.BytesType)
+		frame = protowire.AppendString(frame, message.Subject)
+	}
+	if message.RequestID != "" {
+		frame = protowire.AppendTag(frame, envelopeRequestID, protowire.BytesType)
+		frame = protowire.AppendString(frame, message.RequestID)
+	}
+	if len(message.Data) > 0 {
+		frame = protowire.AppendTag(frame, envelopeData, protowire.BytesType)
+		frame = protowire.AppendBytes(frame, message.Data)
+	}
+	if message.Codec != "" {
+		frame = protowire.AppendTag(frame, envelopeCodec, protowire.BytesType)
+		frame = protowire.AppendString(frame, message.Codec)
+	}
+	if message.Error != "" {
+		frame = protowire.AppendTag(frame, envelopeError, protowire.BytesType)
+		frame = protowire.AppendString(frame, message.Error)
+	}
+	if message.Seq != 0 {
+		frame = protowire.AppendTag(frame, envelopeSeq, protowire.VarintType)
+		frame = protowire.AppendVarint(frame, message.Seq)
+	}
+	return websocket.BinaryMessage, frame, nil
+}
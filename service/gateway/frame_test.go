@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 往返测试使用的消息
+var frameMessages = []*Message{
+	{Subject: "Lobby.Buy", Data: []byte(`{"item":1}`)},
+	{Subject: "Lobby.Buy", RequestID: "r1", Codec: PayloadCodecJSON, Data: []byte(`{"item":1}`)},
+	{Subject: "Lobby.Buy", RequestID: "r2", Codec: PayloadCodecProtobuf, Data: []byte{0x08, 0x01}},
+	{Subject: "Push.alice", Seq: 42, Data: []byte("hello")},
+	{Subject: "Push.alice", Seq: 1 << 63, Codec: PayloadCodecJSON, Data: []byte(`{}`)},
+	{Subject: strings.Repeat("s", binaryFieldMaxLength), RequestID: strings.Repeat("r", binaryFieldMaxLength)},
+	{},
+}
+
+// 解码不出错也不 panic
+func decodeSafely(t *testing.T, codec frameCodec, data []byte) (message *Message, err error) {
+	t.Helper()
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("%s decode of %x panic : %v", codec.subprotocol(), data, r)
+		}
+	}()
+	return codec.decode(data)
+}
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	codec := binaryCodec{}
+
+	for _, message := range frameMessages {
+		typ, frame, err := codec.encode(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != websocket.BinaryMessage {
+			t.Fatalf("frame type = %d , want binary", typ)
+		}
+		got, err := codec.decode(frame)
+		if err != nil {
+			t.Fatalf("decode %+v error : %v", message, err)
+		}
+		if got.Subject != message.Subject || got.RequestID != message.RequestID || got.Codec != message.Codec ||
+			got.Seq != message.Seq || !bytes.Equal(got.Data, message.Data) {
+			t.Fatalf("decoded %+v , want %+v", got, message)
+		}
+	}
+
+	// 错误信息以 error 负载编码发出
+	_, frame, err := codec.encode(&Message{Subject: "Lobby.Buy", RequestID: "r1", Error: "timeout", Data: []byte("ignored")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := codec.decode(frame)
+	if err != nil || got.Codec != PayloadCodecError || string(got.Data) != "timeout" {
+		t.Fatalf("decoded error frame %+v , %v", got, err)
+	}
+
+	// 超长主题无法编码
+	if _, _, err := codec.encode(&Message{Subject: strings.Repeat("s", binaryFieldMaxLength+1)}); err != ErrInvalidFrame {
+		t.Fatalf("encode long subject error = %v , want %v", err, ErrInvalidFrame)
+	}
+}
+
+func TestBinaryCodecMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"empty", nil},
+		{"short", []byte{BinaryFrameVersion, 0, 0}},
+		{"unknown version", []byte{3, 0, 0, 0}},
+		{"unknown codec", []byte{BinaryFrameVersion, byte(len(payloadCodecs)), 0, 0}},
+		{"subject overflow", []byte{BinaryFrameVersion, 0, 5, 'a', 'b'}},
+		{"missing request id", []byte{BinaryFrameVersion, 0, 2, 'a', 'b'}},
+		{"request id overflow", []byte{BinaryFrameVersion, 0, 1, 'a', 3, 'r'}},
+		{"short seq", []byte{BinaryFrameVersionSeq, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{"seq without fields", []byte{BinaryFrameVersionSeq, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0}},
+	}
+
+	for _, test := range tests {
+		if message, err := decodeSafely(t, binaryCodec{}, test.frame); err == nil {
+			t.Errorf("%s : decoded %+v , want error", test.name, message)
+		}
+	}
+
+	// 合法帧的任意截断都不会 panic ，截断到固定头部之内时返回错误
+	for _, message := range frameMessages {
+		_, frame, _ := binaryCodec{}.encode(message)
+		for i := 0; i < len(frame); i++ {
+			if _, err := decodeSafely(t, binaryCodec{}, frame[:i]); err == nil && i < binaryFrameFixedLength {
+				t.Fatalf("truncated frame %x decoded", frame[:i])
+			}
+		}
+	}
+}
+
+func TestProtoCodecRoundTrip(t *testing.T) {
+	codec := protoCodec{}
+	messages := append(frameMessages, &Message{Subject: "Lobby.Buy", RequestID: "r1", Error: "timeout"})
+
+	for _, message := range messages {
+		typ, frame, err := codec.encode(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != websocket.BinaryMessage {
+			t.Fatalf("frame type = %d , want binary", typ)
+		}
+		got, err := codec.decode(frame)
+		if err != nil {
+			t.Fatalf("decode %+v error : %v", message, err)
+		}
+		// 空数据解码为 nil
+		if len(message.Data) == 0 {
+			got.Data = message.Data
+		}
+		if !reflect.DeepEqual(got, message) {
+			t.Fatalf("decoded %+v , want %+v", got, message)
+		}
+	}
+}
+
+func TestProtoCodecSkipsUnknownFields(t *testing.T) {
+	_, frame, _ := protoCodec{}.encode(&Message{Subject: "Lobby.Buy", Data: []byte("hello")})
+	frame = protowire.AppendTag(frame, 99, protowire.VarintType)
+	frame = protowire.AppendVarint(frame, 7)
+	frame = protowire.AppendTag(frame, 100, protowire.Fixed32Type)
+	frame = protowire.AppendFixed32(frame, 7)
+
+	got, err := protoCodec{}.decode(frame)
+	if err != nil || got.Subject != "Lobby.Buy" || string(got.Data) != "hello" {
+		t.Fatalf("decoded %+v , %v", got, err)
+	}
+}
+
+func TestProtoCodecMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"truncated tag", []byte{0x80}},
+		{"field number zero", []byte{0x02, 0x00}},
+		{"truncated length", protowire.AppendTag(nil, envelopeSubject, protowire.BytesType)},
+		{"length overflow", append(protowire.AppendTag(nil, envelopeData, protowire.BytesType), 10, 'a')},
+		{"truncated seq", append(protowire.AppendTag(nil, envelopeSeq, protowire.VarintType), 0xFF)},
+		{"truncated fixed64", append(protowire.AppendTag(nil, 99, protowire.Fixed64Type), 1, 2)},
+		{"unmatched end group", protowire.AppendTag(nil, 99, protowire.EndGroupType)},
+	}
+
+	for _, test := range tests {
+		if message, err := decodeSafely(t, protoCodec{}, test.frame); err == nil {
+			t.Errorf("%s : decoded %+v , want error", test.name, message)
+		}
+	}
+
+	// 合法帧的任意截断都不会 panic
+	for _, message := range frameMessages {
+		_, frame, _ := protoCodec{}.encode(message)
+		for i := 0; i < len(frame); i++ {
+			_, _ = decodeSafely(t, protoCodec{}, frame[:i])
+		}
+	}
+}
@@ -2,17 +2,14 @@ package gateway
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"crypto/tls"
+	"errors"
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 	"github.com/nats-io/nats.go"
-	"io/ioutil"
-	"net"
 	nHttp "net/http"
 	"sherlock/client"
 	"sherlock/log"
-	"sherlock/util/encrypt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -37,271 +34,361 @@ type (
 		server        *nHttp.Server
 		subscriptions []*nats.Subscription
 		bl            BlackList
+		resolver      *ipResolver       // 客户端 IP 解析者
+		proxyProtocol bool              // 是否解析 PROXY 协议
+		auth          Authenticator     // 认证者，为 nil 时不认证
+		connConfig    ConnectionConfig  // WebSocket 连接配置
+		socketConfig  SocketConfig      // TCP 连接配置
+		reqTimeout    time.Duration     // WebSocket 携带请求 ID 的请求超时时间
+		resume        *ResumeConfig     // WebSocket 会话恢复配置，为 nil 时不开启
+		routes        []Route           // HTTP 路由表
+		limiter       *rateLimiter      // 限流者，为 nil 时不限流
+		tls           *TLSConfig        // TLS 配置，为 nil 时不开启 TLS
+		security      *security         // CORS 及安全响应头配置
+		sse           *SSEConfig        // SSE 配置，为 nil 时不开启 SSE
+		maxBodySize   int64             // HTTP 最大请求体字节数
+		schemas       map[string]string // 请求体 JSON Schema map[主题]Schema
+		validator     *bodyValidator    // 请求体校验者，为 nil 时不校验
+		idempotency   *idempotency      // 幂等处理者，为 nil 时不支持幂等键
+		accessLog     *accessLogger     // 访问日志记录者，为 nil 时不记录
+		instanceID    string            // 实例 ID ，用于管理主题
+		startedAt     time.Time         // 启动时间
+		draining      int32             // 是否排空中，1 表示排空
+		stats         *gatewayCounter   // 统计计数
 	}
 
-	http struct {
+	// 基于 HTTP 服务的网关，各协议以插件的形式注册到同一个引擎上
+	engineGateway struct {
 		baseGateway
-		engine *gin.Engine
+		name      string // 网关名称
+		label     string // 日志中的网关名称
+		engine    *gin.Engine
+		protocols []protocol
 	}
 
-	webSocket struct {
-		baseGateway
-		engine   *gin.Engine
-		upgrader *websocket.Upgrader
-		conn     *websocket.Conn
+	// 协议插件
+	protocol interface {
+		// 在引擎上注册路由，可以读取网关配置及追加订阅
+		register(*baseGateway, *gin.Engine, client.Client) error
+		// 是否支持 HTTP/2
+		http2() bool
+		// 关闭协议持有的长连接
+		close()
 	}
 
 	Message struct {
-		Subject string `json:"subject"`
-		Data    []byte `json:"data"`
+		Subject   string `json:"subject"`
+		Data      []byte `json:"data"`
+		RequestID string `json:"request_id,omitempty"` // 请求 ID
+		Codec     string `json:"codec,omitempty"`      // 负载编码，随消息头转发给服务
+		Error     string `json:"error,omitempty"`      // 错误信息，仅出现在网关发往客户端的消息中
+		Seq       uint64 `json:"seq,omitempty"`        // 会话序号，仅出现在开启会话恢复时网关推送的消息中
+	}
+
+	// 健康检查结果
+	// 健康检查是公开接口，不展示各主题的熔断器，详情通过管理主题 Stats 命令查看
+	Health struct {
+		Gateway      string `json:"gateway"`
+		Status       string `json:"status"`
+		OpenBreakers int    `json:"open_breakers"` // 未关闭的熔断器数量
 	}
 )
 
 const (
 	HTTPGatewayName      = "HTTP-GATEWAY"
 	WebSocketGatewayName = "WEBSOCKET-GATEWAY"
+	UnifiedGatewayName   = "UNIFIED-GATEWAY"
+)
+
+const (
+	// HTTP 网关默认请求超时时间
+	DefaultHTTPRequestTimeout = time.Duration(12) * time.Second
+)
+
+const (
+	// 健康检查路径
+	HealthPath = "/health"
+	// 健康状态
+	HealthStatusOK       = "ok"
+	HealthStatusDegraded = "degraded" // 存在未关闭的熔断器
+	HealthStatusDraining = "draining" // 排空中，负载均衡应摘除该实例
 )
 
-var ()
+var (
+	// 内部主题前缀，网关控制、推送主题、NATS 回复及系统主题只能由服务端发布，客户端指定的主题不能以此开头
+	reservedSubjectPrefixes = []string{"Gateway.", "WS_", TopicPushSubjectPrefix + ".", SocketConnSubjectPrefix + ".", "_INBOX.", "$"}
+
+	ErrInvalidSubject  = errors.New("invalid subject")
+	ErrReservedSubject = errors.New("reserved subject")
+	ErrBlocked         = errors.New("blocked by black list")
+)
 
 func init() { gin.SetMode(gin.ReleaseMode) }
 
-func NewHTTPGateway(address string) Gateway {
-	return &http{
-		baseGateway: baseGateway{
-			address:       address,
-			server:        nil,
-			subscriptions: []*nats.Subscription{},
-			bl:            NewBlackList(),
-		},
-	}
+func NewHTTPGateway(address string, options ...Option) Gateway {
+	return newEngineGateway(HTTPGatewayName, "HTTP", address, options, &http{}, &sse{})
 }
 
-func NewWebSocketGateway(address string) Gateway {
-	return &webSocket{
-		baseGateway: baseGateway{
-			address:       address,
-			server:        nil,
-			subscriptions: []*nats.Subscription{},
-			bl:            NewBlackList(),
-		},
-	}
+func NewWebSocketGateway(address string, options ...Option) Gateway {
+	return newEngineGateway(WebSocketGatewayName, "WebSocket", address, options, &webSocket{})
 }
 
-func (h *http) Close() error { return h.server.Shutdown(context.Background()) }
-func (h *http) Info() string { return HTTPGatewayName }
-func (h *http) Init(c client.Client) error {
-	// 网关订阅黑名单开关
-	if sp, err := c.Subscribe(BlackListSwitchSubject, "", h.bl.OnlineSwitch); err != nil {
-		log.ErrorF("HTTP gateway subscribe [%s] error : %s", BlackListSwitchSubject, err.Error())
-	} else {
-		log.DebugF("HTTP gateway subscribe [%s] success", sp.Subject)
-		h.subscriptions = append(h.subscriptions, sp)
+// 新建统一网关，在同一个地址上提供 HTTP 路由、SSE 、/ws 升级及健康检查，
+// 共享一份黑名单、限流及控制主题订阅
+func NewUnifiedGateway(address string, options ...Option) Gateway {
+	return newEngineGateway(UnifiedGatewayName, "Unified", address, options, &http{}, &sse{}, &webSocket{})
+}
+
+func newEngineGateway(name, label, address string, options []Option, protocols ...protocol) *engineGateway {
+	return &engineGateway{
+		baseGateway: newBaseGateway(address, options...),
+		name:        name,
+		label:       label,
+		protocols:   protocols,
 	}
+}
 
-	// 网关订阅黑名单更新
-	if sp, err := c.Subscribe(BlackListUpdateSubject, "", h.bl.OnlineUpdate); err != nil {
-		log.ErrorF("HTTP gateway subscribe [%s] error : %s", BlackListUpdateSubject, err.Error())
-	} else {
-		log.DebugF("HTTP gateway subscribe [%s] success", sp.Subject)
-		h.subscriptions = append(h.subscriptions, sp)
+func (eg *engineGateway) Close() error {
+	// 已升级的长连接不受 Shutdown 管理，事件流请求不会结束，先由协议单独关闭
+	for _, p := range eg.protocols {
+		p.close()
 	}
+	return eg.server.Shutdown(context.Background())
+}
+func (eg *engineGateway) Info() string { return eg.name }
+func (eg *engineGateway) Init(c client.Client) error {
+	if err := eg.security.get().validate(); err != nil {
+		return err
+	}
+	// 网关订阅黑名单控制主题，并从持久化存储中恢复名单
+	eg.baseGateway.subscribeBlackList(eg.label, c)
+	// 以及安全配置更新主题
+	eg.baseGateway.subscribeSecurity(eg.label, c)
 
 	// 初始化 HTTP 引擎
-	h.engine = gin.New()
+	eg.engine = gin.New()
+	// 添加统计中间件
+	eg.engine.Use(eg.baseGateway.StatsMiddleware)
+	// 添加访问日志中间件
+	eg.engine.Use(eg.baseGateway.AccessLogMiddleware)
+	// 添加安全中间件，被拒绝的请求同样携带 CORS 及安全响应头
+	eg.engine.Use(eg.baseGateway.SecurityMiddleware)
 	// 添加IP黑名单中间件
-	h.engine.Use(h.baseGateway.FilterIPMiddleware)
-	// 只支持 POST 请求
-	h.engine.POST("/:module/:path", func(context *gin.Context) {
-		// 模块.路径 指定了发布主题，请求 Body 指定了数据
-		module := context.Param("module")
-		path := context.Param("path")
-		data, err := ioutil.ReadAll(context.Request.Body)
-		if err != nil {
-			context.String(nHttp.StatusBadRequest, "get body error :"+err.Error())
-			return
+	eg.engine.Use(eg.baseGateway.FilterIPMiddleware)
+	// 添加限流中间件
+	eg.engine.Use(eg.baseGateway.RateLimitMiddleware(c))
+	// 添加预检中间件，预检请求同样经过黑名单及限流检查
+	eg.engine.Use(eg.baseGateway.PreflightMiddleware)
+	// 添加幂等中间件
+	eg.engine.Use(eg.baseGateway.IdempotencyMiddleware)
+	// 健康检查
+	eg.engine.GET(HealthPath, eg.baseGateway.HealthHandler(eg.name, c))
+	// 各协议注册自己的路由
+	for _, p := range eg.protocols {
+		if err := p.register(&eg.baseGateway, eg.engine, c); err != nil {
+			return err
 		}
-
-		message := &Message{
-			Subject: strings.Join([]string{module, path}, "."),
-			Data:    data,
+	}
+	// 订阅管理主题
+	eg.subscribeAdmin(eg.name, eg.label, c, eg.connProtocols()...)
+	// 初始化服务
+	eg.server = &nHttp.Server{
+		Addr:    eg.address,
+		Handler: eg.engine,
+	}
+	// 开启 TLS 时，有协议支持 HTTP/2 则通过 ALPN 协商，否则只协商 HTTP/1.1
+	// WebSocket 客户端只会协商 HTTP/1.1
+	if eg.tls != nil {
+		http2 := false
+		for _, p := range eg.protocols {
+			http2 = http2 || p.http2()
 		}
 
-		log.DebugF("HTTP get new message from [%s] : %s", context.Request.RemoteAddr, message.Subject)
-		log.DebugF("HTTP get new message : %s", string(message.Data))
-
-		// 通过请求的方式发布及接收响应
-		response, err := c.Request(message.Subject, "", message.Data, time.Duration(12)*time.Second)
-		if err != nil {
-			log.ErrorF("HTTP request to [%s] subject error : %s", message.Subject, err.Error())
-			context.String(nHttp.StatusInternalServerError, err.Error())
-			return
+		protos := []string{ALPNHTTP1}
+		if http2 {
+			protos = []string{ALPNHTTP2, ALPNHTTP1}
 		}
-
-		context.String(nHttp.StatusOK, string(response.Data))
-	})
-	// 初始化服务
-	h.server = &nHttp.Server{
-		Addr:    h.address,
-		Handler: h.engine,
-	}
-	return nil
-}
-func (h *http) Run() error {
-	if err := h.server.ListenAndServe(); err != nil {
-		if err == nHttp.ErrServerClosed { // 主动关闭
-			return nil
-		} else {
+		config, err := eg.tls.build(protos...)
+		if err != nil {
 			return err
 		}
+		eg.server.TLSConfig = config
+		if !http2 {
+			eg.server.TLSNextProto = map[string]func(*nHttp.Server, *tls.Conn, nHttp.Handler){}
+		}
 	}
 	return nil
 }
-func (h *http) Destroy() error {
+func (eg *engineGateway) Run() error {
+	return eg.baseGateway.serve()
+}
+func (eg *engineGateway) Destroy() error {
 	// 取消订阅
-	for _, sp := range h.subscriptions {
+	for _, sp := range eg.subscriptions {
 		if err := sp.Unsubscribe(); err != nil {
 			return err
 		} else {
-			log.DebugF("HTTP gateway unsubscribe [%s] success", sp.Subject)
+			log.DebugF("%s gateway unsubscribe [%s] success", eg.label, sp.Subject)
 		}
 	}
 
-	h.engine = nil
+	eg.engine = nil
 	return nil
 }
 
-func (ws *webSocket) Close() error { return ws.server.Shutdown(context.Background()) }
-func (ws *webSocket) Info() string { return WebSocketGatewayName }
-func (ws *webSocket) Init(c client.Client) error {
-	// 网关订阅黑名单开关
-	if sp, err := c.Subscribe(BlackListSwitchSubject, "", ws.bl.OnlineSwitch); err != nil {
-		log.ErrorF("WebSocket gateway subscribe [%s] error : %s", BlackListSwitchSubject, err.Error())
-	} else {
-		ws.subscriptions = append(ws.subscriptions, sp)
-		log.DebugF("WebSocket gateway subscribe [%s] success", sp.Subject)
+// 持有长连接的协议
+func (eg *engineGateway) connProtocols() []connProtocol {
+	cps := make([]connProtocol, 0, len(eg.protocols))
+	for _, p := range eg.protocols {
+		if cp, ok := p.(connProtocol); ok {
+			cps = append(cps, cp)
+		}
 	}
+	return cps
+}
 
-	// 网关订阅黑名单更新
-	if sp, err := c.Subscribe(BlackListUpdateSubject, "", ws.bl.OnlineUpdate); err != nil {
-		log.ErrorF("WebSocket gateway subscribe [%s] error : %s", BlackListUpdateSubject, err.Error())
+// 启动 HTTP 服务，配置了 TLS 时以 HTTPS 启动
+func (bg *baseGateway) serve() error {
+	var err error
+	if bg.server.TLSConfig != nil {
+		err = bg.server.ListenAndServeTLS("", "")
 	} else {
-		ws.subscriptions = append(ws.subscriptions, sp)
-		log.DebugF("WebSocket gateway subscribe [%s] success", sp.Subject)
+		err = bg.server.ListenAndServe()
 	}
-
-	// 初始化 HTTP 引擎
-	ws.engine = gin.New()
-	// 添加IP黑名单中间件
-	ws.engine.Use(ws.baseGateway.FilterIPMiddleware)
-	// 初始化 WebSocket 升级件
-	ws.upgrader = &websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *nHttp.Request) bool {
-			return true
-		},
+	if err != nil && err != nHttp.ErrServerClosed { // 主动关闭
+		return err
 	}
-	ws.engine.GET("/ws", func(context *gin.Context) {
-		// 对 [ws://address/ws] 路径上的请求统一升级为长连接
-		conn, err := ws.upgrader.Upgrade(context.Writer, context.Request, nil)
-		if err != nil {
-			log.FatalF("upgrade http connection to WebSocket error : %s", err.Error())
-			return
-		}
-		// 同时开启一个 [WS_CONN.远程地址摘要] 主题的订阅，用于接收回复消息
-		sp, err := c.Subscribe(ws.connSubject(conn.RemoteAddr().String()), "", func(msg *nats.Msg) {
-			if err := conn.WriteMessage(websocket.TextMessage, msg.Data); err != nil {
-				log.ErrorF("Write message to [%s] error : %s", conn.RemoteAddr().String(), err.Error())
-			}
-		})
-		if err != nil {
-			log.ErrorF("Subscribe [%s] according to the remote address [%s] error : %s", "WS_"+encrypt.MD5(conn.RemoteAddr().String()), conn.RemoteAddr().String())
-			// 如果订阅失败，直接关闭连接
-			if err := conn.Close(); err != nil {
-				log.ErrorF("WebSocket connection [%s] close error : %s", conn.RemoteAddr().String(), err.Error())
-			}
-			return
-		}
-
-		defer func() {
-			if err := conn.Close(); err != nil {
-				log.ErrorF("WebSocket connection [%s] close error : %s", conn.RemoteAddr().String(), err.Error())
-			}
+	return nil
+}
 
-			if err := sp.Unsubscribe(); err != nil {
-				log.ErrorF("WebSocket connection [%s] close error : %s", conn.RemoteAddr().String(), err.Error())
-			}
-		}()
+// 根据请求头中的剩余时间预算构建请求上下文
+func requestContext(r *nHttp.Request) (context.Context, context.CancelFunc) {
+	budget := r.Header.Get(client.DeadlineBudgetHeader)
+	if budget == "" {
+		return context.WithCancel(r.Context())
+	}
 
-		for {
-			_, data, err := conn.ReadMessage()
-			if err != nil {
-				log.ErrorF("WebSocket connection [%s] read message error : %s", conn.RemoteAddr().String(), err.Error())
-				break
-			}
-			// 接收的消息必须以 Message 的形式指定
-			message := &Message{}
-			if err := json.Unmarshal(data, message); err != nil {
-				log.ErrorF("WebSocket connection [%s] read message error : %s", conn.RemoteAddr().String(), err.Error())
-				continue
-			}
+	ms, err := strconv.ParseInt(budget, 10, 64)
+	if err != nil {
+		log.ErrorF("Parse deadline budget [%s] error : %s", budget, err.Error())
+		return context.WithCancel(r.Context())
+	}
 
-			log.DebugF("WebSocket get new message from [%s] : %s", context.Request.RemoteAddr, message.Subject)
-			log.DebugF("WebSocket get new message : %s", string(message.Data))
+	return context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+}
 
-			// 通过指定 Reply 为 [WS_CONN.远程地址摘要] ，由上面的订阅接收并且回复给用户
-			if err := c.Publish(message.Subject, ws.connSubject(conn.RemoteAddr().String()), message.Data); err != nil {
-				log.ErrorF("WebSocket publish a message to [%s] subject error : %s", message.Subject, err.Error())
-				continue
-			}
-		}
-	})
-	// 初始化服务
-	ws.server = &nHttp.Server{
-		Addr:    ws.address,
-		Handler: ws.engine,
+// 订阅黑名单控制主题，并从持久化存储中恢复名单
+func (bg *baseGateway) subscribeBlackList(name string, c client.Client) {
+	handlers := []struct {
+		subject string
+		handler nats.MsgHandler
+	}{
+		{BlackListSwitchSubject, bg.bl.OnlineSwitch},
+		{BlackListUpdateSubject, bg.bl.OnlineUpdate},
+		{BlackListAddSubject, bg.bl.OnlineAdd},
+		{BlackListRemoveSubject, bg.bl.OnlineRemove},
+		{AllowListUpdateSubject, bg.bl.OnlineAllowUpdate},
 	}
-	return nil
-}
-func (ws *webSocket) Run() error {
-	if err := ws.server.ListenAndServe(); err != nil {
-		if err == nHttp.ErrServerClosed { // 主动关闭
-			return nil
+
+	for _, h := range handlers {
+		if sp, err := c.Subscribe(h.subject, "", h.handler); err != nil {
+			log.ErrorF("%s gateway subscribe [%s] error : %s", name, h.subject, err.Error())
 		} else {
-			return err
+			bg.subscriptions = append(bg.subscriptions, sp)
+			log.DebugF("%s gateway subscribe [%s] success", name, sp.Subject)
 		}
 	}
-	return nil
+
+	if err := bg.bl.Load(); err != nil {
+		log.ErrorF("%s gateway load black list error : %s", name, err.Error())
+	}
 }
-func (ws *webSocket) Destroy() error {
-	// 取消订阅
-	for _, sp := range ws.subscriptions {
-		if err := sp.Unsubscribe(); err != nil {
-			return err
-		} else {
-			log.DebugF("WebSocket gateway unsubscribe [%s] success", sp.Subject)
-		}
+
+// 认证请求，未设置认证者时返回 nil 身份
+func (bg *baseGateway) authenticate(c client.Client, r *nHttp.Request) (*Identity, error) {
+	if bg.auth == nil {
+		return nil, nil
 	}
 
-	ws.engine = nil
-	return nil
+	token := tokenFromRequest(r)
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+
+	identity, err := bg.auth.Authenticate(c, token)
+	if err != nil {
+		return nil, err
+	}
+	// 用户 ID 用作推送主题片段，自定义认证者返回的身份同样需要校验
+	if !validSubjectToken(identity.UserID) {
+		return nil, ErrUnauthorized
+	}
+	if identity.SessionID == "" {
+		identity.SessionID = newConnID(identity.UserID)
+	}
+
+	return identity, nil
 }
-func (ws *webSocket) connSubject(address string) string {
-	return fmt.Sprintf("WS_CONN.%s", encrypt.MD5(address))
+
+// 健康检查，存在未关闭的熔断器时为 degraded ，只展示数量
+func (bg *baseGateway) HealthHandler(name string, c client.Client) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		health := &Health{
+			Gateway: name,
+			Status:  HealthStatusOK,
+		}
+
+		for _, b := range c.BreakerStates() {
+			if b.State != client.BreakerClosed.String() {
+				health.OpenBreakers++
+			}
+		}
+		if health.OpenBreakers > 0 {
+			health.Status = HealthStatusDegraded
+		}
+
+		// 排空中回复 503 ，负载均衡不再转发新连接
+		if bg.isDraining() {
+			health.Status = HealthStatusDraining
+			context.JSON(nHttp.StatusServiceUnavailable, health)
+			return
+		}
+
+		context.JSON(nHttp.StatusOK, health)
+	}
 }
 
 // 黑名单过滤
+// 解析客户端真实 IP 并保存到上下文中，供后续日志等使用
 func (bg *baseGateway) FilterIPMiddleware(context *gin.Context) {
-	h, _, err := net.SplitHostPort(context.Request.Host)
-	if err != nil {
-		log.ErrorF("Parse connection host [%s] error : %s", context.Request.Host, err.Error())
-		context.Abort()
+	ip := bg.resolver.ClientIP(context.Request)
+	context.Set(ClientIPKey, ip)
+	log.DebugF("Client ip : %s", ip)
+
+	if !bg.bl.Filter(ip) {
+		writeError(context, nHttp.StatusForbidden, "", ErrBlocked.Error())
 	}
-	log.DebugF("Split host : %s", h)
+}
+
+// 校验客户端指定的发布主题，主题片段必须合法，且不能是内部主题
+func checkClientSubject(subject string) error {
+	for _, token := range strings.Split(subject, client.SubjectSeparator) {
+		if !validSubjectToken(token) {
+			return ErrInvalidSubject
+		}
+	}
+	for _, prefix := range reservedSubjectPrefixes {
+		if strings.HasPrefix(subject, prefix) {
+			return ErrReservedSubject
+		}
+	}
+	return nil
+}
 
-	if !bg.bl.Filter(h) {
-		context.String(nHttp.StatusBadRequest, "You are block by blacklist")
-		context.Abort()
+// 主题校验错误对应的状态码
+func subjectErrorStatus(err error) int {
+	if err == ErrReservedSubject {
+		return nHttp.StatusForbidden
 	}
+	return nHttp.StatusBadRequest
 }
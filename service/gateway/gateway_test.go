@@ -0,0 +1,232 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	natsd "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"io/ioutil"
+	nHttp "net/http"
+	"net/http/httptest"
+	"sherlock/client"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 启动内嵌 NATS 服务并连接
+func newTestClient(t *testing.T) client.Client {
+	t.Helper()
+
+	server, err := natsd.NewServer(&natsd.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+	if !server.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(server.Shutdown)
+
+	c, err := client.NewClient(t.Name(), server.ClientURL(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// 初始化基于引擎的网关，请求直接交给引擎处理
+func newTestEngineGateway(t *testing.T, c client.Client, gateway Gateway) *engineGateway {
+	t.Helper()
+
+	eg := gateway.(*engineGateway)
+	if err := eg.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		eg.Close()
+		eg.Destroy()
+	})
+	return eg
+}
+
+func serve(eg *engineGateway, method, target string, body []byte) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	eg.engine.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestCheckClientSubject(t *testing.T) {
+	cases := []struct {
+		subject string
+		err     error
+	}{
+		{"Lobby.Buy", nil},
+		{"Gateway", nil},
+		{"Gateway.Admin.Discover", ErrReservedSubject},
+		{"Gateway.Security.Update", ErrReservedSubject},
+		{"Gateway.BlackList.Add", ErrReservedSubject},
+		{"SSE_TOPIC.news", ErrReservedSubject},
+		{"SOCKET_CONN.abc", ErrReservedSubject},
+		{"_INBOX.abc", ErrReservedSubject},
+		{"$SYS.REQ.SERVER.PING", ErrReservedSubject},
+		{"", ErrInvalidSubject},
+		{"Lobby..Buy", ErrInvalidSubject},
+		{"Lobby.*", ErrInvalidSubject},
+		{"Lobby.>", ErrInvalidSubject},
+	}
+	for _, c := range cases {
+		if err := checkClientSubject(c.subject); err != c.err {
+			t.Errorf("checkClientSubject(%q) = %v , want %v", c.subject, err, c.err)
+		}
+	}
+}
+
+func TestHTTPRejectsReservedSubject(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0", WithInstanceID("probe")))
+
+	for _, target := range []string{
+		"/Gateway.Admin/Discover",
+		fmt.Sprintf("/Gateway.Admin.%s/Drain", eg.instanceID),
+		"/Gateway.Security/Update",
+		"/Gateway.BlackList/Switch",
+	} {
+		if recorder := serve(eg, nHttp.MethodPost, target, []byte(`{"enable":true}`)); recorder.Code != nHttp.StatusForbidden {
+			t.Errorf("POST %s = %d , want %d", target, recorder.Code, nHttp.StatusForbidden)
+		}
+	}
+	if eg.isDraining() {
+		t.Error("gateway drained by a client request")
+	}
+}
+
+func TestHealthHidesSubjects(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0"))
+
+	// 请求一个无响应者的主题，产生熔断器
+	serve(eg, nHttp.MethodPost, "/Lobby/Secret", nil)
+
+	recorder := serve(eg, nHttp.MethodGet, HealthPath, nil)
+	if recorder.Code != nHttp.StatusOK {
+		t.Fatalf("health = %d", recorder.Code)
+	}
+	if body := recorder.Body.String(); strings.Contains(body, "Lobby.Secret") || strings.Contains(body, `"breakers"`) {
+		t.Fatalf("health exposes subjects : %s", body)
+	}
+}
+
+func TestUnifiedGatewayServesAllProtocols(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewUnifiedGateway("127.0.0.1:0"))
+	server := httptest.NewServer(eg.engine)
+	defer server.Close()
+
+	if _, err := c.Subscribe("Lobby.Buy", "", func(msg *nats.Msg) {
+		_ = c.Reply(msg.Reply, "", []byte("ok"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一个地址上的 HTTP 请求、健康检查及 WebSocket 升级
+	response, err := nHttp.Post(server.URL+"/Lobby/Buy", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != nHttp.StatusOK || string(body) != "ok" {
+		t.Fatalf("http response = %d %s", response.StatusCode, body)
+	}
+
+	response, err = nHttp.Get(server.URL + HealthPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != nHttp.StatusOK {
+		t.Fatalf("health status = %d", response.StatusCode)
+	}
+
+	conn := dialTest(t, "ws"+strings.TrimPrefix(server.URL, "http")+WebSocketPath)
+	frame, _ := json.Marshal(&Message{Subject: "Lobby.Buy", RequestID: "r1"})
+	if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+	reply := &Message{}
+	if err := json.Unmarshal(readTest(t, conn, time.Second), reply); err != nil || string(reply.Data) != "ok" {
+		t.Fatalf("websocket reply = %+v , %v", reply, err)
+	}
+
+	// 控制主题只订阅一次
+	subjects := map[string]int{}
+	for _, sp := range eg.subscriptions {
+		subjects[sp.Subject]++
+	}
+	for subject, n := range subjects {
+		if n != 1 {
+			t.Errorf("subject %s subscribed %d times", subject, n)
+		}
+	}
+}
+
+func TestUnifiedGatewaySharesBlackList(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewUnifiedGateway("127.0.0.1:0"))
+	server := httptest.NewServer(eg.engine)
+	defer server.Close()
+
+	data, _ := json.Marshal(map[string]BlackListEntry{"127.0.0.1": {}})
+	if err := c.Publish(BlackListAddSubject, "", data); err != nil {
+		t.Fatal(err)
+	}
+
+	// 一次封禁对 HTTP 及 WebSocket 同时生效
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		response, err := nHttp.Get(server.URL + HealthPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode == nHttp.StatusForbidden {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("http not blocked")
+		}
+	}
+	_, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+WebSocketPath, nil)
+	if err == nil || response == nil || response.StatusCode != nHttp.StatusForbidden {
+		t.Fatalf("websocket upgrade not blocked : %v", err)
+	}
+}
+
+func TestRequestContextBudget(t *testing.T) {
+	request := httptest.NewRequest(nHttp.MethodPost, "/Lobby/Buy", nil)
+	ctx, cancel := requestContext(request)
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("deadline set without budget")
+	}
+	cancel()
+
+	request.Header.Set(client.DeadlineBudgetHeader, "200")
+	ctx, cancel = requestContext(request)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > 200*time.Millisecond || time.Until(deadline) < 100*time.Millisecond {
+		t.Fatalf("deadline = %v , %v", deadline, ok)
+	}
+
+	// 非法预算忽略
+	request.Header.Set(client.DeadlineBudgetHeader, "soon")
+	ctx, cancel = requestContext(request)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("deadline set by invalid budget")
+	}
+}
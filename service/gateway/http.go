@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	nHttp "net/http"
+	"sherlock/client"
+	"sherlock/log"
+	"strings"
+	"time"
+)
+
+type (
+	// HTTP 协议，请求以 NATS 请求的方式转发，回复写为 HTTP 响应
+	http struct{}
+)
+
+const ()
+
+var ()
+
+func (h *http) http2() bool { return true }
+func (h *http) close()      {}
+func (h *http) register(bg *baseGateway, engine *gin.Engine, c client.Client) error {
+	// 编译注册的 JSON Schema
+	if len(bg.schemas) > 0 {
+		validator, err := newBodyValidator(bg.schemas)
+		if err != nil {
+			return err
+		}
+		bg.validator = validator
+	}
+
+	// 未配置路由表时只支持 POST /:module/:path 请求
+	if len(bg.routes) == 0 {
+		engine.POST("/:module/:path", func(context *gin.Context) {
+			// 模块.路径 指定了发布主题，请求 Body 指定了数据
+			module := context.Param("module")
+			path := context.Param("path")
+			subject := strings.Join([]string{module, path}, ".")
+			context.Set(SubjectKey, subject)
+			if err := checkClientSubject(subject); err != nil {
+				writeError(context, subjectErrorStatus(err), "", err.Error())
+				return
+			}
+			data, ok := readBody(context, bg.maxBodySize, nil)
+			if !ok || !bg.validateBody(context, subject, data) {
+				return
+			}
+
+			message := &Message{
+				Subject: subject,
+				Data:    data,
+			}
+
+			h.request(c, context, message, DefaultHTTPRequestTimeout, "")
+		})
+	}
+	// 路由表中的路由以请求信封的形式转发
+	for _, route := range bg.routes {
+		if err := route.validate(); err != nil {
+			return err
+		}
+
+		route := route
+		engine.Handle(route.Method, route.Path, func(context *gin.Context) {
+			subject, err := route.subject(context.Params)
+			if err != nil {
+				writeError(context, nHttp.StatusBadRequest, "", err.Error())
+				return
+			}
+			context.Set(SubjectKey, subject)
+			// 路径参数可能拼出内部主题
+			if err := checkClientSubject(subject); err != nil {
+				writeError(context, subjectErrorStatus(err), "", err.Error())
+				return
+			}
+			limit := route.MaxBodySize
+			if limit <= 0 {
+				limit = bg.maxBodySize
+			}
+			body, ok := readBody(context, limit, route.Accepts)
+			if !ok || !bg.validateBody(context, subject, body) {
+				return
+			}
+			data, err := json.Marshal(newHTTPRequest(context, route, body))
+			if err != nil {
+				log.ErrorF("HTTP marshal request of [%s] error : %s", subject, err.Error())
+				writeError(context, nHttp.StatusInternalServerError, "", "")
+				return
+			}
+
+			message := &Message{
+				Subject: subject,
+				Data:    data,
+			}
+
+			h.request(c, context, message, route.timeout(), route.ContentType)
+		})
+	}
+	return nil
+}
+
+// 请求服务并将回复写为 HTTP 响应
+func (h *http) request(c client.Client, context *gin.Context, message *Message, timeout time.Duration, contentType string) {
+	log.DebugF("HTTP get new message from [%s] : %s", context.GetString(ClientIPKey), message.Subject)
+
+	// 调用方可通过请求头指定剩余时间预算，实际超时时间不会超过路由超时时间
+	ctx, cancel := requestContext(context.Request)
+	defer cancel()
+
+	// 通过请求的方式发布及接收响应
+	response, err := c.RequestWithContext(ctx, message.Subject, "", message.Data, timeout)
+	if err != nil {
+		log.ErrorF("HTTP request to [%s] subject error : %s", message.Subject, err.Error())
+		// 超时回复 504 ，无响应者及熔断器打开时回复 503 ，错误详情不返回给调用方
+		writeRequestError(context, err)
+		return
+	}
+
+	writeReply(context, contentType, response)
+}
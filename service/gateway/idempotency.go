@@ -0,0 +1,514 @@
+package gateway
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	redisGo "github.com/gomodule/redigo/redis"
+	"io"
+	"io/ioutil"
+	nHttp "net/http"
+	"sherlock/database/redis"
+	"sherlock/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// 幂等配置
+	IdempotencyConfig struct {
+		Window       time.Duration // 首个回复的缓存时间，默认 24 小时
+		LockTimeout  time.Duration // 处理中记录的保留时间，重复请求最多等待该时间，默认 30 秒
+		PollInterval time.Duration // 重复请求检查首个回复的间隔，默认 50 毫秒
+		Methods      []string      // 支持幂等键的方法，默认 POST 、PATCH
+		Redis        bool          // 是否使用 Redis 存储，多个网关实例共享幂等记录，使用前需先调用 redis.InitializeRedis
+		MaxEntries   int           // 本地存储的记录数上限，超过时淘汰最久未使用的记录，默认 100000
+		MaxBodySize  int           // 缓存的回复体最大字节数，超过时不缓存回复，默认 1MB
+	}
+
+	// 幂等记录存储
+	IdempotencyStore interface {
+		// 不存在时写入处理中记录，返回是否写入成功
+		Claim(key string, record *IdempotencyRecord, ttl time.Duration) (bool, error)
+		// 读取记录，不存在时返回 nil
+		Load(key string) (*IdempotencyRecord, error)
+		// 保存完成的记录
+		Save(key string, record *IdempotencyRecord, ttl time.Duration) error
+		// 删除记录，处理失败时允许客户端重试
+		Release(key string) error
+	}
+
+	// 幂等记录
+	IdempotencyRecord struct {
+		Fingerprint string              `json:"fingerprint"`        // 请求指纹，方法、路径、查询参数及请求体的摘要
+		Done        bool                `json:"done"`               // 是否已完成
+		Unknown     bool                `json:"unknown,omitempty"`  // 上游超时，无法确定是否已经执行
+		Uncached    bool                `json:"uncached,omitempty"` // 已完成，但回复体过大未缓存
+		Status      int                 `json:"status,omitempty"`
+		Headers     map[string][]string `json:"headers,omitempty"`
+		Body        []byte              `json:"body,omitempty"`
+	}
+
+	// 本地存储，按最近使用顺序淘汰
+	localIdempotencyStore struct {
+		mutex      sync.Mutex
+		maxEntries int
+		records    map[string]*list.Element // 元素值为 *localIdempotencyRecord
+		lru        *list.List               // 最近使用的记录在前
+		lastSweep  time.Time
+	}
+
+	localIdempotencyRecord struct {
+		key    string
+		record *IdempotencyRecord
+		expire time.Time
+	}
+
+	// Redis 存储
+	redisIdempotencyStore struct{}
+
+	// 幂等处理者
+	idempotency struct {
+		config IdempotencyConfig
+		store  IdempotencyStore
+	}
+
+	// 记录回复数据的响应写入者，超过上限后不再记录
+	responseRecorder struct {
+		gin.ResponseWriter
+		body     bytes.Buffer
+		limit    int
+		overflow bool
+	}
+)
+
+const (
+	// 幂等键请求头
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// 重放的回复携带该响应头
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	// 幂等记录 Redis 键前缀
+	IdempotencyRedisKeyPrefix = "Gateway:Idempotency:"
+
+	// 幂等键最大长度
+	MaxIdempotencyKeyLength = 255
+
+	DefaultIdempotencyWindow       = 24 * time.Hour
+	DefaultIdempotencyLockTimeout  = 30 * time.Second
+	DefaultIdempotencyPollInterval = 50 * time.Millisecond
+	DefaultIdempotencyMaxEntries   = 100000
+	DefaultIdempotencyMaxBodySize  = 1 << 20
+)
+
+var (
+	ErrInvalidIdempotencyKey  = errors.New("invalid idempotency key")
+	ErrIdempotencyKeyReused   = errors.New("idempotency key reused with a different request")
+	ErrIdempotencyKeyInFlight = errors.New("request with the same idempotency key is in progress")
+	ErrIdempotencyUnknown     = errors.New("outcome of the request with the same idempotency key is unknown")
+	ErrIdempotencyUncached    = errors.New("request with the same idempotency key is done , response too large to replay")
+
+	// 重放时不复制的响应头，这些响应头与每个请求相关，由本次请求的处理重新设置
+	replaySkipHeaders = []string{"Access-Control-", "Vary", "Date", "Set-Cookie", "Content-Length", RequestIDHeader, IdempotentReplayedHeader}
+)
+
+// 新建本地存储，只在单个网关实例内生效
+// 记录数达到 maxEntries 时淘汰最久未使用的记录，被淘汰的键不再受幂等保护
+func NewLocalIdempotencyStore(maxEntries int) IdempotencyStore {
+	if maxEntries <= 0 {
+		maxEntries = DefaultIdempotencyMaxEntries
+	}
+	return &localIdempotencyStore{
+		maxEntries: maxEntries,
+		records:    map[string]*list.Element{},
+		lru:        list.New(),
+		lastSweep:  time.Now(),
+	}
+}
+
+// 新建 Redis 存储
+// 使用前需先调用 redis.InitializeRedis
+func NewRedisIdempotencyStore() IdempotencyStore {
+	return &redisIdempotencyStore{}
+}
+
+func (ls *localIdempotencyStore) Claim(key string, record *IdempotencyRecord, ttl time.Duration) (bool, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	now := time.Now()
+	ls.sweep(now)
+	if r := ls.get(key, now); r != nil {
+		return false, nil
+	}
+	ls.set(key, record, now.Add(ttl))
+	return true, nil
+}
+
+func (ls *localIdempotencyStore) Load(key string) (*IdempotencyRecord, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if r := ls.get(key, time.Now()); r != nil {
+		return r.record, nil
+	}
+	return nil, nil
+}
+
+func (ls *localIdempotencyStore) Save(key string, record *IdempotencyRecord, ttl time.Duration) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	ls.set(key, record, time.Now().Add(ttl))
+	return nil
+}
+
+func (ls *localIdempotencyStore) Release(key string) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if e, exist := ls.records[key]; exist {
+		ls.lru.Remove(e)
+		delete(ls.records, key)
+	}
+	return nil
+}
+
+// 读取未到期的记录并标记为最近使用，调用方需持有锁
+func (ls *localIdempotencyStore) get(key string, now time.Time) *localIdempotencyRecord {
+	e, exist := ls.records[key]
+	if !exist {
+		return nil
+	}
+	r := e.Value.(*localIdempotencyRecord)
+	if !now.Before(r.expire) {
+		return nil
+	}
+	ls.lru.MoveToFront(e)
+	return r
+}
+
+// 写入记录，超过数量上限时淘汰最久未使用的记录，调用方需持有锁
+func (ls *localIdempotencyStore) set(key string, record *IdempotencyRecord, expire time.Time) {
+	if e, exist := ls.records[key]; exist {
+		r := e.Value.(*localIdempotencyRecord)
+		r.record, r.expire = record, expire
+		ls.lru.MoveToFront(e)
+		return
+	}
+
+	ls.records[key] = ls.lru.PushFront(&localIdempotencyRecord{key: key, record: record, expire: expire})
+	for ls.lru.Len() > ls.maxEntries {
+		oldest := ls.lru.Back()
+		ls.lru.Remove(oldest)
+		delete(ls.records, oldest.Value.(*localIdempotencyRecord).key)
+	}
+}
+
+// 清理到期记录，调用方需持有锁
+func (ls *localIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(ls.lastSweep) < time.Minute {
+		return
+	}
+	ls.lastSweep = now
+
+	for key, e := range ls.records {
+		if now.After(e.Value.(*localIdempotencyRecord).expire) {
+			ls.lru.Remove(e)
+			delete(ls.records, key)
+		}
+	}
+}
+
+func (rs *redisIdempotencyStore) Claim(key string, record *IdempotencyRecord, ttl time.Duration) (bool, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+
+	// SET NX PX ，键已存在时返回 nil
+	err = redis.Set(IdempotencyRedisKeyPrefix+key, string(data), redis.StringSetTimeoutPX, ttl.Milliseconds(), redis.StringSetNotExist)
+	if err == redisGo.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (rs *redisIdempotencyStore) Load(key string) (*IdempotencyRecord, error) {
+	data, err := redis.Get(IdempotencyRedisKeyPrefix + key)
+	if err == redisGo.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := &IdempotencyRecord{}
+	if err := json.Unmarshal([]byte(data), record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (rs *redisIdempotencyStore) Save(key string, record *IdempotencyRecord, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// 只覆盖仍然存在的处理中记录，处理时间超过 LockTimeout 的记录可能已被其他请求重新抢占
+	err = redis.Set(IdempotencyRedisKeyPrefix+key, string(data), redis.StringSetTimeoutPX, ttl.Milliseconds(), redis.StringSetExist)
+	if err == redisGo.ErrNil {
+		return nil
+	}
+	return err
+}
+
+func (rs *redisIdempotencyStore) Release(key string) error {
+	_, err := redis.Del(IdempotencyRedisKeyPrefix + key)
+	return err
+}
+
+func newIdempotency(config IdempotencyConfig) *idempotency {
+	if config.Window <= 0 {
+		config.Window = DefaultIdempotencyWindow
+	}
+	if config.LockTimeout <= 0 {
+		config.LockTimeout = DefaultIdempotencyLockTimeout
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = DefaultIdempotencyPollInterval
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = []string{nHttp.MethodPost, nHttp.MethodPatch}
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = DefaultIdempotencyMaxEntries
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = DefaultIdempotencyMaxBodySize
+	}
+
+	i := &idempotency{config: config, store: NewLocalIdempotencyStore(config.MaxEntries)}
+	if config.Redis {
+		i.store = NewRedisIdempotencyStore()
+	}
+	return i
+}
+
+// 是否对该方法启用幂等键
+func (i *idempotency) enabled(method string) bool {
+	for _, m := range i.config.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rr *responseRecorder) Write(data []byte) (int, error) {
+	rr.record(data)
+	return rr.ResponseWriter.Write(data)
+}
+
+func (rr *responseRecorder) WriteString(s string) (int, error) {
+	rr.record([]byte(s))
+	return rr.ResponseWriter.WriteString(s)
+}
+
+func (rr *responseRecorder) record(data []byte) {
+	if rr.overflow {
+		return
+	}
+	if rr.body.Len()+len(data) > rr.limit {
+		rr.overflow = true
+		rr.body = bytes.Buffer{}
+		return
+	}
+	rr.body.Write(data)
+}
+
+// 幂等中间件
+// 携带 Idempotency-Key 的请求首次处理后缓存回复，重复请求直接重放；处理中的重复请求等待首个回复，
+// 同一个键用于不同的请求时回复 409 ；5xx 回复不缓存，客户端可以使用同一个键重试
+// 回复体超过 MaxBodySize 时只记录已完成，使用同一个键的重复请求回复 409
+// 上游超时（504）时请求可能已经执行，保留记录，使用同一个键的重复请求回复 409 ，不再转发
+func (bg *baseGateway) IdempotencyMiddleware(context *gin.Context) {
+	i := bg.idempotency
+	if i == nil || !i.enabled(context.Request.Method) {
+		return
+	}
+	key := context.GetHeader(IdempotencyKeyHeader)
+	if key == "" {
+		return
+	}
+	if len(key) > MaxIdempotencyKeyLength {
+		writeError(context, nHttp.StatusBadRequest, "", ErrInvalidIdempotencyKey.Error())
+		return
+	}
+
+	fingerprint, err := bg.fingerprint(context)
+	if err != nil {
+		writeError(context, nHttp.StatusBadRequest, "", "read body error")
+		return
+	}
+	// 幂等键的作用域为调用方、方法及路径，不同调用方使用相同的键互不影响
+	scoped := idempotencyOwner(context) + " " + context.Request.Method + " " + context.Request.URL.Path + " " + key
+
+	for deadline := time.Now().Add(i.config.LockTimeout); ; {
+		claimed, err := i.store.Claim(scoped, &IdempotencyRecord{Fingerprint: fingerprint}, i.config.LockTimeout)
+		if err != nil {
+			// 存储不可用时不阻断请求
+			log.ErrorF("Claim idempotency key [%s] error : %s", scoped, err.Error())
+			return
+		}
+		if claimed {
+			i.process(context, scoped, fingerprint)
+			return
+		}
+
+		record, err := i.store.Load(scoped)
+		if err != nil {
+			log.ErrorF("Load idempotency key [%s] error : %s", scoped, err.Error())
+			return
+		}
+		// 记录在抢占与读取之间到期，重新抢占
+		if record == nil {
+			continue
+		}
+		if record.Fingerprint != fingerprint {
+			writeError(context, nHttp.StatusConflict, "", ErrIdempotencyKeyReused.Error())
+			return
+		}
+		if record.Unknown {
+			writeError(context, nHttp.StatusConflict, "", ErrIdempotencyUnknown.Error())
+			return
+		}
+		if record.Uncached {
+			writeError(context, nHttp.StatusConflict, "", ErrIdempotencyUncached.Error())
+			return
+		}
+		if record.Done {
+			replay(context, record)
+			return
+		}
+		if time.Now().After(deadline) {
+			writeError(context, nHttp.StatusConflict, "", ErrIdempotencyKeyInFlight.Error())
+			return
+		}
+
+		select {
+		case <-time.After(i.config.PollInterval):
+		case <-context.Request.Context().Done():
+			context.Abort()
+			return
+		}
+	}
+}
+
+// 处理首个请求并保存回复
+func (i *idempotency) process(context *gin.Context, key, fingerprint string) {
+	recorder := &responseRecorder{ResponseWriter: context.Writer, limit: i.config.MaxBodySize}
+	context.Writer = recorder
+	context.Next()
+	context.Writer = recorder.ResponseWriter
+
+	status := recorder.Status()
+	if status == nHttp.StatusGatewayTimeout {
+		record := &IdempotencyRecord{Fingerprint: fingerprint, Unknown: true}
+		if err := i.store.Save(key, record, i.config.Window); err != nil {
+			log.ErrorF("Save idempotency key [%s] error : %s", key, err.Error())
+		}
+		return
+	}
+	if status >= nHttp.StatusInternalServerError {
+		if err := i.store.Release(key); err != nil {
+			log.ErrorF("Release idempotency key [%s] error : %s", key, err.Error())
+		}
+		return
+	}
+
+	record := &IdempotencyRecord{Fingerprint: fingerprint, Done: true, Uncached: true}
+	if !recorder.overflow {
+		record = &IdempotencyRecord{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Status:      status,
+			Headers:     replayHeaders(recorder.Header()),
+			Body:        recorder.body.Bytes(),
+		}
+	}
+	if err := i.store.Save(key, record, i.config.Window); err != nil {
+		log.ErrorF("Save idempotency key [%s] error : %s", key, err.Error())
+	}
+}
+
+// 重放缓存的回复
+func replay(context *gin.Context, record *IdempotencyRecord) {
+	header := context.Writer.Header()
+	for key, values := range record.Headers {
+		header[key] = values
+	}
+	header.Set(IdempotentReplayedHeader, "true")
+	context.Status(record.Status)
+	if _, err := context.Writer.Write(record.Body); err != nil {
+		log.ErrorF("Replay idempotent response error : %s", err.Error())
+	}
+	context.Abort()
+}
+
+// 可以重放的响应头，CORS 等与请求相关的响应头不保存
+func replayHeaders(header nHttp.Header) nHttp.Header {
+	h := nHttp.Header{}
+	for key, values := range header {
+		skip := false
+		for _, prefix := range replaySkipHeaders {
+			if strings.HasPrefix(key, prefix) {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			h[key] = append([]string(nil), values...)
+		}
+	}
+	return h
+}
+
+// 幂等键所属的调用方，携带令牌时为令牌摘要，否则为客户端 IP
+// 网关不在 HTTP 请求上认证，令牌摘要只用于隔离不同调用方的幂等键
+func idempotencyOwner(context *gin.Context) string {
+	if token := tokenFromRequest(context.Request); token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	return context.GetString(ClientIPKey)
+}
+
+// 请求指纹，读取的请求体会放回请求中
+func (bg *baseGateway) fingerprint(context *gin.Context) (string, error) {
+	// 最多读取最大的请求体限制加一字节，超出部分不计入指纹，由后续处理回复 413
+	limit := bg.maxBodySize
+	for _, route := range bg.routes {
+		if route.MaxBodySize > limit {
+			limit = route.MaxBodySize
+		}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(context.Request.Body, limit+1))
+	if err != nil {
+		return "", err
+	}
+	context.Request.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), context.Request.Body))
+
+	hash := sha256.New()
+	for _, part := range []string{context.Request.Method, context.Request.URL.Path, context.Request.URL.RawQuery} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,167 @@
+package gateway
+
+import (
+	"bytes"
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"net/http/httptest"
+	"sherlock/client"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func serveIdempotent(eg *engineGateway, target, key, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(nHttp.MethodPost, target, bytes.NewReader([]byte(`{"item":1}`)))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(IdempotencyKeyHeader, key)
+	// 缩短超时测试的等待时间
+	request.Header.Set(client.DeadlineBudgetHeader, "200")
+	if token != "" {
+		request.Header.Set("Authorization", BearerPrefix+token)
+	}
+	recorder := httptest.NewRecorder()
+	eg.engine.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0", WithIdempotency(IdempotencyConfig{})))
+
+	calls := int32(0)
+	if _, err := c.Subscribe("Lobby.Buy", "", func(msg *nats.Msg) {
+		atomic.AddInt32(&calls, 1)
+		_ = c.Reply(msg.Reply, "", []byte(`{"ok":true}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := serveIdempotent(eg, "/Lobby/Buy", "k1", "alice")
+	second := serveIdempotent(eg, "/Lobby/Buy", "k1", "alice")
+	if first.Code != nHttp.StatusOK || second.Code != nHttp.StatusOK {
+		t.Fatalf("status = %d , %d", first.Code, second.Code)
+	}
+	if second.Header().Get(IdempotentReplayedHeader) != "true" || second.Body.String() != first.Body.String() {
+		t.Fatal("second request not replayed")
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("service called %d times , want 1", n)
+	}
+
+	// 其他调用方使用相同的键不会得到他人的回复
+	if other := serveIdempotent(eg, "/Lobby/Buy", "k1", "bob"); other.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Fatal("reply replayed to another caller")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("service called %d times , want 2", n)
+	}
+}
+
+func TestIdempotencyKeepsTimedOutKey(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0", WithIdempotency(IdempotencyConfig{})))
+
+	calls := int32(0)
+	if _, err := c.Subscribe("Lobby.Slow", "", func(*nats.Msg) {
+		atomic.AddInt32(&calls, 1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if first := serveIdempotent(eg, "/Lobby/Slow", "k1", ""); first.Code != nHttp.StatusGatewayTimeout {
+		t.Fatalf("status = %d , want %d", first.Code, nHttp.StatusGatewayTimeout)
+	}
+	// 上游可能已经执行，重复请求不再转发
+	if second := serveIdempotent(eg, "/Lobby/Slow", "k1", ""); second.Code != nHttp.StatusConflict {
+		t.Fatalf("retry status = %d , want %d", second.Code, nHttp.StatusConflict)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("service called %d times , want 1", n)
+	}
+}
+
+func TestIdempotencyReplaySkipsPerRequestHeaders(t *testing.T) {
+	config := DefaultSecurityConfig()
+	config.AllowOrigins = []string{"https://a.example.com", "https://b.example.com"}
+
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0", WithSecurity(config), WithIdempotency(IdempotencyConfig{})))
+	if _, err := c.Subscribe("Lobby.Buy", "", func(msg *nats.Msg) {
+		_ = c.Reply(msg.Reply, "", []byte(`{"ok":true}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(origin string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(nHttp.MethodPost, "/Lobby/Buy", bytes.NewReader([]byte(`{"item":1}`)))
+		request.Header.Set(IdempotencyKeyHeader, "k1")
+		if origin != "" {
+			request.Header.Set(HeaderOrigin, origin)
+		}
+		recorder := httptest.NewRecorder()
+		eg.engine.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	send("https://a.example.com")
+	second := send("https://b.example.com")
+	if second.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Fatal("second request not replayed")
+	}
+	if got := second.Header().Get("Access-Control-Allow-Origin"); got != "https://b.example.com" {
+		t.Fatalf("allow origin = %q , want the current origin", got)
+	}
+	if third := send(""); third.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("CORS header replayed to a request without origin")
+	}
+}
+
+func TestIdempotencyUncachedBody(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0", WithIdempotency(IdempotencyConfig{MaxBodySize: 8})))
+
+	calls := int32(0)
+	if _, err := c.Subscribe("Lobby.Buy", "", func(msg *nats.Msg) {
+		atomic.AddInt32(&calls, 1)
+		_ = c.Reply(msg.Reply, "", []byte(`{"items":[1,2,3,4,5]}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if first := serveIdempotent(eg, "/Lobby/Buy", "k1", ""); first.Code != nHttp.StatusOK {
+		t.Fatalf("status = %d , want %d", first.Code, nHttp.StatusOK)
+	}
+	// 回复体超过上限未缓存，但请求已经执行，不再转发
+	if second := serveIdempotent(eg, "/Lobby/Buy", "k1", ""); second.Code != nHttp.StatusConflict {
+		t.Fatalf("retry status = %d , want %d", second.Code, nHttp.StatusConflict)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("service called %d times , want 1", n)
+	}
+}
+
+func TestLocalIdempotencyStoreEviction(t *testing.T) {
+	store := NewLocalIdempotencyStore(2)
+	for _, key := range []string{"a", "b"} {
+		if claimed, _ := store.Claim(key, &IdempotencyRecord{}, time.Minute); !claimed {
+			t.Fatalf("claim %s failed", key)
+		}
+	}
+	// 使用 a 后写入 c ，淘汰最久未使用的 b
+	if record, _ := store.Load("a"); record == nil {
+		t.Fatal("record a missing")
+	}
+	if claimed, _ := store.Claim("c", &IdempotencyRecord{}, time.Minute); !claimed {
+		t.Fatal("claim c failed")
+	}
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if record, _ := store.Load(key); (record != nil) != want {
+			t.Errorf("record %s exist = %v , want %v", key, record != nil, want)
+		}
+	}
+	if n := len(store.(*localIdempotencyStore).records); n != 2 {
+		t.Fatalf("records = %d , want 2", n)
+	}
+}
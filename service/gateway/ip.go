@@ -0,0 +1,260 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	nHttp "net/http"
+	"sherlock/log"
+	"sherlock/util/encrypt"
+	"sherlock/util/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// 客户端 IP 解析者
+	// 只有直接连接方属于受信任代理时，才采信 X-Forwarded-For 、X-Real-IP 及 PROXY 协议中携带的地址
+	ipResolver struct {
+		trusted []*net.IPNet
+	}
+)
+
+const (
+	// 转发地址请求头
+	HeaderXForwardedFor = "X-Forwarded-For"
+	// 真实地址请求头
+	HeaderXRealIP = "X-Real-IP"
+
+	// gin 上下文中保存客户端 IP 的键
+	ClientIPKey = "Sherlock-Client-IP"
+
+	// 读取 PROXY 协议头的超时时间
+	ProxyHeaderTimeout = 5 * time.Second
+	// PROXY 协议 v1 头最大长度
+	proxyV1MaxLength = 107
+)
+
+var (
+	// PROXY 协议 v2 签名
+	proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+	// PROXY 协议 v1 前缀
+	proxyV1Prefix = []byte("PROXY ")
+
+	ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+)
+
+// 新建客户端 IP 解析者，受信任代理可以是 IP 或 CIDR
+func newIPResolver(trustedProxies ...string) *ipResolver {
+	r := &ipResolver{trusted: []*net.IPNet{}}
+
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				log.ErrorF("Parse trusted proxy [%s] error : invalid ip", proxy)
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.ErrorF("Parse trusted proxy [%s] error : %s", proxy, err.Error())
+			continue
+		}
+		r.trusted = append(r.trusted, network)
+	}
+
+	return r
+}
+
+// 是否为受信任代理
+func (r *ipResolver) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range r.trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析 HTTP 请求的客户端 IP
+func (r *ipResolver) ClientIP(req *nHttp.Request) string {
+	remote := hostOf(req.RemoteAddr)
+	if !r.isTrusted(remote) {
+		return remote
+	}
+
+	// 从右往左跳过受信任代理，第一个不受信任的地址即为客户端
+	if xff := req.Header.Get(HeaderXForwardedFor); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !r.isTrusted(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+
+	if real := strings.TrimSpace(req.Header.Get(HeaderXRealIP)); net.ParseIP(real) != nil {
+		return real
+	}
+
+	return remote
+}
+
+// 解析 TCP 连接的客户端地址
+// 开启 PROXY 协议且直接连接方为受信任代理时，从连接头部读取 PROXY 协议头
+func (r *ipResolver) ClientAddr(conn net.Conn, reader *bufio.Reader, proxyProtocol bool) (net.Addr, error) {
+	remote := conn.RemoteAddr()
+	if !proxyProtocol || !r.isTrusted(hostOf(remote.String())) {
+		return remote, nil
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	addr, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	// LOCAL 命令或 UNKNOWN 协议，沿用直接连接方地址
+	if addr == nil {
+		return remote, nil
+	}
+
+	return addr, nil
+}
+
+// 读取 PROXY 协议头，支持 v1 及 v2
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	peek, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(peek, proxyV2Signature) {
+		return readProxyV2(reader)
+	}
+	if bytes.HasPrefix(peek, proxyV1Prefix) {
+		return readProxyV1(reader)
+	}
+
+	return nil, ErrInvalidProxyHeader
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, ErrInvalidProxyHeader
+		}
+	}
+
+	fields := strings.Fields(strings.TrimRight(string(line), "\r\n"))
+	if len(fields) < 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// 12 字节签名 + 1 字节版本命令 + 1 字节协议族 + 2 字节地址长度 + 地址
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+	command := header[12] & 0x0F
+	family := header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL 命令，代理自身发起的连接
+	if command == 0x00 {
+		return nil, nil
+	}
+	if command != 0x01 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	switch family >> 4 {
+	case 0x1: // IPv4
+		if length < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: // IPv6
+		if length < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default: // UNSPEC 及 UNIX
+		return nil, nil
+	}
+}
+
+// 从 host:port 中取出 host ，无法解析时原样返回
+func hostOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// 生成连接 ID ，同一客户端地址的多次连接互不相同
+func newConnID(clientAddr string) string {
+	return encrypt.MD5(clientAddr, fmt.Sprintf("%d", time.Now().UnixNano()), rand.RandomString(8))
+}
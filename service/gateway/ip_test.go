@@ -0,0 +1,131 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	nHttp "net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 构造 PROXY 协议 v2 头
+func proxyV2Header(command, family byte, payload []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// IPv4 或 IPv6 地址块：源地址 + 目标地址 + 源端口 + 目标端口
+func proxyV2Addresses(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	payload := append(append([]byte(nil), src...), dst...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:4], dstPort)
+	return append(payload, ports...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := proxyV2Addresses(net.ParseIP("203.0.113.7").To4(), net.ParseIP("10.0.0.1").To4(), 56324, 443)
+	ipv6 := proxyV2Addresses(net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1"), 56324, 443)
+	unix := make([]byte, 216)
+
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string // 为空时没有地址，沿用直接连接方地址
+		err    bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"), "203.0.113.7:56324", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n"), "[2001:db8::7]:56324", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 truncated", []byte("PROXY TCP4 203.0.113.7 10.0"), "", true},
+		{"v1 missing fields", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324\r\n"), "", true},
+		{"v1 bad protocol", []byte("PROXY UDP4 203.0.113.7 10.0.0.1 56324 443\r\n"), "", true},
+		{"v1 bad ip", []byte("PROXY TCP4 203.0.113.999 10.0.0.1 56324 443\r\n"), "", true},
+		{"v1 bad port", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 65536 443\r\n"), "", true},
+		{"v1 too long", append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), proxyV1MaxLength)...), "", true},
+		{"v2 ipv4", proxyV2Header(0x1, 0x11, ipv4), "203.0.113.7:56324", false},
+		{"v2 ipv6", proxyV2Header(0x1, 0x21, ipv6), "[2001:db8::7]:56324", false},
+		{"v2 unix", proxyV2Header(0x1, 0x31, unix), "", false},
+		{"v2 local", proxyV2Header(0x0, 0x00, nil), "", false},
+		{"v2 truncated header", proxyV2Header(0x1, 0x11, ipv4)[:14], "", true},
+		{"v2 truncated payload", proxyV2Header(0x1, 0x11, ipv4)[:20], "", true},
+		{"v2 short ipv4", proxyV2Header(0x1, 0x11, ipv4[:8]), "", true},
+		{"v2 short ipv6", proxyV2Header(0x1, 0x21, ipv6[:32]), "", true},
+		{"v2 bad version", append(append([]byte(nil), proxyV2Signature...), 0x11, 0x11, 0, 0), "", true},
+		{"v2 bad command", proxyV2Header(0x2, 0x11, ipv4), "", true},
+		{"bad signature", append([]byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0B}, ipv4...), "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), "", true},
+		{"empty", nil, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// 协议头之后的数据保留在 reader 中
+			reader := bufio.NewReader(bytes.NewReader(append(append([]byte(nil), test.header...), "payload"...)))
+			if test.err {
+				reader = bufio.NewReader(bytes.NewReader(test.header))
+			}
+
+			addr, err := readProxyHeader(reader)
+			if test.err {
+				if err == nil {
+					t.Fatalf("addr = %v , want error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.addr == "" && addr != nil || test.addr != "" && (addr == nil || addr.String() != test.addr) {
+				t.Fatalf("addr = %v , want %q", addr, test.addr)
+			}
+			if rest, _ := reader.ReadString(0); rest != "payload" {
+				t.Fatalf("data after header = %q", rest)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := newIPResolver("10.0.0.0/8", "192.0.2.1")
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		real   string
+		want   string
+	}{
+		{"direct", "198.51.100.9:1234", "", "", "198.51.100.9"},
+		{"untrusted remote ignores headers", "198.51.100.9:1234", "203.0.113.7", "203.0.113.8", "198.51.100.9"},
+		{"trusted proxy", "192.0.2.1:1234", "203.0.113.7", "", "203.0.113.7"},
+		{"skip trusted hops", "192.0.2.1:1234", "203.0.113.7, 10.0.0.2, 10.0.0.3", "", "203.0.113.7"},
+		// 客户端伪造的最左侧地址经过不受信任的代理，采信不受信任代理的地址
+		{"spoofed through untrusted proxy", "192.0.2.1:1234", "1.1.1.1, 198.51.100.9, 10.0.0.2", "", "198.51.100.9"},
+		{"all hops trusted", "192.0.2.1:1234", "10.0.0.2, 10.0.0.3", "", "10.0.0.2"},
+		{"invalid hop", "192.0.2.1:1234", "203.0.113.7, garbage", "203.0.113.8", "203.0.113.8"},
+		{"real ip fallback", "192.0.2.1:1234", "", "203.0.113.8", "203.0.113.8"},
+		{"invalid real ip", "192.0.2.1:1234", "", "garbage", "192.0.2.1"},
+		{"ipv6", "[2001:db8::1]:1234", "", "", "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(nHttp.MethodGet, "/", nil)
+			request.RemoteAddr = test.remote
+			if test.xff != "" {
+				request.Header.Set(HeaderXForwardedFor, test.xff)
+			}
+			if test.real != "" {
+				request.Header.Set(HeaderXRealIP, test.real)
+			}
+			if got := r.ClientIP(request); got != test.want {
+				t.Fatalf("client ip = %s , want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"github.com/nats-io/nats.go"
+	"time"
+)
+
+type (
+	// 网关选项
+	Option func(*baseGateway)
+)
+
+const ()
+
+var ()
+
+// 设置受信任代理，可以是 IP 或 CIDR
+// 只有直接连接方属于受信任代理时，才采信其转发的客户端地址
+func WithTrustedProxies(proxies ...string) Option {
+	return func(bg *baseGateway) {
+		bg.resolver = newIPResolver(proxies...)
+	}
+}
+
+// 开启 PROXY 协议（v1/v2）解析，仅作用于 TCP 网关，且只解析受信任代理的连接
+func WithProxyProtocol() Option {
+	return func(bg *baseGateway) {
+		bg.proxyProtocol = true
+	}
+}
+
+// 使用持久化黑名单，名单变更同步写入 Redis ，网关初始化时从 Redis 恢复
+// 使用前需先调用 redis.InitializeRedis
+func WithPersistentBlackList() Option {
+	return func(bg *baseGateway) {
+		bg.bl = NewPersistentBlackList()
+	}
+}
+
+// 设置认证者，WebSocket 升级前执行认证，认证通过的身份随每一条消息转发
+func WithAuthenticator(auth Authenticator) Option {
+	return func(bg *baseGateway) {
+		bg.auth = auth
+	}
+}
+
+// 设置 WebSocket 连接配置，包括最大连接数、最大消息长度、发送队列长度及心跳
+func WithConnectionConfig(config ConnectionConfig) Option {
+	return func(bg *baseGateway) {
+		bg.connConfig = config
+	}
+}
+
+// 设置 TCP 网关连接配置，包括最大连接数、最大帧长度、写入超时及读空闲超时
+func WithSocketConfig(config SocketConfig) Option {
+	return func(bg *baseGateway) {
+		bg.socketConfig = config
+	}
+}
+
+// 开启 WebSocket 会话恢复，推送消息携带会话序号，客户端断线重连后补收断开期间的推送
+func WithResume(config ResumeConfig) Option {
+	return func(bg *baseGateway) {
+		bg.resume = &config
+	}
+}
+
+// 设置 WebSocket 请求超时时间，携带请求 ID 的请求超时未回复时，网关向客户端回复错误
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(bg *baseGateway) {
+		if timeout > 0 {
+			bg.reqTimeout = timeout
+		}
+	}
+}
+
+// 设置 HTTP 路由表，设置后不再支持默认的 POST /:module/:path 请求
+func WithRoutes(routes ...Route) Option {
+	return func(bg *baseGateway) {
+		bg.routes = append(bg.routes, routes...)
+	}
+}
+
+// 开启限流，超过限制的 HTTP 请求回复 429 ，WebSocket 消息回复错误，TCP 消息直接丢弃
+func WithRateLimit(config RateLimitConfig) Option {
+	return func(bg *baseGateway) {
+		bg.limiter = newRateLimiter(config)
+	}
+}
+
+// 开启 TLS ，HTTP 网关同时支持 HTTP/2
+func WithTLS(config TLSConfig) Option {
+	return func(bg *baseGateway) {
+		bg.tls = &config
+	}
+}
+
+// 设置 CORS 、WebSocket 来源白名单及安全响应头，运行期间可通过 Gateway.Security.Update 主题热更新
+func WithSecurity(config SecurityConfig) Option {
+	return func(bg *baseGateway) {
+		bg.security = newSecurity(config)
+	}
+}
+
+// 开启 SSE ，GET /events 以事件流推送用户及有权限的主题消息，支持 Last-Event-ID 断线补发
+func WithSSE(config SSEConfig) Option {
+	return func(bg *baseGateway) {
+		bg.sse = &config
+	}
+}
+
+// 设置 HTTP 最大请求体字节数，超过时回复 413 ，路由可以单独设置
+func WithBodyLimit(size int64) Option {
+	return func(bg *baseGateway) {
+		if size > 0 {
+			bg.maxBodySize = size
+		}
+	}
+}
+
+// 为主题注册请求体 JSON Schema ，主题支持 NATS 通配符，校验失败时回复 400
+func WithJSONSchema(subject, schema string) Option {
+	return func(bg *baseGateway) {
+		bg.schemas[subject] = schema
+	}
+}
+
+// 开启 Idempotency-Key 支持，首个回复在窗口期内缓存，重复请求直接重放
+func WithIdempotency(config IdempotencyConfig) Option {
+	return func(bg *baseGateway) {
+		bg.idempotency = newIdempotency(config)
+	}
+}
+
+// 开启访问日志，HTTP 请求及 WebSocket 消息以 JSON 格式记录，支持采样及请求体脱敏
+func WithAccessLog(config AccessLogConfig) Option {
+	return func(bg *baseGateway) {
+		bg.accessLog = newAccessLogger(config)
+	}
+}
+
+// 设置实例 ID ，管理主题为 Gateway.Admin.<instanceID>.<command> ，默认为主机名加随机后缀
+func WithInstanceID(id string) Option {
+	return func(bg *baseGateway) {
+		if validSubjectToken(id) {
+			bg.instanceID = id
+		}
+	}
+}
+
+// 新建基础网关并应用选项
+func newBaseGateway(address string, options ...Option) baseGateway {
+	bg := baseGateway{
+		address:       address,
+		server:        nil,
+		subscriptions: []*nats.Subscription{},
+		bl:            NewBlackList(),
+		resolver:      newIPResolver(),
+		connConfig:    DefaultConnectionConfig(),
+		socketConfig:  DefaultSocketConfig(),
+		reqTimeout:    DefaultWebSocketRequestTimeout,
+		security:      newSecurity(DefaultSecurityConfig()),
+		maxBodySize:   DefaultMaxBodySize,
+		schemas:       map[string]string{},
+		instanceID:    defaultInstanceID(),
+		startedAt:     time.Now(),
+		stats:         &gatewayCounter{},
+	}
+
+	for _, option := range options {
+		option(&bg)
+	}
+
+	return bg
+}
@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// 连接上等待回复的请求
+	// 每个请求使用独立的回复主题 [WS_CONN.连接ID.序号] ，回复到达时按序号找回客户端的请求 ID
+	pendingRequests struct {
+		mutex    sync.Mutex
+		seq      uint64
+		requests map[string]*pendingRequest // map[序号]请求
+	}
+
+	pendingRequest struct {
+		requestID string
+		subject   string    // 请求主题
+		size      int       // 请求数据字节数
+		start     time.Time // 请求时间
+		timer     *time.Timer
+	}
+)
+
+const (
+	// 请求 ID 消息头，转发给服务，便于链路追踪
+	RequestIDHeader = "Sherlock-Request-Id"
+
+	// WebSocket 网关默认请求超时时间
+	DefaultWebSocketRequestTimeout = 12 * time.Second
+)
+
+var (
+	ErrRequestTimeout = errors.New("request timeout")
+	ErrRequestFailed  = errors.New("request failed")
+)
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{requests: map[string]*pendingRequest{}}
+}
+
+// 登记请求，返回回复主题使用的序号，超时未回复时执行 onTimeout
+func (pr *pendingRequests) add(requestID, subject string, size int, timeout time.Duration, onTimeout func(*pendingRequest)) string {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	pr.seq++
+	seq := strconv.FormatUint(pr.seq, 10)
+
+	pr.requests[seq] = &pendingRequest{
+		requestID: requestID,
+		subject:   subject,
+		size:      size,
+		start:     time.Now(),
+		timer: time.AfterFunc(timeout, func() {
+			if request, ok := pr.take(seq); ok {
+				onTimeout(request)
+			}
+		}),
+	}
+
+	return seq
+}
+
+// 取出请求，已回复或已超时的请求返回 false
+func (pr *pendingRequests) take(seq string) (*pendingRequest, bool) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	request, exist := pr.requests[seq]
+	if !exist {
+		return nil, false
+	}
+	delete(pr.requests, seq)
+	request.timer.Stop()
+
+	return request, true
+}
+
+// 清空所有请求，连接关闭时调用
+func (pr *pendingRequests) clear() {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	for seq, request := range pr.requests {
+		request.timer.Stop()
+		delete(pr.requests, seq)
+	}
+}
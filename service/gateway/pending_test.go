@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingRequestTake(t *testing.T) {
+	pr := newPendingRequests()
+	timeouts := make(chan *pendingRequest, 2)
+
+	first := pr.add("r1", "Lobby.Buy", 10, time.Minute, func(request *pendingRequest) { timeouts <- request })
+	second := pr.add("r2", "Lobby.Sell", 20, time.Minute, func(request *pendingRequest) { timeouts <- request })
+	if first == second {
+		t.Fatalf("sequence %s reused", first)
+	}
+
+	request, ok := pr.take(first)
+	if !ok || request.requestID != "r1" || request.subject != "Lobby.Buy" || request.size != 10 {
+		t.Fatalf("take = %+v , %v", request, ok)
+	}
+	// 已回复的请求不能再次取出
+	if _, ok := pr.take(first); ok {
+		t.Fatal("request taken twice")
+	}
+	if _, ok := pr.take("unknown"); ok {
+		t.Fatal("unknown request taken")
+	}
+	if request, ok := pr.take(second); !ok || request.requestID != "r2" {
+		t.Fatalf("take = %+v , %v", request, ok)
+	}
+}
+
+func TestPendingRequestTimeout(t *testing.T) {
+	pr := newPendingRequests()
+	timeouts := make(chan *pendingRequest, 2)
+
+	seq := pr.add("r1", "Lobby.Buy", 10, 20*time.Millisecond, func(request *pendingRequest) { timeouts <- request })
+	replied := pr.add("r2", "Lobby.Buy", 10, 20*time.Millisecond, func(request *pendingRequest) { timeouts <- request })
+	if _, ok := pr.take(replied); !ok {
+		t.Fatal("request not pending")
+	}
+
+	select {
+	case request := <-timeouts:
+		if request.requestID != "r1" {
+			t.Fatalf("timeout of %s , want r1", request.requestID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout not fired")
+	}
+	// 超时后迟到的回复被忽略
+	if _, ok := pr.take(seq); ok {
+		t.Fatal("timed out request taken")
+	}
+	// 已回复的请求不再触发超时
+	select {
+	case request := <-timeouts:
+		t.Fatalf("timeout of replied request %s", request.requestID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPendingRequestClear(t *testing.T) {
+	pr := newPendingRequests()
+	timeouts := make(chan *pendingRequest, 2)
+
+	seq := pr.add("r1", "Lobby.Buy", 10, 20*time.Millisecond, func(request *pendingRequest) { timeouts <- request })
+	pr.add("r2", "Lobby.Buy", 10, 20*time.Millisecond, func(request *pendingRequest) { timeouts <- request })
+	pr.clear()
+
+	if len(pr.requests) != 0 {
+		t.Fatalf("%d requests left after clear", len(pr.requests))
+	}
+	if _, ok := pr.take(seq); ok {
+		t.Fatal("request taken after clear")
+	}
+	// 连接关闭后不再触发超时
+	select {
+	case request := <-timeouts:
+		t.Fatalf("timeout of cleared request %s", request.requestID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,362 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"sherlock/client"
+	"sherlock/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// 可推送的连接
+	pushConn interface {
+		// 推送数据
+		push([]byte) error
+	}
+
+	// 推送注册表
+	// 连接只登记在持有它的网关实例上，分组成员关系则通过广播复制到所有网关实例，
+	// 推送主题由每个实例以非队列方式订阅，只有持有目标连接的实例会真正写出数据，
+	// 因此推送无论用户连接在哪个实例上都能送达
+	pushRegistry struct {
+		mutex  sync.RWMutex
+		users  map[string]map[pushConn]struct{} // 本实例上的用户连接 map[userID]conns
+		all    map[pushConn]struct{}            // 本实例上的所有连接
+		groups map[string]map[string]struct{}   // 分组成员 map[group]userIDs
+		// 获取快照期间收到变更的成员关系 map[GroupMembership]，以变更为准，不为 nil 时记录
+		changed map[GroupMembership]struct{}
+	}
+
+	// 分组成员变更
+	GroupMembership struct {
+		UserID string `json:"user_id"`
+		Group  string `json:"group"`
+	}
+)
+
+const (
+	// 推送给用户的主题前缀 WS_USER.<userID>
+	UserPushSubjectPrefix = "WS_USER"
+	// 推送给分组的主题前缀 WS_GROUP.<group>
+	GroupPushSubjectPrefix = "WS_GROUP"
+	// 推送给所有连接的主题
+	BroadcastPushSubject = "WS_ALL"
+
+	// 加入分组主题，数据为 GroupMembership
+	GroupJoinSubject = "Gateway.Group.Join"
+	// 离开分组主题，数据为 GroupMembership
+	GroupLeaveSubject = "Gateway.Group.Leave"
+	// 分组成员快照请求主题，新启动的网关实例从已有实例获取成员关系
+	GroupSnapshotSubject = "Gateway.Group.Snapshot"
+
+	// 获取分组成员快照的超时时间
+	GroupSnapshotTimeout = time.Second
+)
+
+var (
+	ErrInvalidSubjectToken = errors.New("invalid subject token")
+)
+
+// 推送给用户的主题
+func UserPushSubject(userID string) string {
+	return fmt.Sprintf("%s.%s", UserPushSubjectPrefix, userID)
+}
+
+// 推送给分组的主题
+func GroupPushSubject(group string) string {
+	return fmt.Sprintf("%s.%s", GroupPushSubjectPrefix, group)
+}
+
+// 推送给用户
+func PushToUser(c client.Client, userID string, data []byte) error {
+	if !validSubjectToken(userID) {
+		return ErrInvalidSubjectToken
+	}
+	return c.Publish(UserPushSubject(userID), "", data)
+}
+
+// 推送给分组
+func PushToGroup(c client.Client, group string, data []byte) error {
+	if !validSubjectToken(group) {
+		return ErrInvalidSubjectToken
+	}
+	return c.Publish(GroupPushSubject(group), "", data)
+}
+
+// 推送给所有连接
+func Broadcast(c client.Client, data []byte) error {
+	return c.Publish(BroadcastPushSubject, "", data)
+}
+
+// 用户加入分组
+func JoinGroup(c client.Client, userID, group string) error {
+	return publishMembership(c, GroupJoinSubject, userID, group)
+}
+
+// 用户离开分组
+func LeaveGroup(c client.Client, userID, group string) error {
+	return publishMembership(c, GroupLeaveSubject, userID, group)
+}
+
+func publishMembership(c client.Client, subject, userID, group string) error {
+	if !validSubjectToken(userID) || !validSubjectToken(group) {
+		return ErrInvalidSubjectToken
+	}
+
+	data, err := json.Marshal(&GroupMembership{UserID: userID, Group: group})
+	if err != nil {
+		return err
+	}
+	return c.Publish(subject, "", data)
+}
+
+// 主题片段不能为空，且不能包含分隔符、通配符及空白字符
+func validSubjectToken(token string) bool {
+	return token != "" && !strings.ContainsAny(token, ".*> \t\r\n")
+}
+
+func newPushRegistry() *pushRegistry {
+	return &pushRegistry{
+		users:  map[string]map[pushConn]struct{}{},
+		all:    map[pushConn]struct{}{},
+		groups: map[string]map[string]struct{}{},
+	}
+}
+
+// 登记连接，匿名连接只接收广播
+func (pr *pushRegistry) add(userID string, conn pushConn) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	pr.all[conn] = struct{}{}
+	if userID == "" {
+		return
+	}
+	if _, exist := pr.users[userID]; !exist {
+		pr.users[userID] = map[pushConn]struct{}{}
+	}
+	pr.users[userID][conn] = struct{}{}
+}
+
+// 注销连接
+func (pr *pushRegistry) remove(userID string, conn pushConn) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	delete(pr.all, conn)
+	if conns, exist := pr.users[userID]; exist {
+		delete(conns, conn)
+		if len(conns) == 0 {
+			delete(pr.users, userID)
+		}
+	}
+}
+
+// 本实例上用户的连接
+func (pr *pushRegistry) userConns(userID string) []pushConn {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	conns := make([]pushConn, 0, len(pr.users[userID]))
+	for conn := range pr.users[userID] {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// 本实例上分组成员的连接
+func (pr *pushRegistry) groupConns(group string) []pushConn {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	conns := make([]pushConn, 0)
+	for userID := range pr.groups[group] {
+		for conn := range pr.users[userID] {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// 本实例上的所有连接
+func (pr *pushRegistry) allConns() []pushConn {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	conns := make([]pushConn, 0, len(pr.all))
+	for conn := range pr.all {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (pr *pushRegistry) join(userID, group string) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	pr.markChanged(userID, group)
+	pr.addMember(userID, group)
+}
+
+func (pr *pushRegistry) addMember(userID, group string) {
+	if _, exist := pr.groups[group]; !exist {
+		pr.groups[group] = map[string]struct{}{}
+	}
+	pr.groups[group][userID] = struct{}{}
+}
+
+func (pr *pushRegistry) leave(userID, group string) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	pr.markChanged(userID, group)
+	// 最后一名成员离开时删除分组
+	if members, exist := pr.groups[group]; exist {
+		delete(members, userID)
+		if len(members) == 0 {
+			delete(pr.groups, group)
+		}
+	}
+}
+
+// 分组成员快照 map[group][]userID
+func (pr *pushRegistry) snapshot() map[string][]string {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	s := make(map[string][]string, len(pr.groups))
+	for group, members := range pr.groups {
+		list := make([]string, 0, len(members))
+		for userID := range members {
+			list = append(list, userID)
+		}
+		s[group] = list
+	}
+	return s
+}
+
+func (pr *pushRegistry) markChanged(userID, group string) {
+	if pr.changed != nil {
+		pr.changed[GroupMembership{UserID: userID, Group: group}] = struct{}{}
+	}
+}
+
+// 开始记录变更，获取快照前调用
+func (pr *pushRegistry) track() {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	pr.changed = map[GroupMembership]struct{}{}
+}
+
+// 合并分组成员快照并停止记录变更，快照期间已有变更的成员关系以变更为准
+func (pr *pushRegistry) restore(s map[string][]string) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	for group, members := range s {
+		for _, userID := range members {
+			if _, exist := pr.changed[GroupMembership{UserID: userID, Group: group}]; !exist {
+				pr.addMember(userID, group)
+			}
+		}
+	}
+	pr.changed = nil
+}
+
+// 推送数据到连接
+func deliver(conns []pushConn, data []byte) {
+	for _, conn := range conns {
+		if err := conn.push(data); err != nil {
+			log.ErrorF("Push message error : %s", err.Error())
+		}
+	}
+}
+
+// 订阅推送及分组成员主题，并从已有实例获取分组成员快照
+// 先订阅变更再获取快照，快照前后的变更都不会丢失；最后才应答快照请求，避免应答自己的请求
+func (pr *pushRegistry) subscribe(name string, c client.Client) []*nats.Subscription {
+	handlers := []struct {
+		subject string
+		handler nats.MsgHandler
+	}{
+		{UserPushSubject(client.SubjectWildcardSingle), func(msg *nats.Msg) {
+			deliver(pr.userConns(msg.Subject[len(UserPushSubjectPrefix)+1:]), msg.Data)
+		}},
+		{GroupPushSubject(client.SubjectWildcardSingle), func(msg *nats.Msg) {
+			deliver(pr.groupConns(msg.Subject[len(GroupPushSubjectPrefix)+1:]), msg.Data)
+		}},
+		{BroadcastPushSubject, func(msg *nats.Msg) {
+			deliver(pr.allConns(), msg.Data)
+		}},
+		{GroupJoinSubject, func(msg *nats.Msg) {
+			if m, ok := parseMembership(msg); ok {
+				pr.join(m.UserID, m.Group)
+			}
+		}},
+		{GroupLeaveSubject, func(msg *nats.Msg) {
+			if m, ok := parseMembership(msg); ok {
+				pr.leave(m.UserID, m.Group)
+			}
+		}},
+	}
+
+	subscriptions := make([]*nats.Subscription, 0, len(handlers)+1)
+	sub := func(subject string, handler nats.MsgHandler) {
+		if sp, err := c.Subscribe(subject, "", handler); err != nil {
+			log.ErrorF("%s gateway subscribe [%s] error : %s", name, subject, err.Error())
+		} else {
+			subscriptions = append(subscriptions, sp)
+			log.DebugF("%s gateway subscribe [%s] success", name, sp.Subject)
+		}
+	}
+
+	pr.track()
+	for _, h := range handlers {
+		sub(h.subject, h.handler)
+	}
+
+	// 同一连接上订阅先于快照请求到达服务端，应答方生成快照之后的变更都会送达本实例
+	s := map[string][]string{}
+	if response, err := c.Request(GroupSnapshotSubject, "", nil, GroupSnapshotTimeout); err == nil {
+		if err := json.Unmarshal(response.Data, &s); err != nil {
+			log.ErrorF("%s gateway unmarshal group snapshot error : %s", name, err.Error())
+		} else {
+			log.InfoF("%s gateway restore %d groups", name, len(s))
+		}
+	} else {
+		log.DebugF("%s gateway request group snapshot : %s", name, err.Error())
+	}
+	pr.restore(s)
+
+	sub(GroupSnapshotSubject, func(msg *nats.Msg) {
+		data, err := json.Marshal(pr.snapshot())
+		if err != nil {
+			log.ErrorF("%s gateway marshal group snapshot error : %s", name, err.Error())
+			return
+		}
+		if err := c.Reply(msg.Reply, "", data); err != nil {
+			log.ErrorF("%s gateway reply group snapshot error : %s", name, err.Error())
+		}
+	})
+
+	return subscriptions
+}
+
+func parseMembership(msg *nats.Msg) (*GroupMembership, bool) {
+	m := &GroupMembership{}
+	if err := json.Unmarshal(msg.Data, m); err != nil {
+		log.ErrorF("Unmarshal data to GroupMembership error : %s", err.Error())
+		return nil, false
+	}
+	if !validSubjectToken(m.UserID) || !validSubjectToken(m.Group) {
+		log.ErrorF("Invalid group membership : %+v", m)
+		return nil, false
+	}
+	return m, true
+}
@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+)
+
+// 分组成员
+func members(pr *pushRegistry, group string) map[string]struct{} {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	m := map[string]struct{}{}
+	for userID := range pr.groups[group] {
+		m[userID] = struct{}{}
+	}
+	return m
+}
+
+func TestGroupLeavePrunesEmptyGroup(t *testing.T) {
+	pr := newPushRegistry()
+	pr.join("alice", "room")
+	pr.join("bob", "room")
+
+	pr.leave("alice", "room")
+	if _, exist := members(pr, "room")["bob"]; !exist {
+		t.Fatal("remaining member removed")
+	}
+	pr.leave("bob", "room")
+	if _, exist := pr.groups["room"]; exist {
+		t.Fatal("empty group not deleted")
+	}
+}
+
+func TestGroupRestoreKeepsConcurrentChanges(t *testing.T) {
+	pr := newPushRegistry()
+	pr.track()
+
+	// 获取快照期间 alice 离开、carol 加入，快照仍然是旧的
+	pr.leave("alice", "room")
+	pr.join("carol", "room")
+	pr.restore(map[string][]string{"room": {"alice", "bob"}})
+
+	got := members(pr, "room")
+	for userID, want := range map[string]bool{"alice": false, "bob": true, "carol": true} {
+		if _, exist := got[userID]; exist != want {
+			t.Errorf("member %s = %v , want %v", userID, exist, want)
+		}
+	}
+
+	// 快照合并后不再记录变更
+	if pr.changed != nil {
+		t.Fatal("changes still tracked after restore")
+	}
+}
+
+func TestGroupSnapshotFromExistingInstance(t *testing.T) {
+	c := newTestClient(t)
+
+	existing := newPushRegistry()
+	for _, sp := range existing.subscribe("existing", c) {
+		defer sp.Unsubscribe()
+	}
+	if err := JoinGroup(c, "alice", "room"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(members(existing, "room")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("join not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 新实例不会应答自己的快照请求
+	joined := newPushRegistry()
+	for _, sp := range joined.subscribe("joined", c) {
+		defer sp.Unsubscribe()
+	}
+	if _, exist := members(joined, "room")["alice"]; !exist {
+		t.Fatal("group snapshot not restored")
+	}
+}
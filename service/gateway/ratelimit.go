@@ -0,0 +1,400 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	redisGo "github.com/gomodule/redigo/redis"
+	"math"
+	nHttp "net/http"
+	"sherlock/client"
+	"sherlock/database/redis"
+	"sherlock/log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// 限流维度
+	RateLimitKey int
+
+	// 限流规则，每条规则独立计算令牌桶
+	RateLimitRule struct {
+		Key    RateLimitKey // 限流维度
+		Rate   float64      // 每秒补充的令牌数
+		Burst  int          // 令牌桶容量
+		Routes []string     // 生效的路由，HTTP 为 "方法 路径"（如 "POST /:module/:path"），WebSocket 及 TCP 为主题模式，为空时全部生效
+
+		// 违规升级，窗口内违规次数达到阈值时将客户端 IP 加入黑名单，阈值为 0 时不升级
+		BanThreshold int
+		BanWindow    time.Duration // 违规计数窗口，默认 DefaultRateLimitBanWindow
+		BanDuration  time.Duration // 封禁时长，0 表示永久封禁
+	}
+
+	// 限流配置
+	RateLimitConfig struct {
+		Rules []RateLimitRule
+		Redis bool // 是否使用 Redis 令牌桶，多个网关实例共享限流，使用前需先调用 redis.InitializeRedis
+	}
+
+	// 令牌桶存储
+	TokenBucket interface {
+		// 从每个令牌桶中各取一个令牌，所有桶都有令牌时才扣除
+		// 返回第一个令牌不足的桶的序号，全部取得时返回 -1
+		Take([]TokenRequest) (int, error)
+	}
+
+	// 取令牌请求
+	TokenRequest struct {
+		Key   string  // 令牌桶键
+		Rate  float64 // 每秒补充的令牌数
+		Burst int     // 容量
+	}
+
+	// 本地令牌桶
+	localBucket struct {
+		mutex     sync.Mutex
+		buckets   map[string]*bucket
+		lastSweep time.Time
+	}
+
+	bucket struct {
+		tokens float64
+		last   time.Time
+		idle   time.Duration // 补满所需时间，空闲超过该时间的桶可以清理
+	}
+
+	// Redis 令牌桶
+	redisBucket struct{}
+
+	// 违规计数
+	violation struct {
+		count  int
+		start  time.Time
+		window time.Duration // 所属规则的违规计数窗口
+	}
+
+	// 限流者
+	rateLimiter struct {
+		rules      []RateLimitRule
+		bucket     TokenBucket
+		mutex      sync.Mutex
+		violations map[string]*violation // map[规则序号:IP]违规计数
+	}
+)
+
+const (
+	RateLimitByIP    RateLimitKey = iota // 按客户端 IP
+	RateLimitByUser                      // 按用户，未认证时按客户端 IP
+	RateLimitByRoute                     // 按路由，所有客户端共享
+)
+
+const (
+	// Redis 令牌桶键前缀
+	RateLimitRedisKeyPrefix = "Sherlock:Gateway:RateLimit:"
+
+	// 本地令牌桶清理间隔
+	RateLimitSweepInterval = time.Minute
+	// 默认违规计数窗口
+	DefaultRateLimitBanWindow = time.Minute
+)
+
+var (
+	// Redis 令牌桶脚本，使用 Redis 时间，避免网关实例之间的时钟偏差
+	// KEYS[i] 键 ，ARGV[2i-1] 每秒补充的令牌数 ，ARGV[2i] 容量
+	// 所有桶都有令牌时才扣除并返回 0 ，否则返回第一个令牌不足的桶的序号（从 1 开始）
+	// 键的数量随生效的规则变化，执行时第一个参数为键的数量
+	tokenBucketScript = redisGo.NewScript(-1, `
+if redis.replicate_commands then redis.replicate_commands() end
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local states = {}
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2 * i - 1])
+	local burst = tonumber(ARGV[2 * i])
+	local state = redis.call('HMGET', key, 'tokens', 'last')
+	local tokens = tonumber(state[1])
+	local last = tonumber(state[2])
+	if tokens == nil or last == nil then
+		tokens = burst
+		last = now
+	end
+	tokens = math.min(burst, tokens + math.max(0, now - last) * rate / 1000)
+	if tokens < 1 then
+		return i
+	end
+	states[i] = tokens
+end
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2 * i - 1])
+	local burst = tonumber(ARGV[2 * i])
+	redis.call('HMSET', key, 'tokens', tostring(states[i] - 1), 'last', now)
+	redis.call('PEXPIRE', key, math.ceil(burst / rate * 1000) + 1000)
+end
+return 0
+`)
+
+	ErrTooManyRequests = errors.New("too many requests")
+)
+
+func (k RateLimitKey) String() string {
+	switch k {
+	case RateLimitByIP:
+		return "ip"
+	case RateLimitByUser:
+		return "user"
+	case RateLimitByRoute:
+		return "route"
+	default:
+		return "unknown"
+	}
+}
+
+// 新建本地令牌桶，只在当前网关实例内限流
+func NewLocalTokenBucket() TokenBucket {
+	return &localBucket{buckets: map[string]*bucket{}}
+}
+
+// 新建 Redis 令牌桶，多个网关实例共享限流
+// 使用前需先调用 redis.InitializeRedis
+func NewRedisTokenBucket() TokenBucket {
+	return &redisBucket{}
+}
+
+func (lb *localBucket) Take(requests []TokenRequest) (int, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	now := time.Now()
+	lb.sweep(now)
+
+	buckets := make([]*bucket, len(requests))
+	for i, r := range requests {
+		b, exist := lb.buckets[r.Key]
+		if !exist {
+			b = &bucket{
+				tokens: float64(r.Burst),
+				last:   now,
+				idle:   time.Duration(float64(r.Burst) / r.Rate * float64(time.Second)),
+			}
+			lb.buckets[r.Key] = b
+		}
+
+		b.tokens = math.Min(float64(r.Burst), b.tokens+now.Sub(b.last).Seconds()*r.Rate)
+		b.last = now
+		if b.tokens < 1 {
+			return i, nil
+		}
+		buckets[i] = b
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return -1, nil
+}
+
+// 清理已经补满的空闲令牌桶，按间隔执行，调用方需持有锁
+func (lb *localBucket) sweep(now time.Time) {
+	if now.Sub(lb.lastSweep) < RateLimitSweepInterval {
+		return
+	}
+	lb.lastSweep = now
+
+	for key, b := range lb.buckets {
+		if now.Sub(b.last) > b.idle {
+			delete(lb.buckets, key)
+		}
+	}
+}
+
+func (rb *redisBucket) Take(requests []TokenRequest) (int, error) {
+	if len(requests) == 0 {
+		return -1, nil
+	}
+
+	conn, err := redis.GetRedisConn()
+	if err != nil {
+		return -1, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	args := make([]interface{}, 0, len(requests)*3+1)
+	args = append(args, len(requests))
+	for _, r := range requests {
+		args = append(args, RateLimitRedisKeyPrefix+r.Key)
+	}
+	for _, r := range requests {
+		args = append(args, r.Rate, r.Burst)
+	}
+
+	denied, err := redisGo.Int(tokenBucketScript.Do(conn, args...))
+	if err != nil {
+		return -1, err
+	}
+	return denied - 1, nil
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	rl := &rateLimiter{
+		rules:      make([]RateLimitRule, 0, len(config.Rules)),
+		bucket:     NewLocalTokenBucket(),
+		violations: map[string]*violation{},
+	}
+	if config.Redis {
+		rl.bucket = NewRedisTokenBucket()
+	}
+
+	for _, rule := range config.Rules {
+		if rule.Rate <= 0 || rule.Burst <= 0 {
+			log.ErrorF("Ignore rate limit rule by %s : rate and burst must be positive", rule.Key)
+			continue
+		}
+		if rule.BanWindow <= 0 {
+			rule.BanWindow = DefaultRateLimitBanWindow
+		}
+		rl.rules = append(rl.rules, rule)
+	}
+
+	return rl
+}
+
+// 规则是否作用于路由
+func (r RateLimitRule) match(route string) bool {
+	if len(r.Routes) == 0 {
+		return true
+	}
+	for _, pattern := range r.Routes {
+		if pattern == route || client.MatchSubject(pattern, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// 限流维度对应的键
+func (r RateLimitRule) key(index int, ip, userID, route string) string {
+	value := ip
+	switch r.Key {
+	case RateLimitByUser:
+		if userID != "" {
+			value = userID
+		}
+	case RateLimitByRoute:
+		value = route
+	}
+	return fmt.Sprintf("%d:%s:%s", index, r.Key, value)
+}
+
+// 路由是否有按用户限流的规则生效
+func (rl *rateLimiter) byUser(route string) bool {
+	for _, rule := range rl.rules {
+		if rule.Key == RateLimitByUser && rule.match(route) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否放行，所有生效的规则都有令牌时放行并各扣除一个令牌，任一规则拒绝时不扣除
+// 令牌桶不可用时放行，避免存储故障导致网关不可用
+func (rl *rateLimiter) allow(c client.Client, ip, userID, route string) bool {
+	indexes := make([]int, 0, len(rl.rules))
+	requests := make([]TokenRequest, 0, len(rl.rules))
+	for i, rule := range rl.rules {
+		if !rule.match(route) {
+			continue
+		}
+		indexes = append(indexes, i)
+		requests = append(requests, TokenRequest{Key: rule.key(i, ip, userID, route), Rate: rule.Rate, Burst: rule.Burst})
+	}
+	if len(requests) == 0 {
+		return true
+	}
+
+	denied, err := rl.bucket.Take(requests)
+	if err != nil {
+		log.ErrorF("Rate limit take token error : %s", err.Error())
+		return true
+	}
+	if denied < 0 {
+		return true
+	}
+
+	index := indexes[denied]
+	rule := rl.rules[index]
+	log.DebugF("Rate limit [%s] on [%s] by %s", ip, route, rule.Key)
+	rl.violate(c, index, rule, ip)
+	return false
+}
+
+// 记录违规，达到阈值时通过黑名单添加主题封禁客户端 IP ，所有网关实例同步生效
+func (rl *rateLimiter) violate(c client.Client, index int, rule RateLimitRule, ip string) {
+	if rule.BanThreshold <= 0 || ip == "" {
+		return
+	}
+
+	rl.mutex.Lock()
+	now := time.Now()
+	key := strconv.Itoa(index) + ":" + ip
+	v, exist := rl.violations[key]
+	if !exist || now.Sub(v.start) > v.window {
+		// 顺带清理过期的违规计数，每条计数按所属规则的窗口判断
+		for k, old := range rl.violations {
+			if now.Sub(old.start) > old.window {
+				delete(rl.violations, k)
+			}
+		}
+		v = &violation{start: now, window: rule.BanWindow}
+		rl.violations[key] = v
+	}
+	v.count++
+	ban := v.count >= rule.BanThreshold
+	if ban {
+		delete(rl.violations, key)
+	}
+	rl.mutex.Unlock()
+
+	if !ban {
+		return
+	}
+
+	entry := BlackListEntry{}
+	if rule.BanDuration > 0 {
+		entry.Expire = now.Add(rule.BanDuration).Unix()
+	}
+	data, err := json.Marshal(map[string]BlackListEntry{ip: entry})
+	if err != nil {
+		log.ErrorF("Marshal black list entry error : %s", err.Error())
+		return
+	}
+	if err := c.Publish(BlackListAddSubject, "", data); err != nil {
+		log.ErrorF("Publish black list entry of [%s] error : %s", ip, err.Error())
+		return
+	}
+	log.InfoF("Rate limit ban [%s] for %s", ip, rule.BanDuration)
+}
+
+// 限流中间件，路由为 "方法 路径"，超过限制时回复 429
+// 有按用户限流的规则生效时先认证请求，认证失败时按客户端 IP 限流
+func (bg *baseGateway) RateLimitMiddleware(c client.Client) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if bg.limiter == nil {
+			return
+		}
+
+		route := context.Request.Method + " " + context.FullPath()
+		userID := ""
+		if bg.auth != nil && bg.limiter.byUser(route) {
+			if identity, err := bg.authenticate(c, context.Request); err == nil {
+				userID = identity.UserID
+				context.Set(UserIDKey, userID)
+			}
+		}
+		if !bg.limiter.allow(c, context.GetString(ClientIPKey), userID, route) {
+			writeError(context, nHttp.StatusTooManyRequests, "", "")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	nHttp "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLocalTokenBucketAllOrNothing(t *testing.T) {
+	b := NewLocalTokenBucket()
+	loose := TokenRequest{Key: "loose", Rate: 0.001, Burst: 10}
+	strict := TokenRequest{Key: "strict", Rate: 0.001, Burst: 1}
+
+	if denied, _ := b.Take([]TokenRequest{loose, strict}); denied != -1 {
+		t.Fatalf("first take denied by %d", denied)
+	}
+	// 后一条规则拒绝时，前一条规则的令牌不被扣除
+	for i := 0; i < 5; i++ {
+		if denied, _ := b.Take([]TokenRequest{loose, strict}); denied != 1 {
+			t.Fatalf("take denied by %d , want 1", denied)
+		}
+	}
+	for i := 0; i < 9; i++ {
+		if denied, _ := b.Take([]TokenRequest{loose}); denied != -1 {
+			t.Fatalf("loose bucket drained by denied requests after %d takes", i)
+		}
+	}
+}
+
+func TestRateLimitViolationWindowPerRule(t *testing.T) {
+	rl := newRateLimiter(RateLimitConfig{Rules: []RateLimitRule{
+		{Key: RateLimitByIP, Rate: 1, Burst: 1, BanThreshold: 100},
+		{Key: RateLimitByIP, Rate: 1, Burst: 1, BanThreshold: 100, BanWindow: time.Hour},
+	}})
+	if rl.rules[0].BanWindow != DefaultRateLimitBanWindow {
+		t.Fatalf("ban window = %s , want default %s", rl.rules[0].BanWindow, DefaultRateLimitBanWindow)
+	}
+
+	rl.violate(nil, 1, rl.rules[1], "192.0.2.1")
+	rl.violations["1:192.0.2.1"].start = time.Now().Add(-10 * time.Minute)
+
+	// 短窗口规则的清理不影响长窗口规则的计数
+	rl.violate(nil, 0, rl.rules[0], "192.0.2.2")
+	if v, exist := rl.violations["1:192.0.2.1"]; !exist || v.count != 1 {
+		t.Fatal("violation of the long window rule swept by the short window rule")
+	}
+}
+
+func TestRateLimitByUserOverHTTP(t *testing.T) {
+	secret := []byte("secret")
+	auth, err := NewJWTAuthenticator(JWTConfig{Algorithm: JWTAlgorithmHS256, Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0", WithAuthenticator(auth), WithRateLimit(RateLimitConfig{Rules: []RateLimitRule{
+		{Key: RateLimitByUser, Rate: 0.001, Burst: 1},
+	}})))
+
+	// 所有请求来自同一客户端 IP ，按用户分别限流
+	limited := func(token string) bool {
+		request := httptest.NewRequest(nHttp.MethodPost, "/Lobby/Buy", nil)
+		if token != "" {
+			request.Header.Set("Authorization", BearerPrefix+token)
+		}
+		recorder := httptest.NewRecorder()
+		eg.engine.ServeHTTP(recorder, request)
+		return recorder.Code == nHttp.StatusTooManyRequests
+	}
+	alice := signTestJWT(t, secret, map[string]interface{}{"sub": "alice", "exp": exp})
+	bob := signTestJWT(t, secret, map[string]interface{}{"sub": "bob", "exp": exp})
+
+	if limited(alice) || !limited(alice) {
+		t.Fatal("alice not limited after burst")
+	}
+	if limited(bob) {
+		t.Fatal("bob limited by alice")
+	}
+	// 未认证的请求按客户端 IP 限流
+	if limited("") || !limited("") {
+		t.Fatal("anonymous requests not limited by ip")
+	}
+}
@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"sherlock/client"
+	"strings"
+)
+
+type (
+	// 标准回复信封，服务通过 ReplyWithEnvelope 回复
+	// 状态码小于 400 时网关以 Data 作为 JSON 响应，否则以 ErrorResponse 响应
+	ReplyEnvelope struct {
+		Status  int             `json:"status,omitempty"`  // HTTP 状态码，0 表示 200
+		Code    string          `json:"code,omitempty"`    // 错误码，为空时按状态码生成
+		Message string          `json:"message,omitempty"` // 错误信息，会展示给调用方
+		Data    json.RawMessage `json:"data,omitempty"`    // 数据
+	}
+
+	// 错误响应
+	ErrorResponse struct {
+		Error ErrorBody `json:"error"`
+	}
+
+	ErrorBody struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+)
+
+const (
+	// 回复格式消息头，值为 envelope 时回复数据为 ReplyEnvelope
+	ReplyFormatHeader   = "Sherlock-Reply-Format"
+	ReplyFormatEnvelope = "envelope"
+
+	// JSON 响应内容类型
+	JSONContentType = "application/json; charset=utf-8"
+)
+
+var ()
+
+// 以标准回复信封回复网关转发的请求
+func ReplyWithEnvelope(c client.Client, request *nats.Msg, envelope *ReplyEnvelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	msg := &nats.Msg{
+		Subject: request.Reply,
+		Header:  nHttp.Header{},
+		Data:    data,
+	}
+	msg.Header.Set(ReplyFormatHeader, ReplyFormatEnvelope)
+
+	return c.PublishMsg(msg)
+}
+
+// 按状态码生成错误码，例如 504 为 gateway_timeout
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(nHttp.StatusText(status)), " ", "_")
+}
+
+// 写出 JSON 错误响应，code 及 message 为空时按状态码生成
+func writeError(context *gin.Context, status int, code, message string) {
+	if code == "" {
+		code = errorCode(status)
+	}
+	if message == "" {
+		message = nHttp.StatusText(status)
+	}
+
+	context.AbortWithStatusJSON(status, &ErrorResponse{Error: ErrorBody{Code: code, Message: message}})
+}
+
+// 请求错误对应的状态码
+func requestErrorStatus(err error) int {
+	switch err {
+	case nats.ErrTimeout, context.DeadlineExceeded:
+		return nHttp.StatusGatewayTimeout
+	case nats.ErrNoResponders, client.ErrCircuitOpen:
+		return nHttp.StatusServiceUnavailable
+	default:
+		return nHttp.StatusInternalServerError
+	}
+}
+
+// 将请求错误映射为状态码，错误详情只记录日志，不返回给调用方
+func writeRequestError(context *gin.Context, err error) {
+	writeError(context, requestErrorStatus(err), "", "")
+}
+
+// 写出标准回复信封
+func writeEnvelope(context *gin.Context, data []byte) {
+	envelope := &ReplyEnvelope{}
+	if err := json.Unmarshal(data, envelope); err != nil {
+		writeError(context, nHttp.StatusBadGateway, "", "")
+		return
+	}
+
+	status := envelope.Status
+	if status == 0 {
+		status = nHttp.StatusOK
+	}
+	if status < 100 || status > 999 {
+		writeError(context, nHttp.StatusBadGateway, "", "")
+		return
+	}
+
+	if status >= nHttp.StatusBadRequest {
+		writeError(context, status, envelope.Code, envelope.Message)
+		return
+	}
+	if len(envelope.Data) == 0 {
+		context.Status(status)
+		return
+	}
+	context.Data(status, JSONContentType, envelope.Data)
+}
@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"net/http/httptest"
+	"sherlock/client"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 解析错误响应
+func errorResponse(t *testing.T, recorder *httptest.ResponseRecorder) ErrorBody {
+	t.Helper()
+
+	response := &ErrorResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+		t.Fatalf("decode error response %s : %v", recorder.Body.String(), err)
+	}
+	return response.Error
+}
+
+func TestRequestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{nats.ErrTimeout, nHttp.StatusGatewayTimeout},
+		{context.DeadlineExceeded, nHttp.StatusGatewayTimeout},
+		{nats.ErrNoResponders, nHttp.StatusServiceUnavailable},
+		{client.ErrCircuitOpen, nHttp.StatusServiceUnavailable},
+		{nats.ErrConnectionClosed, nHttp.StatusInternalServerError},
+		{errors.New("internal detail"), nHttp.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		if got := requestErrorStatus(test.err); got != test.status {
+			t.Errorf("status of %v = %d , want %d", test.err, got, test.status)
+		}
+
+		// 错误详情不返回给调用方
+		recorder := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(recorder)
+		writeRequestError(ctx, test.err)
+		body := errorResponse(t, recorder)
+		if recorder.Code != test.status || body.Code != errorCode(test.status) || body.Message != nHttp.StatusText(test.status) {
+			t.Errorf("response of %v = %d %+v", test.err, recorder.Code, body)
+		}
+		if strings.Contains(recorder.Body.String(), test.err.Error()) {
+			t.Errorf("response leaks error %v : %s", test.err, recorder.Body.String())
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	writeError(ctx, nHttp.StatusTooManyRequests, "", "")
+	if body := errorResponse(t, recorder); recorder.Code != nHttp.StatusTooManyRequests || body.Code != "too_many_requests" || body.Message != "Too Many Requests" {
+		t.Fatalf("response = %d %+v", recorder.Code, body)
+	}
+	if !ctx.IsAborted() {
+		t.Fatal("context not aborted")
+	}
+
+	recorder = httptest.NewRecorder()
+	ctx, _ = gin.CreateTestContext(recorder)
+	writeError(ctx, nHttp.StatusConflict, "item_sold", "item already sold")
+	if body := errorResponse(t, recorder); body.Code != "item_sold" || body.Message != "item already sold" {
+		t.Fatalf("response = %+v", body)
+	}
+}
+
+func TestWriteEnvelope(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		status int
+		body   string
+		code   string
+	}{
+		{"data", `{"data":{"id":1}}`, nHttp.StatusOK, `{"id":1}`, ""},
+		{"created", `{"status":201,"data":{"id":1}}`, nHttp.StatusCreated, `{"id":1}`, ""},
+		{"no content", `{"status":204}`, nHttp.StatusNoContent, "", ""},
+		{"service error", `{"status":409,"code":"item_sold","message":"item already sold"}`, nHttp.StatusConflict, "", "item_sold"},
+		{"default code", `{"status":404}`, nHttp.StatusNotFound, "", "not_found"},
+		{"invalid status", `{"status":1000}`, nHttp.StatusBadGateway, "", "bad_gateway"},
+		{"invalid envelope", `not json`, nHttp.StatusBadGateway, "", "bad_gateway"},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(recorder)
+		writeEnvelope(ctx, []byte(test.data))
+		ctx.Writer.WriteHeaderNow()
+
+		if recorder.Code != test.status {
+			t.Errorf("%s : status = %d , want %d", test.name, recorder.Code, test.status)
+			continue
+		}
+		if test.code != "" {
+			if body := errorResponse(t, recorder); body.Code != test.code {
+				t.Errorf("%s : code = %s , want %s", test.name, body.Code, test.code)
+			}
+			continue
+		}
+		if recorder.Body.String() != test.body {
+			t.Errorf("%s : body = %s , want %s", test.name, recorder.Body.String(), test.body)
+		}
+	}
+}
+
+func TestReplyWithEnvelope(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0"))
+
+	if _, err := c.Subscribe("Lobby.Buy", "", func(msg *nats.Msg) {
+		_ = ReplyWithEnvelope(c, msg, &ReplyEnvelope{Status: nHttp.StatusConflict, Code: "item_sold", Message: "item already sold"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := serve(eg, nHttp.MethodPost, "/Lobby/Buy", []byte(`{}`))
+	if body := errorResponse(t, recorder); recorder.Code != nHttp.StatusConflict || body.Code != "item_sold" {
+		t.Fatalf("response = %d %+v", recorder.Code, body)
+	}
+
+	// 无响应者时回复 503 ，不展示内部错误
+	start := time.Now()
+	recorder = serve(eg, nHttp.MethodPost, "/Lobby/Sell", []byte(`{}`))
+	if recorder.Code != nHttp.StatusServiceUnavailable || strings.Contains(recorder.Body.String(), "responders") {
+		t.Fatalf("response = %d %s", recorder.Code, recorder.Body.String())
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("no responders not detected")
+	}
+}
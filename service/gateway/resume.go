@@ -0,0 +1,709 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	redisGo "github.com/gomodule/redigo/redis"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"sherlock/client"
+	"sherlock/database/redis"
+	"sherlock/log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// WebSocket 会话恢复配置
+	// 连接建立时下发会话令牌，推送消息携带会话内递增的序号并缓冲，连接断开后会话保留一段时间，
+	// 客户端携带令牌及最后收到的序号重连即可补收期间的推送
+	ResumeConfig struct {
+		BufferSize  int           // 每个会话缓冲的推送消息数，默认 128 ，不超过发送队列长度
+		GracePeriod time.Duration // 连接断开后会话的保留时间，默认 2 分钟
+		Redis       bool          // 是否使用 Redis 存储，客户端可以在其他网关实例上恢复会话，使用前需先调用 redis.InitializeRedis
+	}
+
+	// 会话信息，连接建立后以 Gateway.Resume 主题的消息下发
+	ResumeInfo struct {
+		Token   string `json:"token"`   // 会话令牌，重连时携带
+		Seq     uint64 `json:"seq"`     // 会话最后分配的序号
+		Resumed bool   `json:"resumed"` // 是否恢复了已有会话，否则为新会话
+		Missed  bool   `json:"missed"`  // 是否有消息超出缓冲无法补发
+	}
+
+	// 会话存储，连接断开后保存会话，供其他网关实例恢复
+	ResumeStore interface {
+		// 保存会话快照
+		Save(token string, record *ResumeRecord, ttl time.Duration) error
+		// 追加推送消息，只保留最近 size 条
+		Append(token string, message *ResumeMessage, size int, ttl time.Duration) error
+		// 读取会话，不存在时返回 nil
+		Load(token string) (*ResumeRecord, error)
+		// 删除会话
+		Delete(token string) error
+	}
+
+	// 会话记录
+	ResumeRecord struct {
+		UserID   string
+		Instance string // 持有会话的网关实例 ID
+		Seq      uint64
+		Messages []*ResumeMessage
+	}
+
+	// 缓冲的推送消息
+	ResumeMessage struct {
+		Seq  uint64 `json:"seq"`
+		Data []byte `json:"data"`
+	}
+
+	// Redis 存储，会话信息为哈希表，缓冲的消息为列表
+	redisResumeStore struct{}
+
+	// 会话管理者
+	resumeManager struct {
+		config     ResumeConfig
+		store      ResumeStore // 为 nil 时会话只保存在本实例内存中
+		instanceID string
+		registry   *pushRegistry
+		subject    func(string, ...string) string // 会话回复主题
+		mutex      sync.Mutex
+		sessions   map[string]*resumeSession
+		closed     bool
+
+		// 存储操作在持久化协程中按加入顺序执行，推送及连接的绑定、解绑不等待存储
+		persistMutex sync.Mutex
+		pending      []func()
+		notify       chan struct{}
+		persisted    chan struct{} // 持久化协程退出
+	}
+
+	// 可恢复的会话，代替连接登记到推送注册表，断开期间的推送写入缓冲
+	resumeSession struct {
+		token   string
+		userID  string
+		manager *resumeManager
+		mutex   sync.Mutex
+		seq     uint64
+		buffer  []*ResumeMessage
+		conn    *wsConn            // 当前连接，断开期间为 nil
+		sp      *nats.Subscription // [WS_CONN.会话令牌] 主题的订阅
+		timer   *time.Timer        // 保留期计时
+		gen     uint64             // 断开次数，保留期计时只对最近一次断开有效
+		closed  bool
+	}
+)
+
+const (
+	// 会话信息消息主题
+	ResumeSubject = "Gateway.Resume"
+	// 接管会话主题前缀 Gateway.Resume.Takeover.<instanceID> ，数据为会话令牌
+	ResumeTakeoverSubjectPrefix = "Gateway.Resume.Takeover"
+
+	// 会话令牌请求头及请求参数，浏览器无法为 WebSocket 设置请求头，可通过参数传递
+	ResumeTokenHeader   = "Sherlock-Resume-Token"
+	ResumeTokenQueryKey = "resume_token"
+	// 最后收到的序号请求头及请求参数
+	LastSeqHeader   = "Sherlock-Last-Seq"
+	LastSeqQueryKey = "last_seq"
+
+	// 会话 Redis 键前缀
+	ResumeRedisKeyPrefix = "Gateway:Resume:"
+
+	DefaultResumeBufferSize  = 128
+	DefaultResumeGracePeriod = 2 * time.Minute
+	// 接管会话的超时时间
+	ResumeTakeoverTimeout = time.Second
+
+	// 在线会话在 Redis 中的保留时间，实例异常退出时会话最多保留该时间
+	resumeOnlineTTL = 24 * time.Hour
+	// 会话令牌字节数
+	resumeTokenBytes = 16
+)
+
+var (
+	ErrSessionResumed = errors.New("session resumed by another connection")
+
+	// 替换会话快照：删除原有的会话信息及缓冲后重新写入
+	// KEYS[1] 会话信息 ，KEYS[2] 缓冲 ，ARGV[1] 过期时间（毫秒），ARGV[2..4] 用户 ID 、实例 ID 、序号 ，其余为缓冲的消息
+	resumeSaveScript = redisGo.NewScript(2, `
+redis.call('DEL', KEYS[1], KEYS[2])
+redis.call('HMSET', KEYS[1], 'user_id', ARGV[2], 'instance', ARGV[3], 'seq', ARGV[4])
+for i = 5, #ARGV do
+	redis.call('RPUSH', KEYS[2], ARGV[i])
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+redis.call('PEXPIRE', KEYS[2], ARGV[1])
+return 1
+`)
+
+	// 追加推送消息并只保留最近的消息
+	// KEYS[1] 会话信息 ，KEYS[2] 缓冲 ，ARGV[1] 过期时间（毫秒），ARGV[2] 保留条数 ，ARGV[3] 序号 ，ARGV[4] 消息
+	resumeAppendScript = redisGo.NewScript(2, `
+redis.call('HSET', KEYS[1], 'seq', ARGV[3])
+redis.call('RPUSH', KEYS[2], ARGV[4])
+redis.call('LTRIM', KEYS[2], -tonumber(ARGV[2]), -1)
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+redis.call('PEXPIRE', KEYS[2], ARGV[1])
+return 1
+`)
+)
+
+// 新建 Redis 会话存储
+// 使用前需先调用 redis.InitializeRedis
+func NewRedisResumeStore() ResumeStore {
+	return &redisResumeStore{}
+}
+
+// 接管会话的主题
+func ResumeTakeoverSubject(instanceID string) string {
+	return fmt.Sprintf("%s.%s", ResumeTakeoverSubjectPrefix, instanceID)
+}
+
+func (rs *redisResumeStore) keys(token string) (string, string) {
+	return ResumeRedisKeyPrefix + token, ResumeRedisKeyPrefix + token + ":Buffer"
+}
+
+// 以脚本执行，保证多个键的修改是原子的
+func (rs *redisResumeStore) run(script *redisGo.Script, args ...interface{}) error {
+	conn, err := redis.GetRedisConn()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	_, err = script.Do(conn, args...)
+	return err
+}
+
+func (rs *redisResumeStore) Save(token string, record *ResumeRecord, ttl time.Duration) error {
+	info, buffer := rs.keys(token)
+	args := make([]interface{}, 0, len(record.Messages)+6)
+	args = append(args, info, buffer, ttl.Milliseconds(), record.UserID, record.Instance, strconv.FormatUint(record.Seq, 10))
+	for _, message := range record.Messages {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		args = append(args, data)
+	}
+	return rs.run(resumeSaveScript, args...)
+}
+
+func (rs *redisResumeStore) Append(token string, message *ResumeMessage, size int, ttl time.Duration) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	info, buffer := rs.keys(token)
+	return rs.run(resumeAppendScript, info, buffer, ttl.Milliseconds(), size, strconv.FormatUint(message.Seq, 10), data)
+}
+
+func (rs *redisResumeStore) Load(token string) (*ResumeRecord, error) {
+	info, buffer := rs.keys(token)
+	fields, err := redis.HGetAll(info)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	record := &ResumeRecord{UserID: fields["user_id"], Instance: fields["instance"]}
+	if record.Seq, err = strconv.ParseUint(fields["seq"], 10, 64); err != nil {
+		return nil, err
+	}
+
+	values, err := redis.LRange(buffer, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	record.Messages = make([]*ResumeMessage, 0, len(values))
+	for _, value := range values {
+		message := &ResumeMessage{}
+		if err := json.Unmarshal([]byte(value), message); err != nil {
+			return nil, err
+		}
+		record.Messages = append(record.Messages, message)
+	}
+	return record, nil
+}
+
+func (rs *redisResumeStore) Delete(token string) error {
+	info, buffer := rs.keys(token)
+	_, err := redis.Del(info, buffer)
+	return err
+}
+
+// 新建会话令牌
+func newResumeToken() (string, error) {
+	b := make([]byte, resumeTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// 会话令牌必须是网关生成的格式，同时用作主题片段
+func validResumeToken(token string) bool {
+	if len(token) != resumeTokenBytes*2 {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+// 读取重连时携带的会话令牌及最后收到的序号，请求头优先
+func resumeParams(context *gin.Context) (string, uint64) {
+	token := context.GetHeader(ResumeTokenHeader)
+	if token == "" {
+		token = context.Query(ResumeTokenQueryKey)
+	}
+
+	last := context.GetHeader(LastSeqHeader)
+	if last == "" {
+		last = context.Query(LastSeqQueryKey)
+	}
+	seq, err := strconv.ParseUint(last, 10, 64)
+	if err != nil {
+		seq = 0
+	}
+	return token, seq
+}
+
+func newResumeManager(config ResumeConfig, instanceID string, registry *pushRegistry, subject func(string, ...string) string, queueSize int) *resumeManager {
+	if config.BufferSize <= 0 {
+		config.BufferSize = DefaultResumeBufferSize
+	}
+	// 补发的消息及会话信息必须能一次放入发送队列
+	if config.BufferSize >= queueSize {
+		config.BufferSize = queueSize - 1
+	}
+	if config.GracePeriod <= 0 {
+		config.GracePeriod = DefaultResumeGracePeriod
+	}
+
+	rm := &resumeManager{
+		config:     config,
+		instanceID: instanceID,
+		registry:   registry,
+		subject:    subject,
+		sessions:   map[string]*resumeSession{},
+	}
+	if config.Redis {
+		rm.useStore(NewRedisResumeStore())
+	}
+	return rm
+}
+
+// 使用存储并启动持久化协程
+func (rm *resumeManager) useStore(store ResumeStore) {
+	rm.store = store
+	rm.notify = make(chan struct{}, 1)
+	rm.persisted = make(chan struct{})
+	go rm.persistLoop(rm.notify)
+}
+
+// 加入存储操作，持久化协程已退出时直接执行
+func (rm *resumeManager) enqueue(op func()) {
+	rm.persistMutex.Lock()
+	if rm.notify == nil {
+		rm.persistMutex.Unlock()
+		op()
+		return
+	}
+	defer rm.persistMutex.Unlock()
+
+	rm.pending = append(rm.pending, op)
+	select {
+	case rm.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 等待已加入的存储操作全部执行完毕
+func (rm *resumeManager) flush() {
+	done := make(chan struct{})
+	rm.enqueue(func() { close(done) })
+	<-done
+}
+
+// 持久化协程，notify 关闭后执行完剩余操作再退出
+func (rm *resumeManager) persistLoop(notify chan struct{}) {
+	defer close(rm.persisted)
+
+	for {
+		_, open := <-notify
+
+		rm.persistMutex.Lock()
+		ops := rm.pending
+		rm.pending = nil
+		rm.persistMutex.Unlock()
+
+		for _, op := range ops {
+			op()
+		}
+		if !open {
+			return
+		}
+	}
+}
+
+// 停止持久化协程，等待剩余操作执行完毕
+func (rm *resumeManager) stopPersist() {
+	rm.persistMutex.Lock()
+	notify := rm.notify
+	rm.notify = nil
+	rm.persistMutex.Unlock()
+
+	if notify != nil {
+		close(notify)
+		<-rm.persisted
+	}
+}
+
+// 使用 Redis 存储时订阅本实例的接管主题，其他实例恢复会话前通知本实例释放会话
+func (rm *resumeManager) subscribe(name string, c client.Client) []*nats.Subscription {
+	if rm.store == nil {
+		return nil
+	}
+
+	sp, err := c.Subscribe(ResumeTakeoverSubject(rm.instanceID), "", func(msg *nats.Msg) {
+		rm.takeover(string(msg.Data))
+		if err := c.Reply(msg.Reply, "", msg.Data); err != nil {
+			log.ErrorF("%s gateway reply session takeover error : %s", name, err.Error())
+		}
+	})
+	if err != nil {
+		log.ErrorF("%s gateway subscribe [%s] error : %s", name, ResumeTakeoverSubject(rm.instanceID), err.Error())
+		return nil
+	}
+	log.DebugF("%s gateway subscribe [%s] success", name, sp.Subject)
+	return []*nats.Subscription{sp}
+}
+
+// 打开会话并绑定连接
+// 令牌有效且属于同一用户时恢复会话，补发序号大于 lastSeq 的消息，否则新建会话
+func (rm *resumeManager) open(c client.Client, wc *wsConn, token string, lastSeq uint64) (*resumeSession, error) {
+	if validResumeToken(token) {
+		if s := rm.local(token, wc.userID); s != nil && s.attach(wc, lastSeq, true) {
+			return s, nil
+		}
+		if record := rm.load(c, token, wc.userID); record != nil {
+			// 令牌已被其他用户的会话占用时新建会话
+			s, err := rm.create(c, token, wc.userID, record)
+			if err != nil && err != ErrUnauthorized {
+				return nil, err
+			}
+			if err == nil && s.attach(wc, lastSeq, true) {
+				return s, nil
+			}
+		}
+		log.DebugF("WebSocket connection [%s] session [%s] not found , create a new one", wc.clientIP, token)
+	}
+
+	token, err := newResumeToken()
+	if err != nil {
+		return nil, err
+	}
+	s, err := rm.create(c, token, wc.userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.attach(wc, 0, false)
+	return s, nil
+}
+
+// 本实例上的会话
+func (rm *resumeManager) local(token, userID string) *resumeSession {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	s, exist := rm.sessions[token]
+	if !exist || s.userID != userID {
+		return nil
+	}
+	return s
+}
+
+// 从存储中读取会话，会话由其他实例持有时先通知其释放并保存最新的快照
+func (rm *resumeManager) load(c client.Client, token, userID string) *ResumeRecord {
+	if rm.store == nil {
+		return nil
+	}
+
+	record, err := rm.store.Load(token)
+	if err != nil {
+		log.ErrorF("Load session [%s] error : %s", token, err.Error())
+		return nil
+	}
+	if record == nil || record.UserID != userID {
+		return nil
+	}
+	if record.Instance == "" || record.Instance == rm.instanceID {
+		return record
+	}
+
+	// 原实例已退出时直接使用已保存的快照
+	if _, err := c.Request(ResumeTakeoverSubject(record.Instance), "", []byte(token), ResumeTakeoverTimeout); err != nil {
+		log.DebugF("Take over session [%s] from [%s] : %s", token, record.Instance, err.Error())
+		return record
+	}
+	latest, err := rm.store.Load(token)
+	if err != nil {
+		log.ErrorF("Load session [%s] error : %s", token, err.Error())
+		return record
+	}
+	if latest == nil {
+		return record
+	}
+	return latest
+}
+
+// 新建会话，订阅会话回复主题并登记到推送注册表
+// 检查、订阅及登记在同一把锁内完成，同一令牌的并发重连只会创建一个会话，后到者取得已创建的会话
+func (rm *resumeManager) create(c client.Client, token, userID string, record *ResumeRecord) (*resumeSession, error) {
+	rm.mutex.Lock()
+	if rm.closed {
+		rm.mutex.Unlock()
+		return nil, ErrGatewayClosed
+	}
+	if s, exist := rm.sessions[token]; exist {
+		rm.mutex.Unlock()
+		if s.userID != userID {
+			return nil, ErrUnauthorized
+		}
+		return s, nil
+	}
+
+	s := &resumeSession{token: token, userID: userID, manager: rm}
+	if record != nil {
+		s.seq, s.buffer = record.Seq, record.Messages
+	}
+	sp, err := c.Subscribe(rm.subject(token), "", func(msg *nats.Msg) {
+		if err := s.push(msg.Data); err != nil {
+			log.ErrorF("Push message to session [%s] error : %s", token, err.Error())
+		}
+	})
+	if err != nil {
+		rm.mutex.Unlock()
+		return nil, err
+	}
+	s.sp = sp
+	rm.sessions[token] = s
+	rm.mutex.Unlock()
+
+	rm.registry.add(userID, s)
+	return s, nil
+}
+
+// 保留期结束后删除会话
+func (rm *resumeManager) expire(s *resumeSession, gen uint64) {
+	rm.mutex.Lock()
+	s.mutex.Lock()
+	if s.closed || s.conn != nil || s.gen != gen {
+		s.mutex.Unlock()
+		rm.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	delete(rm.sessions, s.token)
+	s.mutex.Unlock()
+	rm.mutex.Unlock()
+
+	log.DebugF("Session [%s] expired", s.token)
+	rm.release(s, true)
+}
+
+// 其他实例恢复会话时释放本实例持有的会话，仍然绑定的连接一并关闭
+func (rm *resumeManager) takeover(token string) {
+	rm.mutex.Lock()
+	s, exist := rm.sessions[token]
+	delete(rm.sessions, token)
+	rm.mutex.Unlock()
+	if !exist {
+		return
+	}
+
+	if conn := s.close(); conn != nil {
+		conn.closeAsync(websocket.CloseGoingAway, ErrSessionResumed.Error())
+	}
+	log.DebugF("Session [%s] taken over by another instance", token)
+	rm.release(s, false)
+	// 接管方随后读取存储，回复前确保快照已经写入
+	rm.flush()
+}
+
+// 注销会话并取消订阅，remove 为 true 时同时删除存储中的会话
+func (rm *resumeManager) release(s *resumeSession, remove bool) {
+	rm.registry.remove(s.userID, s)
+	if err := s.sp.Unsubscribe(); err != nil {
+		log.ErrorF("Session [%s] unsubscribe error : %s", s.token, err.Error())
+	}
+	if remove && rm.store != nil {
+		// 与快照的保存同样经过持久化队列，保证删除在之前的保存之后执行
+		rm.enqueue(func() {
+			if err := rm.store.Delete(s.token); err != nil {
+				log.ErrorF("Delete session [%s] error : %s", s.token, err.Error())
+			}
+		})
+	}
+}
+
+// 关闭所有会话，使用 Redis 存储时保存快照，客户端可以在其他实例上恢复
+func (rm *resumeManager) close() {
+	rm.mutex.Lock()
+	rm.closed = true
+	sessions := make([]*resumeSession, 0, len(rm.sessions))
+	for _, s := range rm.sessions {
+		sessions = append(sessions, s)
+	}
+	rm.sessions = map[string]*resumeSession{}
+	rm.mutex.Unlock()
+
+	for _, s := range sessions {
+		s.close()
+		rm.release(s, false)
+	}
+	// 退出前写完所有快照
+	rm.stopPersist()
+}
+
+// 推送数据，分配序号并写入缓冲，断开期间同时追加到存储
+func (s *resumeSession) push(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return ErrConnClosed
+	}
+
+	s.seq++
+	message := &ResumeMessage{Seq: s.seq, Data: data}
+	s.buffer = append(s.buffer, message)
+	if over := len(s.buffer) - s.manager.config.BufferSize; over > 0 {
+		s.buffer = s.buffer[over:]
+	}
+
+	if s.conn != nil {
+		return s.conn.pushMessage(&Message{Data: data, Seq: message.Seq})
+	}
+	if rm := s.manager; rm.store != nil {
+		rm.enqueue(func() {
+			if err := rm.store.Append(s.token, message, rm.config.BufferSize, rm.config.GracePeriod); err != nil {
+				log.ErrorF("Append message to session [%s] error : %s", s.token, err.Error())
+			}
+		})
+	}
+	return nil
+}
+
+// 绑定连接，先下发会话信息再补发序号大于 lastSeq 的消息，会话已关闭时返回 false
+// 会话仍然绑定着旧连接时（客户端已断开但网关尚未察觉）关闭旧连接
+func (s *resumeSession) attach(wc *wsConn, lastSeq uint64, resumed bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	// 持有会话锁，不能阻塞在旧连接的写入上
+	if s.conn != nil {
+		s.conn.closeAsync(websocket.CloseGoingAway, ErrSessionResumed.Error())
+	}
+	s.conn = wc
+	s.save(resumeOnlineTTL)
+
+	// 缓冲中最早的序号
+	first := s.seq - uint64(len(s.buffer)) + 1
+	info := &ResumeInfo{
+		Token:   s.token,
+		Seq:     s.seq,
+		Resumed: resumed,
+		Missed:  resumed && lastSeq+1 < first,
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		log.ErrorF("Marshal session [%s] info error : %s", s.token, err.Error())
+		return true
+	}
+	if err := wc.pushMessage(&Message{Subject: ResumeSubject, Data: data}); err != nil {
+		log.ErrorF("Write message to [%s] error : %s", wc.clientIP, err.Error())
+		return true
+	}
+
+	for _, message := range s.buffer {
+		if message.Seq <= lastSeq {
+			continue
+		}
+		if err := wc.pushMessage(&Message{Data: message.Data, Seq: message.Seq}); err != nil {
+			log.ErrorF("Write message to [%s] error : %s", wc.clientIP, err.Error())
+			break
+		}
+	}
+	return true
+}
+
+// 解绑连接并开始保留期计时，连接已被新连接替换时不处理
+func (s *resumeSession) detach(wc *wsConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || s.conn != wc {
+		return
+	}
+	s.conn = nil
+	s.gen++
+	s.save(s.manager.config.GracePeriod)
+
+	gen := s.gen
+	s.timer = time.AfterFunc(s.manager.config.GracePeriod, func() {
+		s.manager.expire(s, gen)
+	})
+}
+
+// 关闭会话并保存快照，返回仍然绑定的连接
+func (s *resumeSession) close() *wsConn {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	conn := s.conn
+	s.conn = nil
+	s.save(s.manager.config.GracePeriod)
+	return conn
+}
+
+// 保存会话快照，调用方需持有锁，快照在锁内复制，写入由持久化协程完成
+func (s *resumeSession) save(ttl time.Duration) {
+	rm := s.manager
+	if rm.store == nil {
+		return
+	}
+
+	record := &ResumeRecord{
+		UserID:   s.userID,
+		Instance: rm.instanceID,
+		Seq:      s.seq,
+		Messages: append([]*ResumeMessage(nil), s.buffer...),
+	}
+	rm.enqueue(func() {
+		if err := rm.store.Save(s.token, record, ttl); err != nil {
+			log.ErrorF("Save session [%s] error : %s", s.token, err.Error())
+		}
+	})
+}
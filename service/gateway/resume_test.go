@@ -0,0 +1,179 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 读取一条消息，超时失败
+func readMessage(t *testing.T, conn *websocket.Conn) *Message {
+	t.Helper()
+
+	data := readTest(t, conn, 2*time.Second)
+	if data == nil {
+		t.Fatal("no message received")
+	}
+	message := &Message{}
+	if err := json.Unmarshal(data, message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestResumeReplaysMissedPushes(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewWebSocketGateway("127.0.0.1:0", WithResume(ResumeConfig{})))
+	url := newTestServer(t, eg)
+
+	conn := dialTest(t, url)
+	message := readMessage(t, conn)
+	info := &ResumeInfo{}
+	if err := json.Unmarshal(message.Data, info); err != nil || message.Subject != ResumeSubject || info.Resumed {
+		t.Fatalf("first message = %+v", message)
+	}
+	if err := c.Publish(BroadcastPushSubject, "", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMessage(t, conn); string(got.Data) != "1" || got.Seq != 1 {
+		t.Fatalf("push = %+v", got)
+	}
+	conn.Close()
+
+	// 等待网关察觉断开后推送
+	time.Sleep(100 * time.Millisecond)
+	if err := c.Publish(BroadcastPushSubject, "", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	conn = dialTest(t, fmt.Sprintf("%s?%s=%s&%s=1", url, ResumeTokenQueryKey, info.Token, LastSeqQueryKey))
+	message = readMessage(t, conn)
+	resumed := &ResumeInfo{}
+	if err := json.Unmarshal(message.Data, resumed); err != nil || !resumed.Resumed || resumed.Token != info.Token {
+		t.Fatalf("resume info = %s", message.Data)
+	}
+	if got := readMessage(t, conn); string(got.Data) != "2" || got.Seq != 2 {
+		t.Fatalf("replayed push = %+v", got)
+	}
+}
+
+func TestResumeConcurrentCreate(t *testing.T) {
+	c := newTestClient(t)
+	rm := newResumeManager(ResumeConfig{}, "test", newPushRegistry(), func(token string, _ ...string) string {
+		return "Test.Session." + token
+	}, 16)
+	token, err := newResumeToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一令牌的并发重连只创建一个会话
+	sessions := make([]*resumeSession, 8)
+	wg := sync.WaitGroup{}
+	for i := range sessions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := rm.create(c, token, "alice", &ResumeRecord{UserID: "alice"})
+			if err != nil {
+				t.Error(err)
+			}
+			sessions[i] = s
+		}(i)
+	}
+	wg.Wait()
+
+	for _, s := range sessions {
+		if s != sessions[0] {
+			t.Fatal("concurrent reconnects created different sessions")
+		}
+	}
+	if n := len(rm.registry.all); n != 1 {
+		t.Fatalf("%d sessions registered , want 1", n)
+	}
+
+	// 其他用户不能取得该会话
+	if _, err := rm.create(c, token, "bob", nil); err != ErrUnauthorized {
+		t.Fatalf("error = %v , want %v", err, ErrUnauthorized)
+	}
+	rm.close()
+}
+
+func TestNewResumeToken(t *testing.T) {
+	token, err := newResumeToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validResumeToken(token) || !validSubjectToken(token) {
+		t.Fatalf("invalid token %q", token)
+	}
+}
+
+// 记录操作顺序的存储，release 关闭前所有操作阻塞，模拟缓慢的 Redis
+type slowResumeStore struct {
+	release chan struct{}
+	mutex   sync.Mutex
+	ops     []string
+}
+
+func (ss *slowResumeStore) record(op string) error {
+	<-ss.release
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.ops = append(ss.ops, op)
+	return nil
+}
+
+func (ss *slowResumeStore) Save(_ string, record *ResumeRecord, _ time.Duration) error {
+	return ss.record(fmt.Sprintf("save %d", record.Seq))
+}
+
+func (ss *slowResumeStore) Append(_ string, message *ResumeMessage, _ int, _ time.Duration) error {
+	return ss.record(fmt.Sprintf("append %d", message.Seq))
+}
+
+func (ss *slowResumeStore) Load(string) (*ResumeRecord, error) { return nil, nil }
+
+func (ss *slowResumeStore) Delete(string) error { return ss.record("delete") }
+
+func TestResumePersistsOffThePushPath(t *testing.T) {
+	c := newTestClient(t)
+	rm := newResumeManager(ResumeConfig{}, "test", newPushRegistry(), func(token string, _ ...string) string {
+		return "Test.Session." + token
+	}, 16)
+	store := &slowResumeStore{release: make(chan struct{})}
+	rm.useStore(store)
+
+	token, err := newResumeToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := rm.create(c, token, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 存储阻塞时，断开期间的推送不等待存储
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := s.push([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("push blocked on the store for %s", elapsed)
+	}
+
+	// 关闭时等待剩余操作按顺序写入
+	close(store.release)
+	rm.close()
+	want := []string{"append 1", "append 2", "append 3", "save 3"}
+	if fmt.Sprint(store.ops) != fmt.Sprint(want) {
+		t.Fatalf("store ops = %v , want %v", store.ops, want)
+	}
+}
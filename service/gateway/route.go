@@ -0,0 +1,189 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"regexp"
+	"sherlock/client"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// HTTP 路由
+	// 例如 {Method: "GET", Path: "/users/:id", Subject: "User.{id}.Get"}
+	Route struct {
+		Method      string        // HTTP 方法
+		Path        string        // 路径，支持 :param 及 *param 参数
+		Subject     string        // NATS 主题，{param} 占位替换为路径参数，参数中的 / 替换为 .
+		Timeout     time.Duration // 请求超时时间，0 表示使用默认超时时间
+		Headers     []string      // 注入到请求信封中的请求头
+		ContentType string        // 服务未指定时的响应内容类型，为空时为 text/plain
+		MaxBodySize int64         // 最大请求体字节数，0 表示使用网关的限制
+		Accepts     []string      // 允许的请求内容类型，支持 type/* ，为空时不限制
+	}
+
+	// 路由请求信封，路由表中的路由以该信封的 JSON 编码作为请求数据
+	HTTPRequest struct {
+		Method  string              `json:"method"`
+		Path    string              `json:"path"`
+		Params  map[string]string   `json:"params"`
+		Query   map[string][]string `json:"query"`
+		Headers map[string]string   `json:"headers"`
+		Body    []byte              `json:"body"`
+	}
+
+	// HTTP 回复，服务通过 ReplyHTTP 回复时转换为回复消息头
+	HTTPResponse struct {
+		Status      int               // 状态码，0 表示 200
+		ContentType string            // 内容类型
+		Headers     map[string]string // 响应头
+		Body        []byte            // 响应数据
+	}
+)
+
+const (
+	// 回复消息头，网关据此设置 HTTP 状态码、内容类型及响应头
+	ReplyStatusHeader      = "Sherlock-Status"
+	ReplyContentTypeHeader = "Sherlock-Content-Type"
+	ReplyHeaderPrefix      = "Sherlock-Http-" // Sherlock-Http-<响应头>
+
+	// 默认响应内容类型
+	DefaultContentType = "text/plain; charset=utf-8"
+)
+
+var (
+	// 主题中的参数占位
+	subjectParamPattern = regexp.MustCompile(`\{([^{}]+)\}`)
+
+	ErrInvalidRouteParam = errors.New("invalid route param")
+)
+
+// 校验路由，主题中的占位必须是路径中的参数
+func (r Route) validate() error {
+	if r.Method == "" || r.Path == "" || r.Subject == "" {
+		return fmt.Errorf("route [%s %s] requires method , path and subject", r.Method, r.Path)
+	}
+
+	for _, match := range subjectParamPattern.FindAllStringSubmatch(r.Subject, -1) {
+		if !strings.Contains(r.Path, ":"+match[1]) && !strings.Contains(r.Path, "*"+match[1]) {
+			return fmt.Errorf("route [%s %s] subject param [%s] not found in path", r.Method, r.Path, match[1])
+		}
+	}
+	return nil
+}
+
+// 根据路径参数生成主题
+func (r Route) subject(params gin.Params) (string, error) {
+	var err error
+	subject := subjectParamPattern.ReplaceAllStringFunc(r.Subject, func(placeholder string) string {
+		value, _ := params.Get(placeholder[1 : len(placeholder)-1])
+		tokens := strings.Split(strings.Trim(value, "/"), "/")
+		for _, token := range tokens {
+			if !validSubjectToken(token) {
+				err = ErrInvalidRouteParam
+			}
+		}
+		return strings.Join(tokens, client.SubjectSeparator)
+	})
+	return subject, err
+}
+
+// 请求超时时间
+func (r Route) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return DefaultHTTPRequestTimeout
+}
+
+// 构建请求信封
+func newHTTPRequest(context *gin.Context, route Route, body []byte) *HTTPRequest {
+	request := &HTTPRequest{
+		Method:  context.Request.Method,
+		Path:    context.Request.URL.Path,
+		Params:  make(map[string]string, len(context.Params)),
+		Query:   context.Request.URL.Query(),
+		Headers: make(map[string]string, len(route.Headers)),
+		Body:    body,
+	}
+
+	for _, param := range context.Params {
+		request.Params[param.Key] = param.Value
+	}
+	for _, header := range route.Headers {
+		if value := context.GetHeader(header); value != "" {
+			request.Headers[header] = value
+		}
+	}
+
+	return request
+}
+
+// 将回复写为 HTTP 响应，回复消息头指定状态码、内容类型及响应头
+// 回复为标准回复信封时按信封写出
+func writeReply(context *gin.Context, contentType string, response *nats.Msg) {
+	status := nHttp.StatusOK
+	if contentType == "" {
+		contentType = DefaultContentType
+	}
+	envelope := false
+
+	for key, values := range response.Header {
+		switch {
+		case key == ReplyFormatHeader:
+			envelope = values[0] == ReplyFormatEnvelope
+		case key == ReplyStatusHeader:
+			if s, err := strconv.Atoi(values[0]); err == nil && s >= 100 && s <= 999 {
+				status = s
+			}
+		case key == ReplyContentTypeHeader:
+			contentType = values[0]
+		case strings.HasPrefix(key, ReplyHeaderPrefix):
+			for _, value := range values {
+				context.Writer.Header().Add(key[len(ReplyHeaderPrefix):], value)
+			}
+		}
+	}
+
+	if envelope {
+		writeEnvelope(context, response.Data)
+		return
+	}
+	context.Data(status, contentType, response.Data)
+}
+
+// 解析路由请求信封
+func ParseHTTPRequest(msg *nats.Msg) (*HTTPRequest, error) {
+	request := &HTTPRequest{}
+	if err := json.Unmarshal(msg.Data, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// 以 HTTP 回复的形式回复网关转发的请求
+func ReplyHTTP(c client.Client, request *nats.Msg, response *HTTPResponse) error {
+	msg := &nats.Msg{
+		Subject: request.Reply,
+		Header:  nHttp.Header{},
+		Data:    response.Body,
+	}
+
+	if response.Status != 0 {
+		msg.Header.Set(ReplyStatusHeader, strconv.Itoa(response.Status))
+	}
+	if response.ContentType != "" {
+		msg.Header.Set(ReplyContentTypeHeader, response.ContentType)
+	}
+	for key, value := range response.Headers {
+		msg.Header.Set(ReplyHeaderPrefix+key, value)
+	}
+
+	return c.PublishMsg(msg)
+}
@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"testing"
+)
+
+func TestRouteSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		params  gin.Params
+		want    string
+		err     error
+	}{
+		{"User.{id}.Get", gin.Params{{Key: "id", Value: "42"}}, "User.42.Get", nil},
+		{"User.{id}.Item.{item}", gin.Params{{Key: "id", Value: "42"}, {Key: "item", Value: "7"}}, "User.42.Item.7", nil},
+		// *param 中的 / 替换为 . ，首尾的 / 去除
+		{"File.{path}", gin.Params{{Key: "path", Value: "/a/b/c"}}, "File.a.b.c", nil},
+		{"File.{path}", gin.Params{{Key: "path", Value: "/a/b/"}}, "File.a.b", nil},
+		{"Static", nil, "Static", nil},
+		// 参数不能拼出通配符或额外的主题片段
+		{"User.{id}.Get", gin.Params{{Key: "id", Value: "*"}}, "", ErrInvalidRouteParam},
+		{"User.{id}.Get", gin.Params{{Key: "id", Value: ">"}}, "", ErrInvalidRouteParam},
+		{"User.{id}.Get", gin.Params{{Key: "id", Value: "a.b"}}, "", ErrInvalidRouteParam},
+		{"User.{id}.Get", gin.Params{{Key: "id", Value: "a b"}}, "", ErrInvalidRouteParam},
+		{"User.{id}.Get", gin.Params{{Key: "id", Value: ""}}, "", ErrInvalidRouteParam},
+		{"File.{path}", gin.Params{{Key: "path", Value: "/a//b"}}, "", ErrInvalidRouteParam},
+	}
+
+	for _, test := range tests {
+		got, err := Route{Subject: test.subject}.subject(test.params)
+		if err != test.err {
+			t.Errorf("subject %s with %v error = %v , want %v", test.subject, test.params, err, test.err)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("subject %s with %v = %s , want %s", test.subject, test.params, got, test.want)
+		}
+	}
+}
+
+func TestRouteValidate(t *testing.T) {
+	tests := []struct {
+		route Route
+		valid bool
+	}{
+		{Route{Method: "GET", Path: "/users/:id", Subject: "User.{id}.Get"}, true},
+		{Route{Method: "GET", Path: "/files/*path", Subject: "File.{path}"}, true},
+		{Route{Method: "GET", Path: "/users/:id", Subject: "User.{name}.Get"}, false},
+		{Route{Method: "GET", Path: "/users/:id"}, false},
+		{Route{Path: "/users/:id", Subject: "User.{id}.Get"}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.route.validate(); (err == nil) != test.valid {
+			t.Errorf("validate %+v error = %v , want valid %v", test.route, err, test.valid)
+		}
+	}
+}
+
+func TestRouteRequest(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0", WithRoutes(Route{
+		Method: nHttp.MethodGet, Path: "/users/:id", Subject: "User.{id}.Get", ContentType: "application/json",
+	})))
+
+	if _, err := c.Subscribe("User.*.Get", "", func(msg *nats.Msg) {
+		request, err := ParseHTTPRequest(msg)
+		if err != nil || request.Params["id"] != "42" || len(request.Query["fields"]) != 1 || request.Query["fields"][0] != "name" {
+			_ = ReplyHTTP(c, msg, &HTTPResponse{Status: nHttp.StatusBadRequest})
+			return
+		}
+		_ = ReplyHTTP(c, msg, &HTTPResponse{Status: nHttp.StatusCreated, Headers: map[string]string{"X-User": "42"}, Body: []byte(`{"id":42}`)})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := serve(eg, nHttp.MethodGet, "/users/42?fields=name", nil)
+	if recorder.Code != nHttp.StatusCreated || recorder.Body.String() != `{"id":42}` {
+		t.Fatalf("response = %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get("X-User") != "42" || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("response header = %v", recorder.Header())
+	}
+
+	// 非法参数不会转发
+	if recorder := serve(eg, nHttp.MethodGet, "/users/*", nil); recorder.Code != nHttp.StatusBadRequest {
+		t.Fatalf("invalid param status = %d , want %d", recorder.Code, nHttp.StatusBadRequest)
+	}
+}
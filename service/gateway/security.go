@@ -0,0 +1,219 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"net/url"
+	"sherlock/client"
+	"sherlock/log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// 安全配置，可通过 Gateway.Security.Update 主题热更新（全量替换，未指定的字段使用默认值）
+	SecurityConfig struct {
+		AllowOrigins     []string `json:"allow_origins"`     // CORS 允许的来源，支持 * 及 https://*.example.com ，为空时不开启 CORS
+		AllowMethods     []string `json:"allow_methods"`     // CORS 允许的方法
+		AllowHeaders     []string `json:"allow_headers"`     // CORS 允许的请求头，为空时允许预检请求中的所有请求头
+		ExposeHeaders    []string `json:"expose_headers"`    // CORS 暴露的响应头
+		AllowCredentials bool     `json:"allow_credentials"` // CORS 是否允许携带凭证
+		MaxAge           int      `json:"max_age"`           // 预检结果缓存时间（秒）
+
+		// WebSocket 升级允许的来源，支持 * 及 https://*.example.com
+		// 为空时只允许同源及未携带 Origin 的非浏览器客户端
+		WebSocketOrigins []string `json:"websocket_origins"`
+
+		// 安全响应头，值为空表示不设置该响应头
+		// Strict-Transport-Security 只在 TLS 连接上设置
+		Headers map[string]string `json:"headers"`
+	}
+
+	// 可热更新的安全配置
+	security struct {
+		mutex  sync.RWMutex
+		config SecurityConfig
+	}
+)
+
+const (
+	// 安全配置更新主题，数据为 SecurityConfig
+	SecurityUpdateSubject = "Gateway.Security.Update"
+
+	HeaderOrigin = "Origin"
+	HeaderHSTS   = "Strict-Transport-Security"
+
+	// 标记 CORS 预检请求，由 PreflightMiddleware 回复
+	PreflightKey = "Sherlock-Preflight"
+)
+
+var (
+	ErrCORSWildcardCredentials = errors.New("cors allow origin * can not be used with allow credentials")
+)
+
+// 默认安全配置
+func DefaultSecurityConfig() SecurityConfig {
+	return SecurityConfig{
+		AllowOrigins: []string{},
+		AllowMethods: []string{nHttp.MethodGet, nHttp.MethodPost, nHttp.MethodPut, nHttp.MethodPatch, nHttp.MethodDelete},
+		AllowHeaders: []string{},
+		MaxAge:       600,
+		Headers: map[string]string{
+			"X-Content-Type-Options": "nosniff",
+			"X-Frame-Options":        "DENY",
+			"Referrer-Policy":        "no-referrer",
+			HeaderHSTS:               "max-age=31536000",
+		},
+	}
+}
+
+// 校验配置，允许任意来源时不能携带凭证，否则任何站点都可以读取带凭证的跨域响应
+func (config SecurityConfig) validate() error {
+	if config.AllowCredentials && matchOrigin(config.AllowOrigins, "*") {
+		return ErrCORSWildcardCredentials
+	}
+	return nil
+}
+
+func newSecurity(config SecurityConfig) *security {
+	return &security{config: config}
+}
+
+func (s *security) get() SecurityConfig {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.config
+}
+
+func (s *security) OnlineUpdate(order *nats.Msg) {
+	config := DefaultSecurityConfig()
+	if err := json.Unmarshal(order.Data, &config); err != nil {
+		log.ErrorF("Unmarshal data to SecurityConfig error : %s", err.Error())
+		return
+	}
+	if err := config.validate(); err != nil {
+		log.ErrorF("Reject security config update : %s", err.Error())
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.config = config
+	log.InfoF("Security config after update : %+v", config)
+}
+
+// 来源是否匹配
+func matchOrigin(patterns []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		// https://*.example.com 匹配 https://a.example.com
+		if i := strings.Index(pattern, "://*."); i >= 0 {
+			if strings.HasPrefix(origin, pattern[:i+3]) && strings.HasSuffix(origin, pattern[i+4:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocket 升级来源检查
+func (s *security) checkOrigin(r *nHttp.Request) bool {
+	origin := r.Header.Get(HeaderOrigin)
+	if origin == "" {
+		return true
+	}
+
+	config := s.get()
+	if len(config.WebSocketOrigins) > 0 {
+		return matchOrigin(config.WebSocketOrigins, origin)
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// 安全中间件，设置安全响应头及 CORS 响应头
+// 预检请求只做标记，经过黑名单及限流检查后由 PreflightMiddleware 回复
+func (bg *baseGateway) SecurityMiddleware(context *gin.Context) {
+	config := bg.security.get()
+
+	header := context.Writer.Header()
+	for key, value := range config.Headers {
+		if value == "" || (key == HeaderHSTS && context.Request.TLS == nil) {
+			continue
+		}
+		header.Set(key, value)
+	}
+
+	origin := context.GetHeader(HeaderOrigin)
+	if origin == "" || len(config.AllowOrigins) == 0 {
+		return
+	}
+
+	preflight := context.Request.Method == nHttp.MethodOptions && context.GetHeader("Access-Control-Request-Method") != ""
+	header.Add("Vary", HeaderOrigin)
+	if !matchOrigin(config.AllowOrigins, origin) {
+		if preflight {
+			context.AbortWithStatus(nHttp.StatusForbidden)
+		}
+		return
+	}
+
+	// 配置校验保证允许任意来源时不携带凭证
+	if matchOrigin(config.AllowOrigins, "*") {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if config.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		if len(config.ExposeHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(config.ExposeHeaders, ", "))
+		}
+		return
+	}
+
+	header.Set("Access-Control-Allow-Methods", strings.Join(config.AllowMethods, ", "))
+	if len(config.AllowHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(config.AllowHeaders, ", "))
+	} else if requested := context.GetHeader("Access-Control-Request-Headers"); requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+	if config.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(config.MaxAge))
+	}
+	context.Set(PreflightKey, true)
+}
+
+// 预检中间件，回复已通过来源检查的预检请求
+func (bg *baseGateway) PreflightMiddleware(context *gin.Context) {
+	if context.GetBool(PreflightKey) {
+		context.AbortWithStatus(nHttp.StatusNoContent)
+	}
+}
+
+// 订阅安全配置更新主题
+func (bg *baseGateway) subscribeSecurity(name string, c client.Client) {
+	if sp, err := c.Subscribe(SecurityUpdateSubject, "", bg.security.OnlineUpdate); err != nil {
+		log.ErrorF("%s gateway subscribe [%s] error : %s", name, SecurityUpdateSubject, err.Error())
+	} else {
+		bg.subscriptions = append(bg.subscriptions, sp)
+		log.DebugF("%s gateway subscribe [%s] success", name, sp.Subject)
+	}
+}
@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 发出预检请求
+func preflight(eg *engineGateway, origin string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(nHttp.MethodOptions, "/Lobby/Buy", nil)
+	request.Header.Set(HeaderOrigin, origin)
+	request.Header.Set("Access-Control-Request-Method", nHttp.MethodPost)
+	recorder := httptest.NewRecorder()
+	eg.engine.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestSecurityRejectsWildcardWithCredentials(t *testing.T) {
+	config := DefaultSecurityConfig()
+	config.AllowOrigins = []string{"*"}
+	config.AllowCredentials = true
+
+	c := newTestClient(t)
+	gateway := NewHTTPGateway("127.0.0.1:0", WithSecurity(config)).(*engineGateway)
+	if err := gateway.Init(c); err != ErrCORSWildcardCredentials {
+		t.Fatalf("init error = %v , want %v", err, ErrCORSWildcardCredentials)
+	}
+
+	// 热更新同样拒绝，保留原配置
+	s := newSecurity(DefaultSecurityConfig())
+	s.OnlineUpdate(&nats.Msg{Data: []byte(`{"allow_origins":["*"],"allow_credentials":true}`)})
+	if s.get().AllowCredentials {
+		t.Fatal("insecure config applied by online update")
+	}
+}
+
+func TestSecurityWildcardOrigin(t *testing.T) {
+	config := DefaultSecurityConfig()
+	config.AllowOrigins = []string{"*"}
+
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0", WithSecurity(config)))
+
+	recorder := preflight(eg, "https://evil.example.com")
+	if recorder.Code != nHttp.StatusNoContent {
+		t.Fatalf("status = %d , want %d", recorder.Code, nHttp.StatusNoContent)
+	}
+	if got := recorder.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Fatalf("allow origin = %q , want *", got)
+	}
+	if got := recorder.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Fatalf("allow credentials = %q , want empty", got)
+	}
+}
+
+func TestPreflightChecksBlackList(t *testing.T) {
+	config := DefaultSecurityConfig()
+	config.AllowOrigins = []string{"https://app.example.com"}
+
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0", WithSecurity(config)))
+
+	if recorder := preflight(eg, "https://other.example.com"); recorder.Code != nHttp.StatusForbidden {
+		t.Fatalf("disallowed origin status = %d , want %d", recorder.Code, nHttp.StatusForbidden)
+	}
+	if recorder := preflight(eg, "https://app.example.com"); recorder.Code != nHttp.StatusNoContent {
+		t.Fatalf("allowed origin status = %d , want %d", recorder.Code, nHttp.StatusNoContent)
+	}
+
+	// httptest 请求的客户端地址为 192.0.2.1
+	eg.bl.OnlineAdd(&nats.Msg{Data: []byte(`{"192.0.2.1":{}}`)})
+	if recorder := preflight(eg, "https://app.example.com"); recorder.Code != nHttp.StatusForbidden {
+		t.Fatalf("blocked ip status = %d , want %d", recorder.Code, nHttp.StatusForbidden)
+	}
+}
@@ -0,0 +1,422 @@
+package gateway
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"io"
+	"net"
+	"sherlock/client"
+	"sherlock/log"
+	"sherlock/util/transform"
+	"sync"
+	"time"
+)
+
+type (
+	// TCP 网关，帧格式为 4 字节大端长度头 + 数据
+	// 客户端发送的数据为 Message 的 JSON 编码，回复的数据为服务回复的原始数据
+	socket struct {
+		baseGateway
+		client   client.Client
+		mutex    sync.Mutex
+		listener net.Listener
+		shutdown bool                     // 是否已经主动关闭
+		conns    map[net.Conn]*socketConn // 存活连接，关闭网关时一并关闭
+		pending  map[net.Conn]struct{}    // 读取 PROXY 协议头及 TLS 握手中的连接，同样占用连接名额
+		tlsConf  *tls.Config              // 不为 nil 时在连接上完成 TLS 握手
+	}
+
+	// TCP 网关连接配置
+	SocketConfig struct {
+		MaxConnections int           // 最大连接数，0 表示不限制
+		MaxFrameSize   int           // 客户端单帧最大字节数，超过时断开连接
+		WriteTimeout   time.Duration // 单次写入超时时间，超时视为慢速连接并断开
+		IdleTimeout    time.Duration // 读空闲超时时间，期间未收到任何帧即断开连接
+	}
+
+	// TCP 连接，写入需要加锁，回复来自 NATS 回调协程
+	socketConn struct {
+		id       string
+		clientIP string
+		since    time.Time // 建立时间
+		conn     net.Conn
+		mutex    sync.Mutex
+		timeout  time.Duration // 写入超时时间
+	}
+)
+
+const (
+	SocketGatewayName = "SOCKET-GATEWAY"
+	// 连接回复主题前缀 SOCKET_CONN.<connID>
+	SocketConnSubjectPrefix = "SOCKET_CONN"
+
+	// 帧长度头字节数
+	FrameHeaderLength = 4
+	// 默认最大帧长度 1MB
+	DefaultMaxFrameSize = 1 << 20
+	// 默认读空闲超时时间
+	DefaultSocketIdleTimeout = 5 * time.Minute
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
+// 默认 TCP 连接配置
+func DefaultSocketConfig() SocketConfig {
+	return SocketConfig{
+		MaxConnections: 0,
+		MaxFrameSize:   DefaultMaxFrameSize,
+		WriteTimeout:   DefaultWriteTimeout,
+		IdleTimeout:    DefaultSocketIdleTimeout,
+	}
+}
+
+func NewSocketGateway(address string, options ...Option) Gateway {
+	return &socket{
+		baseGateway: newBaseGateway(address, options...),
+		conns:       map[net.Conn]*socketConn{},
+		pending:     map[net.Conn]struct{}{},
+	}
+}
+
+func (s *socket) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.shutdown = true
+
+	// 关闭监听，Run 随之返回
+	if s.listener != nil {
+		if err := s.listener.Close(); err != nil {
+			return err
+		}
+	}
+
+	for conn := range s.conns {
+		if err := conn.Close(); err != nil {
+			log.ErrorF("Socket connection [%s] close error : %s", conn.RemoteAddr().String(), err.Error())
+		}
+	}
+	for conn := range s.pending {
+		_ = conn.Close()
+	}
+
+	return nil
+}
+func (s *socket) Info() string { return SocketGatewayName }
+func (s *socket) Init(c client.Client) error {
+	// 网关订阅黑名单控制主题，并从持久化存储中恢复名单
+	s.baseGateway.subscribeBlackList("Socket", c)
+
+	// 开启 TLS 时，握手在解析 PROXY 协议头及黑名单过滤之后进行
+	if s.tls != nil {
+		config, err := s.tls.build()
+		if err != nil {
+			return err
+		}
+		s.tlsConf = config
+	}
+
+	d := DefaultSocketConfig()
+	if s.socketConfig.MaxFrameSize <= 0 {
+		s.socketConfig.MaxFrameSize = d.MaxFrameSize
+	}
+	if s.socketConfig.WriteTimeout <= 0 {
+		s.socketConfig.WriteTimeout = d.WriteTimeout
+	}
+	if s.socketConfig.IdleTimeout <= 0 {
+		s.socketConfig.IdleTimeout = d.IdleTimeout
+	}
+
+	s.client = c
+
+	// 订阅管理主题，TCP 连接同样支持查询、踢出及排空
+	s.baseGateway.subscribeAdmin(SocketGatewayName, "Socket", c, s)
+	return nil
+}
+func (s *socket) Run() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	if s.shutdown { // 运行前已经主动关闭
+		s.mutex.Unlock()
+		return listener.Close()
+	}
+	s.listener = listener
+	s.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.closed() { // 主动关闭
+				return nil
+			}
+			return err
+		}
+
+		go s.handle(conn)
+	}
+}
+func (s *socket) Destroy() error {
+	// 取消订阅
+	for _, sp := range s.subscriptions {
+		if err := sp.Unsubscribe(); err != nil {
+			return err
+		} else {
+			log.DebugF("Socket gateway unsubscribe [%s] success", sp.Subject)
+		}
+	}
+
+	return nil
+}
+
+// 是否已经主动关闭
+func (s *socket) closed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.shutdown
+}
+
+func (s *socket) connSubject(connID string) string {
+	return fmt.Sprintf("%s.%s", SocketConnSubjectPrefix, connID)
+}
+
+// 处理单一连接
+func (s *socket) handle(conn net.Conn) {
+	// 排空期间不再接受新连接，超过最大连接数时直接关闭
+	// 在读取 PROXY 协议头及 TLS 握手之前占用名额，握手本身不会突破连接数限制
+	if !s.reserve(conn) {
+		log.DebugF("Socket connection [%s] rejected : draining or too many connections", conn.RemoteAddr().String())
+		_ = conn.Close()
+		return
+	}
+	raw := conn
+
+	reader := bufio.NewReader(conn)
+
+	// PROXY 协议头及 TLS 握手同样受读空闲超时限制
+	if err := conn.SetDeadline(time.Now().Add(s.socketConfig.IdleTimeout)); err != nil {
+		log.ErrorF("Socket connection [%s] set deadline error : %s", conn.RemoteAddr().String(), err.Error())
+		s.release(raw)
+		return
+	}
+
+	// 解析客户端真实地址，受信任代理的连接先读取 PROXY 协议头
+	addr, err := s.resolver.ClientAddr(conn, reader, s.proxyProtocol)
+	if err != nil {
+		log.ErrorF("Resolve client address of [%s] error : %s", conn.RemoteAddr().String(), err.Error())
+		s.release(raw)
+		return
+	}
+	address := addr.String()
+
+	// 黑名单过滤
+	if !s.bl.Filter(hostOf(address)) {
+		log.DebugF("Socket connection [%s] is block by blacklist", address)
+		s.release(raw)
+		return
+	}
+
+	if s.tlsConf != nil {
+		tlsConn, err := serverTLS(conn, reader, s.tlsConf)
+		if err != nil {
+			log.DebugF("Socket connection [%s] tls handshake error : %s", address, err.Error())
+			s.release(raw)
+			return
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(tlsConn)
+	}
+
+	sc := &socketConn{
+		id:       newConnID(address + "|" + conn.RemoteAddr().String()),
+		clientIP: hostOf(address),
+		since:    time.Now(),
+		conn:     conn,
+		timeout:  s.socketConfig.WriteTimeout,
+	}
+
+	s.mutex.Lock()
+	delete(s.pending, raw)
+	s.conns[conn] = sc
+	s.mutex.Unlock()
+
+	connSubject := s.connSubject(sc.id)
+
+	// 同时开启一个 [SOCKET_CONN.连接ID] 主题的订阅，用于接收回复消息
+	// 写入超时的连接直接关闭，读协程随之退出并释放连接
+	sp, err := s.client.Subscribe(connSubject, "", func(msg *nats.Msg) {
+		if err := sc.writeFrame(msg.Data); err != nil {
+			log.ErrorF("Write frame to [%s] error : %s", address, err.Error())
+			_ = conn.Close()
+		}
+	})
+	if err != nil {
+		log.ErrorF("Subscribe [%s] for the client [%s] error : %s", connSubject, address, err.Error())
+		s.release(conn)
+		return
+	}
+
+	defer func() {
+		if err := sp.Unsubscribe(); err != nil {
+			log.ErrorF("Socket connection [%s] unsubscribe error : %s", address, err.Error())
+		}
+		s.release(conn)
+	}()
+
+	for {
+		// 空闲超过读超时时间的连接断开
+		if err := conn.SetReadDeadline(time.Now().Add(s.socketConfig.IdleTimeout)); err != nil {
+			log.ErrorF("Socket connection [%s] set read deadline error : %s", address, err.Error())
+			break
+		}
+		data, err := readFrame(reader, s.socketConfig.MaxFrameSize)
+		if err != nil {
+			if err != io.EOF {
+				log.ErrorF("Socket connection [%s] read frame error : %s", address, err.Error())
+			}
+			break
+		}
+
+		// 接收的消息必须以 Message 的形式指定
+		message := &Message{}
+		if err := json.Unmarshal(data, message); err != nil {
+			log.ErrorF("Socket connection [%s] unmarshal message error : %s", address, err.Error())
+			continue
+		}
+
+		log.DebugF("Socket get new message from [%s] : %s", address, message.Subject)
+		s.stats.message()
+
+		// 内部主题只能由服务端发布，客户端指定时直接丢弃
+		if err := checkClientSubject(message.Subject); err != nil {
+			log.DebugF("Socket connection [%s] drop message to [%s] : %s", address, message.Subject, err.Error())
+			continue
+		}
+
+		// 超过限流的消息直接丢弃
+		if s.limiter != nil && !s.limiter.allow(s.client, hostOf(address), "", message.Subject) {
+			log.DebugF("Socket connection [%s] drop message to [%s] : %s", address, message.Subject, ErrTooManyRequests.Error())
+			continue
+		}
+
+		// 通过指定 Reply 为 [SOCKET_CONN.连接ID] ，由上面的订阅接收并且回复给用户
+		if err := s.client.Publish(message.Subject, connSubject, message.Data); err != nil {
+			log.ErrorF("Socket publish a message to [%s] subject error : %s", message.Subject, err.Error())
+			continue
+		}
+	}
+}
+
+// 占用连接名额，排空、已关闭或达到最大连接数时返回 false
+func (s *socket) reserve(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.shutdown || s.isDraining() {
+		return false
+	}
+	if max := s.socketConfig.MaxConnections; max > 0 && len(s.conns)+len(s.pending) >= max {
+		return false
+	}
+	s.pending[conn] = struct{}{}
+	return true
+}
+
+// 关闭并移除连接
+func (s *socket) release(conn net.Conn) {
+	s.mutex.Lock()
+	delete(s.conns, conn)
+	delete(s.pending, conn)
+	s.mutex.Unlock()
+
+	if err := conn.Close(); err != nil {
+		log.DebugF("Socket connection [%s] close : %s", conn.RemoteAddr().String(), err.Error())
+	}
+}
+
+// 所有连接的信息
+func (s *socket) connections() []ConnectionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	infos := make([]ConnectionInfo, 0, len(s.conns))
+	for _, sc := range s.conns {
+		infos = append(infos, sc.info())
+	}
+	return infos
+}
+
+// 断开匹配的连接，TCP 连接没有关闭码及原因，直接关闭，读协程随之退出并释放连接
+func (s *socket) disconnect(match func(*ConnectionInfo) bool, _ int, _ string) int {
+	s.mutex.Lock()
+	conns := make([]net.Conn, 0)
+	for conn, sc := range s.conns {
+		if info := sc.info(); match(&info) {
+			conns = append(conns, conn)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, conn := range conns {
+		if err := conn.Close(); err != nil {
+			log.DebugF("Socket connection [%s] close : %s", conn.RemoteAddr().String(), err.Error())
+		}
+	}
+	return len(conns)
+}
+
+// 连接信息
+func (sc *socketConn) info() ConnectionInfo {
+	return ConnectionInfo{
+		ID:       sc.id,
+		Protocol: ProtocolSocket,
+		ClientIP: sc.clientIP,
+		Since:    sc.since,
+	}
+}
+
+// 写入一帧
+func (sc *socketConn) writeFrame(data []byte) error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	frame := make([]byte, 0, FrameHeaderLength+len(data))
+	frame = append(frame, transform.IntToBytes(len(data))...)
+	frame = append(frame, data...)
+
+	if err := sc.conn.SetWriteDeadline(time.Now().Add(sc.timeout)); err != nil {
+		return err
+	}
+	_, err := sc.conn.Write(frame)
+	return err
+}
+
+// 读取一帧
+func readFrame(reader io.Reader, maxSize int) ([]byte, error) {
+	header := make([]byte, FrameHeaderLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	length := transform.BytesToInt(header)
+	if length > maxSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	"net"
+	"testing"
+	"time"
+)
+
+// 启动 TCP 网关并返回监听地址
+func newTestSocket(t *testing.T, options ...Option) (*socket, string) {
+	t.Helper()
+
+	c := newTestClient(t)
+	s := NewSocketGateway("127.0.0.1:0", options...).(*socket)
+	if err := s.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Run() }()
+	t.Cleanup(func() {
+		_ = s.Close()
+		_ = s.Destroy()
+	})
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.mutex.Lock()
+		listener := s.listener
+		s.mutex.Unlock()
+		if listener != nil {
+			return s, listener.Addr().String()
+		}
+	}
+	t.Fatal("socket gateway not listening")
+	return nil, ""
+}
+
+// 连接是否已被网关关闭
+func closedByPeer(conn net.Conn, timeout time.Duration) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func TestSocketRoundTrip(t *testing.T) {
+	s, address := newTestSocket(t)
+	if _, err := s.client.Subscribe("Lobby.Echo", "", func(msg *nats.Msg) {
+		_ = s.client.Reply(msg.Reply, "", msg.Data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, _ := json.Marshal(&Message{Subject: "Lobby.Echo", Data: []byte("ping")})
+	sc := &socketConn{conn: conn, timeout: time.Second}
+	if err := sc.writeFrame(data); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, err := readFrame(bufio.NewReader(conn), DefaultMaxFrameSize)
+	if err != nil || string(reply) != "ping" {
+		t.Fatalf("reply = %q , %v", reply, err)
+	}
+}
+
+func TestSocketMaxConnections(t *testing.T) {
+	_, address := newTestSocket(t, WithSocketConfig(SocketConfig{MaxConnections: 1}))
+
+	first, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// 等待第一个连接登记
+	time.Sleep(50 * time.Millisecond)
+
+	second, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if !closedByPeer(second, time.Second) {
+		t.Fatal("connection over the limit not closed")
+	}
+	if closedByPeer(first, 100*time.Millisecond) {
+		t.Fatal("connection within the limit closed")
+	}
+}
+
+func TestSocketMaxConnectionsCountsHandshakes(t *testing.T) {
+	dir := tempDir(t)
+	certFile, keyFile, _ := writeTestCert(t, dir, "server", "127.0.0.1")
+	_, address := newTestSocket(t, WithTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile}), WithSocketConfig(SocketConfig{MaxConnections: 1}))
+
+	// 第一个连接不发起握手，仍然占用名额
+	first, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	second, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if !closedByPeer(second, time.Second) {
+		t.Fatal("connection over the limit not closed before handshake")
+	}
+	if closedByPeer(first, 100*time.Millisecond) {
+		t.Fatal("handshaking connection within the limit closed")
+	}
+}
+
+func TestSocketIdleTimeout(t *testing.T) {
+	_, address := newTestSocket(t, WithSocketConfig(SocketConfig{IdleTimeout: 100 * time.Millisecond}))
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !closedByPeer(conn, time.Second) {
+		t.Fatal("idle connection not closed")
+	}
+}
+
+func TestSocketAdminCommands(t *testing.T) {
+	s, address := newTestSocket(t, WithInstanceID("socket-1"))
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 等待连接登记
+	var infos []ConnectionInfo
+	for deadline := time.Now().Add(time.Second); len(infos) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not registered")
+		}
+		ack, err := AdminRequest(s.client, "socket-1", AdminCommandConnections, nil, time.Second)
+		if err != nil || !ack.OK {
+			t.Fatalf("connections ack = %+v , %v", ack, err)
+		}
+		if err := json.Unmarshal(ack.Data, &infos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if infos[0].Protocol != ProtocolSocket || infos[0].ClientIP != "127.0.0.1" {
+		t.Fatalf("connection info = %+v", infos[0])
+	}
+
+	ack, err := AdminRequest(s.client, "socket-1", AdminCommandStats, nil, time.Second)
+	stats := &GatewayStats{}
+	if err != nil || json.Unmarshal(ack.Data, stats) != nil || stats.Connections[ProtocolSocket] != 1 {
+		t.Fatalf("stats = %s , %v", ack.Data, err)
+	}
+
+	// 排空并断开已有连接，之后不再接受新连接
+	ack, err = AdminRequest(s.client, "socket-1", AdminCommandDrain, &AdminDrain{Enable: true, CloseConnections: true}, time.Second)
+	if err != nil || !ack.OK {
+		t.Fatalf("drain ack = %+v , %v", ack, err)
+	}
+	if !closedByPeer(conn, time.Second) {
+		t.Fatal("connection not closed by drain")
+	}
+	next, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	if !closedByPeer(next, time.Second) {
+		t.Fatal("new connection accepted while draining")
+	}
+}
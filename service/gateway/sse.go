@@ -0,0 +1,472 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"sherlock/client"
+	"sherlock/log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// SSE 配置
+	SSEConfig struct {
+		// 允许订阅的主题及所需角色，角色为空时任何客户端均可订阅
+		// 未设置认证者时接受匿名客户端，匿名客户端只能订阅不要求角色的主题，不接收用户推送
+		Topics            map[string][]string
+		BufferSize        int           // 每个事件流的回放缓冲长度，默认 256
+		BufferTTL         time.Duration // 回放缓冲保留时间，默认 5 分钟
+		HeartbeatInterval time.Duration // 心跳注释间隔，默认 15 秒
+		MaxBufferedUsers  int           // 保留回放缓冲的用户数上限，默认 10000
+	}
+
+	// 事件
+	sseEvent struct {
+		id   uint64
+		name string // 事件名，用户推送为 user ，主题推送为主题名
+		data []byte
+		time time.Time
+	}
+
+	// 客户端的事件流
+	sseStream struct {
+		info   ConnectionInfo
+		events chan *sseEvent
+		done   chan struct{}
+		once   sync.Once
+	}
+
+	// SSE 协议，GET /events 上的请求以事件流的形式推送用户及主题消息
+	// 网关订阅所有用户及主题推送，每个事件流保留最近的事件，客户端断线重连时按 Last-Event-ID 补发
+	// 用户推送只为存在事件流或事件流在保留时间内关闭的用户缓冲
+	sse struct {
+		config      SSEConfig
+		queueSize   int
+		mutex       sync.Mutex
+		seq         uint64                             // 事件 ID ，以启动时间为起点单调递增，重启后不会回退
+		buffers     map[string][]*sseEvent             // 回放缓冲 map[subject]events
+		streams     map[string]map[*sseStream]struct{} // 客户端事件流 map[subject]streams
+		closedAt    map[string]time.Time               // 用户最后一个事件流的关闭时间 map[subject]time
+		userBuffers int                                // 用户回放缓冲数
+		lastSweep   time.Time
+		closed      bool
+	}
+)
+
+const (
+	// SSE 路径
+	SSEPath = "/events"
+	// 订阅主题的查询参数，可以指定多个
+	SSETopicQueryKey = "topic"
+	// 不支持设置请求头的客户端通过查询参数指定最后收到的事件 ID
+	SSELastEventIDQueryKey = "last_event_id"
+	// 用户事件名
+	SSEUserEvent = "user"
+
+	// 推送给主题的主题前缀 SSE_TOPIC.<topic>
+	TopicPushSubjectPrefix = "SSE_TOPIC"
+
+	DefaultSSEBufferSize        = 256
+	DefaultSSEBufferTTL         = 5 * time.Minute
+	DefaultSSEHeartbeatInterval = 15 * time.Second
+	DefaultSSEMaxBufferedUsers  = 10000
+)
+
+var (
+	ErrTopicForbidden = errors.New("topic forbidden")
+	ErrNoEventStream  = errors.New("no event stream")
+)
+
+// 推送给主题的主题
+func TopicPushSubject(topic string) string {
+	return fmt.Sprintf("%s.%s", TopicPushSubjectPrefix, topic)
+}
+
+// 推送给订阅了主题的 SSE 客户端
+func PushToTopic(c client.Client, topic string, data []byte) error {
+	if !validSubjectToken(topic) {
+		return ErrInvalidSubjectToken
+	}
+	return c.Publish(TopicPushSubject(topic), "", data)
+}
+
+func (s *sse) http2() bool { return true }
+func (s *sse) close() {
+	// 事件流的请求一直处于活跃状态，需要在 Shutdown 前结束
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	for stream := range s.all() {
+		stream.close()
+	}
+}
+func (s *sse) connections() []ConnectionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	infos := make([]ConnectionInfo, 0)
+	for stream := range s.all() {
+		infos = append(infos, stream.info)
+	}
+	return infos
+}
+func (s *sse) disconnect(match func(*ConnectionInfo) bool, _ int, _ string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := 0
+	for stream := range s.all() {
+		if match(&stream.info) {
+			stream.close()
+			n++
+		}
+	}
+	return n
+}
+func (s *sse) register(bg *baseGateway, engine *gin.Engine, c client.Client) error {
+	// 未开启 SSE 时不注册
+	if bg.sse == nil {
+		return nil
+	}
+
+	s.config = *bg.sse
+	if s.config.BufferSize <= 0 {
+		s.config.BufferSize = DefaultSSEBufferSize
+	}
+	if s.config.BufferTTL <= 0 {
+		s.config.BufferTTL = DefaultSSEBufferTTL
+	}
+	if s.config.HeartbeatInterval <= 0 {
+		s.config.HeartbeatInterval = DefaultSSEHeartbeatInterval
+	}
+	if s.config.MaxBufferedUsers <= 0 {
+		s.config.MaxBufferedUsers = DefaultSSEMaxBufferedUsers
+	}
+	// 发送队列长度与 WebSocket 连接一致
+	s.queueSize = bg.connConfig.SendQueueSize
+	if s.queueSize <= 0 {
+		s.queueSize = DefaultConnectionConfig().SendQueueSize
+	}
+	s.seq = uint64(time.Now().UnixNano())
+	s.buffers = map[string][]*sseEvent{}
+	s.streams = map[string]map[*sseStream]struct{}{}
+	s.closedAt = map[string]time.Time{}
+	s.lastSweep = time.Now()
+
+	// 用户推送与 WebSocket 共用主题，客户端断线后保留时间内的推送同样进入回放缓冲
+	for _, subject := range []string{
+		UserPushSubject(client.SubjectWildcardSingle),
+		TopicPushSubject(client.SubjectWildcardSingle),
+	} {
+		sp, err := c.Subscribe(subject, "", s.onMessage)
+		if err != nil {
+			return err
+		}
+		bg.subscriptions = append(bg.subscriptions, sp)
+		log.DebugF("SSE subscribe [%s] success", sp.Subject)
+	}
+
+	engine.GET(SSEPath, s.handler(bg, c))
+	return nil
+}
+
+// 对 [http://address/events?topic=xxx] 上的请求以事件流回复
+// 设置了认证者时必须通过认证，已认证的客户端同时接收推送给自己的消息
+func (s *sse) handler(bg *baseGateway, c client.Client) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		clientIP := context.GetString(ClientIPKey)
+
+		// 排空中的网关不再接受新的事件流
+		if bg.isDraining() {
+			writeError(context, nHttp.StatusServiceUnavailable, "", ErrGatewayDraining.Error())
+			return
+		}
+
+		identity, err := bg.authenticate(c, context.Request)
+		if err != nil {
+			log.DebugF("SSE authenticate [%s] error : %s", clientIP, err.Error())
+			writeError(context, nHttp.StatusUnauthorized, "", ErrUnauthorized.Error())
+			return
+		}
+		subjects, err := s.subjects(identity, context.QueryArray(SSETopicQueryKey))
+		if err != nil {
+			writeError(context, nHttp.StatusForbidden, "", err.Error())
+			return
+		}
+		if len(subjects) == 0 {
+			writeError(context, nHttp.StatusBadRequest, "", ErrNoEventStream.Error())
+			return
+		}
+
+		lastID := context.GetHeader("Last-Event-ID")
+		if lastID == "" {
+			lastID = context.Query(SSELastEventIDQueryKey)
+		}
+		after, _ := strconv.ParseUint(lastID, 10, 64)
+
+		info := ConnectionInfo{
+			ID:       newConnID(clientIP + "|" + context.Request.RemoteAddr),
+			Protocol: ProtocolSSE,
+			ClientIP: clientIP,
+			Since:    time.Now(),
+		}
+		if identity != nil {
+			info.UserID = identity.UserID
+			context.Set(UserIDKey, identity.UserID)
+		}
+		stream, replay, err := s.open(info, subjects, after)
+		if err != nil {
+			writeError(context, nHttp.StatusServiceUnavailable, "", err.Error())
+			return
+		}
+		defer s.remove(subjects, stream)
+		log.DebugF("SSE stream [%s] open : %v , replay %d events", clientIP, subjects, len(replay))
+
+		header := context.Writer.Header()
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("Connection", "keep-alive")
+		// 禁止反向代理缓冲
+		header.Set("X-Accel-Buffering", "no")
+		context.Status(nHttp.StatusOK)
+
+		for _, event := range replay {
+			if err := writeEvent(context, event); err != nil {
+				return
+			}
+		}
+		context.Writer.Flush()
+
+		ticker := time.NewTicker(s.config.HeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case event := <-stream.events:
+				if err := writeEvent(context, event); err != nil {
+					log.DebugF("SSE stream [%s] write error : %s", clientIP, err.Error())
+					return
+				}
+			case <-ticker.C:
+				// 注释行作为心跳，避免代理断开空闲连接
+				if _, err := context.Writer.WriteString(": heartbeat\n\n"); err != nil {
+					return
+				}
+			case <-stream.done:
+				// 发送队列写满、被踢出或网关关闭，客户端重连后从回放缓冲补发
+				log.DebugF("SSE stream [%s] closed by gateway", clientIP)
+				return
+			case <-context.Request.Context().Done():
+				log.DebugF("SSE stream [%s] closed", clientIP)
+				return
+			}
+			context.Writer.Flush()
+		}
+	}
+}
+
+// 客户端可订阅的主题，包括自己的用户主题及有权限的主题
+func (s *sse) subjects(identity *Identity, topics []string) ([]string, error) {
+	subjects := make([]string, 0, len(topics)+1)
+	seen := map[string]struct{}{}
+	if identity != nil && validSubjectToken(identity.UserID) {
+		subjects = append(subjects, UserPushSubject(identity.UserID))
+	}
+
+	for _, topic := range topics {
+		if _, exist := seen[topic]; exist {
+			continue
+		}
+		seen[topic] = struct{}{}
+
+		roles, exist := s.config.Topics[topic]
+		if !exist || !validSubjectToken(topic) {
+			return nil, ErrTopicForbidden
+		}
+		if len(roles) > 0 && !identity.hasAnyRole(roles) {
+			return nil, ErrTopicForbidden
+		}
+		subjects = append(subjects, TopicPushSubject(topic))
+	}
+
+	return subjects, nil
+}
+
+// 登记事件流并取出 ID 大于 after 的缓冲事件，两者在同一把锁内完成，补发与实时推送之间不会丢失或重复
+func (s *sse) open(info ConnectionInfo, subjects []string, after uint64) (*sseStream, []*sseEvent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, nil, ErrGatewayClosed
+	}
+
+	stream := &sseStream{
+		info:   info,
+		events: make(chan *sseEvent, s.queueSize),
+		done:   make(chan struct{}),
+	}
+	replay := make([]*sseEvent, 0)
+	deadline := time.Now().Add(-s.config.BufferTTL)
+	for _, subject := range subjects {
+		if _, exist := s.streams[subject]; !exist {
+			s.streams[subject] = map[*sseStream]struct{}{}
+		}
+		s.streams[subject][stream] = struct{}{}
+
+		if after == 0 {
+			continue
+		}
+		for _, event := range s.buffers[subject] {
+			if event.id > after && event.time.After(deadline) {
+				replay = append(replay, event)
+			}
+		}
+	}
+	sort.Slice(replay, func(i, j int) bool { return replay[i].id < replay[j].id })
+
+	return stream, replay, nil
+}
+
+// 注销事件流
+func (s *sse) remove(subjects []string, stream *sseStream) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, subject := range subjects {
+		if streams, exist := s.streams[subject]; exist {
+			delete(streams, stream)
+			if len(streams) == 0 {
+				delete(s.streams, subject)
+				// 保留时间内继续缓冲用户推送，供客户端重连补发
+				if isUserPushSubject(subject) {
+					s.closedAt[subject] = time.Now()
+				}
+			}
+		}
+	}
+	stream.close()
+}
+
+// 是否为用户推送主题
+func isUserPushSubject(subject string) bool {
+	return strings.HasPrefix(subject, UserPushSubjectPrefix+client.SubjectSeparator)
+}
+
+// 是否缓冲该主题的推送，调用方需持有锁
+// 主题推送总是缓冲；用户推送只在存在事件流或事件流在保留时间内关闭时缓冲，并且缓冲的用户数不超过上限
+func (s *sse) buffered(subject string, now time.Time) bool {
+	if !isUserPushSubject(subject) {
+		return true
+	}
+	if _, exist := s.buffers[subject]; exist {
+		return len(s.streams[subject]) > 0 || now.Sub(s.closedAt[subject]) < s.config.BufferTTL
+	}
+	if len(s.streams[subject]) == 0 && now.Sub(s.closedAt[subject]) >= s.config.BufferTTL {
+		return false
+	}
+	return s.userBuffers < s.config.MaxBufferedUsers
+}
+
+// 接收推送，写入回放缓冲并分发给事件流
+func (s *sse) onMessage(msg *nats.Msg) {
+	name := SSEUserEvent
+	if strings.HasPrefix(msg.Subject, TopicPushSubjectPrefix+client.SubjectSeparator) {
+		name = msg.Subject[len(TopicPushSubjectPrefix)+1:]
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq++
+	now := time.Now()
+	event := &sseEvent{id: s.seq, name: name, data: msg.Data, time: now}
+
+	s.sweep(now)
+	if s.buffered(msg.Subject, now) {
+		buffer, exist := s.buffers[msg.Subject]
+		if !exist && isUserPushSubject(msg.Subject) {
+			s.userBuffers++
+		}
+		buffer = append(buffer, event)
+		if len(buffer) > s.config.BufferSize {
+			buffer = buffer[len(buffer)-s.config.BufferSize:]
+		}
+		s.buffers[msg.Subject] = buffer
+	}
+
+	for stream := range s.streams[msg.Subject] {
+		select {
+		case stream.events <- event:
+		default:
+			// 慢速客户端断开，由客户端重连补发
+			stream.close()
+		}
+	}
+}
+
+// 所有事件流，同一事件流可能登记在多个主题下，调用方需持有锁
+func (s *sse) all() map[*sseStream]struct{} {
+	all := map[*sseStream]struct{}{}
+	for _, streams := range s.streams {
+		for stream := range streams {
+			all[stream] = struct{}{}
+		}
+	}
+	return all
+}
+
+// 按保留时间清理回放缓冲，调用方需持有锁
+func (s *sse) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.config.BufferTTL {
+		return
+	}
+	s.lastSweep = now
+
+	deadline := now.Add(-s.config.BufferTTL)
+	for subject, buffer := range s.buffers {
+		i := sort.Search(len(buffer), func(i int) bool { return buffer[i].time.After(deadline) })
+		if i == len(buffer) {
+			delete(s.buffers, subject)
+			if isUserPushSubject(subject) {
+				s.userBuffers--
+			}
+		} else if i > 0 {
+			s.buffers[subject] = append([]*sseEvent{}, buffer[i:]...)
+		}
+	}
+	for subject, closedAt := range s.closedAt {
+		if closedAt.Before(deadline) {
+			delete(s.closedAt, subject)
+		}
+	}
+}
+
+func (ss *sseStream) close() {
+	ss.once.Do(func() { close(ss.done) })
+}
+
+// 写出事件，多行数据拆分为多个 data 字段
+func writeEvent(context *gin.Context, event *sseEvent) error {
+	buf := bytes.Buffer{}
+	buf.WriteString("id: " + strconv.FormatUint(event.id, 10) + "\n")
+	buf.WriteString("event: " + event.name + "\n")
+	for _, line := range bytes.Split(event.data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+
+	_, err := context.Writer.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"testing"
+	"time"
+)
+
+func newTestSSE(config SSEConfig) *sse {
+	return &sse{
+		config:    config,
+		queueSize: 16,
+		buffers:   map[string][]*sseEvent{},
+		streams:   map[string]map[*sseStream]struct{}{},
+		closedAt:  map[string]time.Time{},
+		lastSweep: time.Now(),
+	}
+}
+
+func TestSSEBuffersOnlyKnownUsers(t *testing.T) {
+	s := newTestSSE(SSEConfig{BufferSize: 8, BufferTTL: time.Minute, MaxBufferedUsers: 1})
+
+	// 没有事件流的用户不缓冲
+	s.onMessage(&nats.Msg{Subject: UserPushSubject("nobody"), Data: []byte("x")})
+	if len(s.buffers) != 0 {
+		t.Fatal("push buffered for a user without stream")
+	}
+
+	alice := []string{UserPushSubject("alice")}
+	stream, _, err := s.open(ConnectionInfo{UserID: "alice"}, alice, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.onMessage(&nats.Msg{Subject: alice[0], Data: []byte("1")})
+	s.remove(alice, stream)
+
+	// 事件流关闭后保留时间内继续缓冲，重连时补发
+	s.onMessage(&nats.Msg{Subject: alice[0], Data: []byte("2")})
+	_, replay, err := s.open(ConnectionInfo{UserID: "alice"}, alice, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replay) != 2 {
+		t.Fatalf("replay %d events , want 2", len(replay))
+	}
+
+	// 超过缓冲用户数上限时不再缓冲新用户
+	bob := []string{UserPushSubject("bob")}
+	if _, _, err := s.open(ConnectionInfo{UserID: "bob"}, bob, 0); err != nil {
+		t.Fatal(err)
+	}
+	s.onMessage(&nats.Msg{Subject: bob[0], Data: []byte("1")})
+	if _, exist := s.buffers[bob[0]]; exist {
+		t.Fatal("buffered users exceed the limit")
+	}
+}
+
+func TestSSEAnonymousRoleTopicForbidden(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewHTTPGateway("127.0.0.1:0", WithSSE(SSEConfig{
+		Topics: map[string][]string{"vip": {"vip"}},
+	})))
+
+	if recorder := serve(eg, nHttp.MethodGet, SSEPath+"?topic=vip", nil); recorder.Code != nHttp.StatusForbidden {
+		t.Fatalf("status = %d , want %d", recorder.Code, nHttp.StatusForbidden)
+	}
+}
@@ -0,0 +1,214 @@
+package gateway
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sherlock/log"
+	"sync"
+	"time"
+)
+
+type (
+	// TLS 配置
+	TLSConfig struct {
+		CertFile       string        // 证书文件（PEM）
+		KeyFile        string        // 私钥文件（PEM）
+		ClientCAFile   string        // 客户端 CA 文件（PEM），不为空时开启 mTLS ，校验客户端证书
+		MinVersion     uint16        // 最低版本，默认 TLS 1.2
+		ReloadInterval time.Duration // 检查证书文件变更的间隔，默认 1 分钟，证书轮换后无需重启
+	}
+
+	// 证书热加载，握手时按间隔检查证书文件的修改时间，变更后重新加载
+	certReloader struct {
+		certFile  string
+		keyFile   string
+		interval  time.Duration
+		mutex     sync.Mutex
+		cert      *tls.Certificate
+		modTime   time.Time
+		lastCheck time.Time
+	}
+
+	// 带缓冲读取的连接，PROXY 协议头之后的数据可能已经读入缓冲
+	bufferedConn struct {
+		net.Conn
+		reader *bufio.Reader
+	}
+)
+
+const (
+	// 默认证书检查间隔
+	DefaultCertReloadInterval = time.Minute
+	// TLS 握手超时时间
+	TLSHandshakeTimeout = 10 * time.Second
+
+	// ALPN 协议
+	ALPNHTTP2 = "h2"
+	ALPNHTTP1 = "http/1.1"
+)
+
+var (
+	ErrInvalidClientCA = errors.New("invalid client ca")
+)
+
+// 构建 tls.Config
+func (tc *TLSConfig) build(nextProtos ...string) (*tls.Config, error) {
+	reloader := &certReloader{
+		certFile: tc.CertFile,
+		keyFile:  tc.KeyFile,
+		interval: tc.ReloadInterval,
+	}
+	if reloader.interval <= 0 {
+		reloader.interval = DefaultCertReloadInterval
+	}
+	// 启动时加载失败直接返回错误
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     tc.MinVersion,
+		NextProtos:     nextProtos,
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	if tc.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(tc.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, ErrInvalidClientCA
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// 加载证书
+func (cr *certReloader) load() error {
+	info, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.cert = &cert
+	cr.modTime = info.ModTime()
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(cr.lastCheck) < cr.interval {
+		return cr.cert, nil
+	}
+	cr.lastCheck = now
+
+	info, err := os.Stat(cr.certFile)
+	if err != nil {
+		log.ErrorF("Stat certificate [%s] error : %s", cr.certFile, err.Error())
+		return cr.cert, nil
+	}
+	if !info.ModTime().After(cr.modTime) {
+		return cr.cert, nil
+	}
+
+	// 重新加载失败时沿用旧证书，证书与私钥可能尚未全部写入
+	if err := cr.load(); err != nil {
+		log.ErrorF("Reload certificate [%s] error : %s", cr.certFile, err.Error())
+		cr.lastCheck = time.Time{}
+		return cr.cert, nil
+	}
+	log.InfoF("Reload certificate [%s]", cr.certFile)
+
+	return cr.cert, nil
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) { return bc.reader.Read(p) }
+
+// 在已接受的 TCP 连接上完成 TLS 握手
+func serverTLS(conn net.Conn, reader *bufio.Reader, config *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Server(&bufferedConn{Conn: conn, reader: reader}, config)
+
+	if err := conn.SetDeadline(time.Now().Add(TLSHandshakeTimeout)); err != nil {
+		return nil, err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// 生成自签名证书及私钥（PEM），用于测试及开发环境
+// hosts 可以是域名或 IP
+func GenerateSelfSignedCert(hosts ...string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Sherlock"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
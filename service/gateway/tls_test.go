@@ -0,0 +1,188 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 生成自签名证书并写入文件，返回证书文件、私钥文件及证书
+func writeTestCert(t *testing.T, dir, name string, hosts ...string) (string, string, []byte) {
+	t.Helper()
+
+	certPEM, keyPEM, err := GenerateSelfSignedCert(hosts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, certPEM
+}
+
+// 启动 TLS 服务，握手成功后回复 ok
+func newTestTLSServer(t *testing.T, config *TLSConfig) string {
+	t.Helper()
+
+	tlsConf, err := config.build(ALPNHTTP1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err == nil {
+					_, _ = conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func certPool(t *testing.T, certPEM []byte) *x509.CertPool {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		t.Fatal("append certificate error")
+	}
+	return pool
+}
+
+// 建立连接并读取回复，返回服务端证书
+func dialTLS(address string, config *tls.Config) (*x509.Certificate, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// TLS 1.3 下服务端拒绝客户端证书的错误在读取时才返回
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestTLSHandshake(t *testing.T) {
+	dir := tempDir(t)
+	certFile, keyFile, certPEM := writeTestCert(t, dir, "server", "127.0.0.1", "localhost")
+	address := newTestTLSServer(t, &TLSConfig{CertFile: certFile, KeyFile: keyFile})
+
+	if _, err := dialTLS(address, &tls.Config{RootCAs: certPool(t, certPEM), ServerName: "localhost"}); err != nil {
+		t.Fatalf("handshake error : %v", err)
+	}
+	// 证书不受信任时握手失败
+	if _, err := dialTLS(address, &tls.Config{ServerName: "localhost"}); err == nil {
+		t.Fatal("handshake with an untrusted certificate succeeded")
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	dir := tempDir(t)
+	certFile, keyFile, certPEM := writeTestCert(t, dir, "server", "127.0.0.1")
+	clientCert, clientKey, _ := writeTestCert(t, dir, "client")
+	otherCert, otherKey, _ := writeTestCert(t, dir, "other")
+	address := newTestTLSServer(t, &TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCert})
+
+	base := &tls.Config{RootCAs: certPool(t, certPEM), ServerName: "127.0.0.1"}
+	if _, err := dialTLS(address, base); err == nil {
+		t.Fatal("connection without client certificate accepted")
+	}
+
+	other, err := tls.LoadX509KeyPair(otherCert, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withOther := base.Clone()
+	withOther.Certificates = []tls.Certificate{other}
+	if _, err := dialTLS(address, withOther); err == nil {
+		t.Fatal("connection with an untrusted client certificate accepted")
+	}
+
+	trusted, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTrusted := base.Clone()
+	withTrusted.Certificates = []tls.Certificate{trusted}
+	if _, err := dialTLS(address, withTrusted); err != nil {
+		t.Fatalf("connection with a trusted client certificate rejected : %v", err)
+	}
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	dir := tempDir(t)
+	certFile, keyFile, oldPEM := writeTestCert(t, dir, "server", "127.0.0.1")
+	address := newTestTLSServer(t, &TLSConfig{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Millisecond})
+
+	config := &tls.Config{InsecureSkipVerify: true}
+	cert, err := dialTLS(address, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Raw, pemBytes(t, oldPEM)) {
+		t.Fatal("unexpected initial certificate")
+	}
+
+	// 轮换证书，修改时间晚于原证书
+	_, _, newPEM := writeTestCert(t, dir, "server", "127.0.0.1")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if cert, err = dialTLS(address, config); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Raw, pemBytes(t, newPEM)) {
+		t.Fatal("certificate not reloaded")
+	}
+}
+
+func pemBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("decode pem error")
+	}
+	return block.Bytes
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "sherlock-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
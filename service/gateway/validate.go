@@ -0,0 +1,188 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/xeipuuv/gojsonschema"
+	"io"
+	"io/ioutil"
+	"mime"
+	nHttp "net/http"
+	"sherlock/client"
+	"sort"
+	"strings"
+)
+
+type (
+	// 请求体校验者，按主题匹配 JSON Schema
+	bodyValidator struct {
+		schemas []subjectSchema
+	}
+
+	// 主题的 JSON Schema ，主题支持 NATS 通配符
+	subjectSchema struct {
+		subject string
+		schema  *gojsonschema.Schema
+	}
+)
+
+const (
+	// 默认最大请求体字节数
+	DefaultMaxBodySize = 1 << 20
+
+	// 单次回复的最大校验错误数
+	maxValidationErrors = 8
+)
+
+var (
+	ErrBodyTooLarge           = errors.New("request body too large")
+	ErrUnsupportedContentType = errors.New("unsupported content type")
+	ErrMalformedJSON          = errors.New("malformed json body")
+)
+
+// 编译 JSON Schema ，schemas 为 map[主题]Schema
+func newBodyValidator(schemas map[string]string) (*bodyValidator, error) {
+	bv := &bodyValidator{schemas: make([]subjectSchema, 0, len(schemas))}
+	for subject, source := range schemas {
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(source))
+		if err != nil {
+			return nil, fmt.Errorf("compile json schema of [%s] error : %s", subject, err.Error())
+		}
+		bv.schemas = append(bv.schemas, subjectSchema{subject: subject, schema: schema})
+	}
+	// 多个主题匹配时取最具体的一个，结果不受注册顺序影响
+	sort.Slice(bv.schemas, func(i, j int) bool {
+		return moreSpecific(bv.schemas[i].subject, bv.schemas[j].subject)
+	})
+	return bv, nil
+}
+
+// 主题 a 是否比 b 更具体
+// 从左到右比较片段，首个不同的片段上普通片段优先于 * ，* 优先于 > ，同类片段按字典序
+func moreSpecific(a, b string) bool {
+	at := strings.Split(a, client.SubjectSeparator)
+	bt := strings.Split(b, client.SubjectSeparator)
+	rank := func(token string) int {
+		switch token {
+		case client.SubjectWildcardFull:
+			return 2
+		case client.SubjectWildcardSingle:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	for i := 0; i < len(at) && i < len(bt); i++ {
+		if at[i] == bt[i] {
+			continue
+		}
+		if ra, rb := rank(at[i]), rank(bt[i]); ra != rb {
+			return ra < rb
+		}
+		return at[i] < bt[i]
+	}
+	// 前缀相同时片段多者更具体
+	return len(at) > len(bt)
+}
+
+// 主题对应的 Schema ，精确匹配优先，其次为最具体的通配符匹配
+func (bv *bodyValidator) schema(subject string) *gojsonschema.Schema {
+	for _, s := range bv.schemas {
+		if client.MatchSubject(s.subject, subject) {
+			return s.schema
+		}
+	}
+	return nil
+}
+
+// 按主题校验请求体，未注册 Schema 的主题不校验
+func (bv *bodyValidator) validate(subject string, body []byte) error {
+	schema := bv.schema(subject)
+	if schema == nil {
+		return nil
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return ErrMalformedJSON
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	details := make([]string, 0, maxValidationErrors)
+	for i, e := range result.Errors() {
+		if i == maxValidationErrors {
+			break
+		}
+		details = append(details, e.String())
+	}
+	return errors.New(strings.Join(details, "; "))
+}
+
+// 内容类型是否在允许列表中，支持 type/* 通配
+func allowContentType(allowed []string, contentType string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == mediaType || (strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, a[:len(a)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// 读取请求体，超过限制时回复 413 ，内容类型不被允许时回复 415 ，JSON 格式错误时回复 400
+func readBody(context *gin.Context, limit int64, contentTypes []string) ([]byte, bool) {
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+	// 声明的长度超过限制时不读取
+	if context.Request.ContentLength > limit {
+		writeError(context, nHttp.StatusRequestEntityTooLarge, "", ErrBodyTooLarge.Error())
+		return nil, false
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(context.Request.Body, limit+1))
+	if err != nil {
+		writeError(context, nHttp.StatusBadRequest, "", "read body error")
+		return nil, false
+	}
+	if int64(len(data)) > limit {
+		writeError(context, nHttp.StatusRequestEntityTooLarge, "", ErrBodyTooLarge.Error())
+		return nil, false
+	}
+
+	// 没有请求体时不检查内容类型
+	if len(data) > 0 && !allowContentType(contentTypes, context.GetHeader("Content-Type")) {
+		writeError(context, nHttp.StatusUnsupportedMediaType, "", ErrUnsupportedContentType.Error())
+		return nil, false
+	}
+	if len(data) > 0 && strings.HasPrefix(context.ContentType(), gin.MIMEJSON) && !json.Valid(data) {
+		writeError(context, nHttp.StatusBadRequest, "", ErrMalformedJSON.Error())
+		return nil, false
+	}
+	return data, true
+}
+
+// 按主题校验请求体，校验失败时回复 400 及错误详情
+func (bg *baseGateway) validateBody(context *gin.Context, subject string, body []byte) bool {
+	if bg.validator == nil {
+		return true
+	}
+	if err := bg.validator.validate(subject, body); err != nil {
+		writeError(context, nHttp.StatusBadRequest, "", err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"testing"
+)
+
+func TestBodyValidatorPicksMostSpecificSchema(t *testing.T) {
+	// 每个 Schema 只接受对应的 kind
+	schemas := map[string]string{
+		"Lobby.>":        `{"properties":{"kind":{"const":"full"}}}`,
+		"Lobby.*.Buy":    `{"properties":{"kind":{"const":"single"}}}`,
+		"Lobby.Shop.>":   `{"properties":{"kind":{"const":"shop"}}}`,
+		"Lobby.Shop.Buy": `{"properties":{"kind":{"const":"exact"}}}`,
+	}
+
+	tests := []struct {
+		subject string
+		kind    string
+	}{
+		{"Lobby.Shop.Buy", "exact"},
+		{"Lobby.Shop.Sell", "shop"},
+		{"Lobby.Bank.Buy", "single"},
+		{"Lobby.Bank.Sell", "full"},
+	}
+
+	// 多次编译，结果不受 map 遍历顺序影响
+	for round := 0; round < 20; round++ {
+		bv, err := newBodyValidator(schemas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range tests {
+			if err := bv.validate(test.subject, []byte(`{"kind":"`+test.kind+`"}`)); err != nil {
+				t.Fatalf("subject %s validated by the wrong schema : %v", test.subject, err)
+			}
+			if err := bv.validate(test.subject, []byte(`{"kind":"other"}`)); err == nil {
+				t.Fatalf("subject %s not validated", test.subject)
+			}
+		}
+	}
+}
+
+func TestMoreSpecific(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"A.B", "A.*", true},
+		{"A.*", "A.>", true},
+		{"A.B.>", "A.*.C", true},
+		{"A.B.C", "A.B", true},
+		{"A.>", "A.B", false},
+	}
+
+	for _, test := range tests {
+		if got := moreSpecific(test.a, test.b); got != test.want {
+			t.Errorf("moreSpecific(%s , %s) = %v , want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
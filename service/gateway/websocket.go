@@ -0,0 +1,338 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	nHttp "net/http"
+	"sherlock/client"
+	"sherlock/log"
+	"strings"
+	"time"
+)
+
+type (
+	// WebSocket 协议，/ws 路径上的请求升级为长连接
+	webSocket struct {
+		upgrader *websocket.Upgrader
+		conns    *connManager   // 连接管理者
+		registry *pushRegistry  // 推送注册表
+		resume   *resumeManager // 会话管理者，为 nil 时不支持会话恢复
+	}
+)
+
+const (
+	// WebSocket 升级路径
+	WebSocketPath = "/ws"
+
+	// NATS 无响应者回复的状态头
+	NATSStatusHeader       = "Status"
+	NATSNoRespondersStatus = "503"
+)
+
+var ()
+
+func (ws *webSocket) http2() bool { return false }
+func (ws *webSocket) close() {
+	// 先关闭会话保存快照，再关闭连接
+	if ws.resume != nil {
+		ws.resume.close()
+	}
+	// 已升级的连接不受 Shutdown 管理，需要单独关闭
+	if ws.conns != nil {
+		ws.conns.closeAll()
+	}
+}
+func (ws *webSocket) connections() []ConnectionInfo { return ws.conns.connections() }
+func (ws *webSocket) disconnect(match func(*ConnectionInfo) bool, code int, reason string) int {
+	return ws.conns.disconnect(match, code, reason)
+}
+func (ws *webSocket) register(bg *baseGateway, engine *gin.Engine, c client.Client) error {
+	ws.conns = newConnManager(bg.connConfig)
+	ws.registry = newPushRegistry()
+
+	// 网关订阅用户、分组、广播推送主题及分组成员主题
+	bg.subscriptions = append(bg.subscriptions, ws.registry.subscribe("WebSocket", c)...)
+
+	// 开启会话恢复时，推送由会话分配序号并缓冲
+	if bg.resume != nil {
+		ws.resume = newResumeManager(*bg.resume, bg.instanceID, ws.registry, ws.connSubject, ws.conns.config.SendQueueSize)
+		bg.subscriptions = append(bg.subscriptions, ws.resume.subscribe("WebSocket", c)...)
+	}
+
+	// 初始化 WebSocket 升级件
+	// 按客户端请求的子协议协商帧格式，未协商时使用 JSON 文本帧
+	ws.upgrader = &websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		Subprotocols:      subprotocols,
+		EnableCompression: bg.connConfig.Compression,
+		// 只允许白名单内的来源升级，未配置白名单时只允许同源
+		CheckOrigin: bg.security.checkOrigin,
+	}
+	engine.GET(WebSocketPath, ws.handler(bg, c))
+	return nil
+}
+
+// 对 [ws://address/ws] 路径上的请求统一升级为长连接
+func (ws *webSocket) handler(bg *baseGateway, c client.Client) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		clientIP := context.GetString(ClientIPKey)
+
+		// 排空中的网关不再接受新连接
+		if bg.isDraining() {
+			log.DebugF("WebSocket reject [%s] : %s", clientIP, ErrGatewayDraining.Error())
+			context.String(nHttp.StatusServiceUnavailable, ErrGatewayDraining.Error())
+			return
+		}
+		// 达到最大连接数时拒绝升级
+		if ws.conns.full() {
+			log.ErrorF("WebSocket reject [%s] : %s", clientIP, ErrTooManyConnections.Error())
+			context.String(nHttp.StatusServiceUnavailable, ErrTooManyConnections.Error())
+			return
+		}
+
+		// 设置了认证者时，升级前先完成认证，认证失败拒绝升级
+		identity, err := bg.authenticate(c, context.Request)
+		if err != nil {
+			log.DebugF("WebSocket authenticate [%s] error : %s", clientIP, err.Error())
+			context.String(nHttp.StatusUnauthorized, ErrUnauthorized.Error())
+			return
+		}
+		// 重连时携带的会话令牌及最后收到的序号
+		resumeToken, lastSeq := resumeParams(context)
+
+		// 升级失败时升级件已经回复了错误响应
+		conn, err := ws.upgrader.Upgrade(context.Writer, context.Request, nil)
+		if err != nil {
+			log.ErrorF("upgrade http connection to WebSocket error : %s", err.Error())
+			return
+		}
+
+		userID := ""
+		if identity != nil {
+			userID = identity.UserID
+		}
+		context.Set(UserIDKey, userID)
+
+		// 连接以客户端真实地址及唯一 ID 标识，写入统一经由连接的发送队列
+		wc, err := ws.conns.add(conn, clientIP, userID)
+		if err != nil {
+			log.ErrorF("WebSocket connection [%s] register error : %s", clientIP, err.Error())
+			return
+		}
+		// 回复主题 [WS_CONN.连接ID] ，开启会话恢复时为 [WS_CONN.会话令牌] ，由会话订阅，断开期间的消息在重连后补发
+		replySubject := ws.connSubject(wc.id)
+		connSubject := replySubject
+		log.DebugF("WebSocket connection [%s] use subprotocol : %s", clientIP, wc.codec.subprotocol())
+
+		var session *resumeSession
+		subscriptions := make([]*nats.Subscription, 0, 2)
+		release := func() {
+			if session != nil {
+				session.detach(wc)
+			} else {
+				ws.registry.remove(userID, wc)
+			}
+			ws.conns.remove(wc)
+
+			for _, s := range subscriptions {
+				if err := s.Unsubscribe(); err != nil {
+					log.ErrorF("WebSocket connection [%s] close error : %s", clientIP, err.Error())
+				}
+			}
+		}
+
+		if ws.resume != nil {
+			if session, err = ws.resume.open(c, wc, resumeToken, lastSeq); err != nil {
+				log.ErrorF("WebSocket connection [%s] open session error : %s", clientIP, err.Error())
+				release()
+				return
+			}
+			connSubject = ws.connSubject(session.token)
+		} else {
+			// 同时开启一个 [WS_CONN.连接ID] 主题的订阅，用于接收回复消息
+			sp, err := c.Subscribe(connSubject, "", func(msg *nats.Msg) {
+				if err := wc.push(msg.Data); err != nil {
+					log.ErrorF("Write message to [%s] error : %s", clientIP, err.Error())
+				}
+			})
+			if err != nil {
+				log.ErrorF("Subscribe [%s] for the client [%s] error : %s", connSubject, clientIP, err.Error())
+				// 如果订阅失败，直接关闭连接
+				release()
+				return
+			}
+			subscriptions = append(subscriptions, sp)
+		}
+		// 以及一个 [WS_CONN.连接ID.序号] 主题的订阅，用于接收携带请求 ID 的请求的回复，回复时回显请求 ID
+		rsp, err := c.Subscribe(ws.connSubject(wc.id, client.SubjectWildcardSingle), "", func(msg *nats.Msg) {
+			request, ok := wc.pending.take(msg.Subject[len(replySubject)+1:])
+			if !ok {
+				log.DebugF("WebSocket connection [%s] drop reply of finished request : %s", clientIP, msg.Subject)
+				return
+			}
+			entry := &AccessLogEntry{
+				ClientIP:  clientIP,
+				UserID:    userID,
+				Subject:   request.subject,
+				Status:    nHttp.StatusOK,
+				BytesIn:   int64(request.size),
+				BytesOut:  int64(len(msg.Data)),
+				RequestID: request.requestID,
+			}
+			reply := &Message{
+				RequestID: request.requestID,
+				Data:      msg.Data,
+				Codec:     msg.Header.Get(PayloadCodecHeader),
+			}
+			// 没有服务订阅该主题时 NATS 回复空消息及 503 状态头
+			if len(msg.Data) == 0 && msg.Header.Get(NATSStatusHeader) == NATSNoRespondersStatus {
+				reply = &Message{RequestID: request.requestID, Error: ErrRequestFailed.Error()}
+				entry.Status, entry.Error = nHttp.StatusServiceUnavailable, nats.ErrNoResponders.Error()
+			}
+			bg.logMessage(entry, request.start, nil)
+			if err := wc.pushMessage(reply); err != nil {
+				log.ErrorF("Write message to [%s] error : %s", clientIP, err.Error())
+			}
+		})
+		if err != nil {
+			log.ErrorF("Subscribe [%s.*] for the client [%s] error : %s", replySubject, clientIP, err.Error())
+			release()
+			return
+		}
+		subscriptions = append(subscriptions, rsp)
+
+		// 登记到推送注册表，已认证的连接可以按用户及分组推送，开启会话恢复时由会话登记
+		if session == nil {
+			ws.registry.add(userID, wc)
+		}
+		defer release()
+
+		for {
+			// 超过读超时时间未收到任何消息或 pong 的连接在这里返回错误并被驱逐
+			data, err := wc.read()
+			start := time.Now()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					log.ErrorF("WebSocket connection [%s] read message error : %s", clientIP, err.Error())
+				} else {
+					log.DebugF("WebSocket connection [%s] closed : %s", clientIP, err.Error())
+				}
+				break
+			}
+			// 接收的消息必须以 Message 的形式指定，按连接的帧格式解码
+			message, err := wc.codec.decode(data)
+			if err != nil {
+				log.ErrorF("WebSocket connection [%s] decode message error : %s", clientIP, err.Error())
+				bg.logMessage(&AccessLogEntry{
+					ClientIP: clientIP,
+					UserID:   userID,
+					Status:   nHttp.StatusBadRequest,
+					BytesIn:  int64(len(data)),
+					Error:    err.Error(),
+				}, start, nil)
+				continue
+			}
+			bg.stats.message()
+
+			log.DebugF("WebSocket get new message from [%s] : %s", clientIP, message.Subject)
+
+			// 访问日志项，携带请求 ID 的消息在回复或超时时记录
+			entry := &AccessLogEntry{
+				ClientIP:  clientIP,
+				UserID:    userID,
+				Subject:   message.Subject,
+				BytesIn:   int64(len(message.Data)),
+				RequestID: message.RequestID,
+			}
+
+			// 内部主题只能由服务端发布，客户端指定时回复错误
+			if err := checkClientSubject(message.Subject); err != nil {
+				if err := wc.pushMessage(&Message{RequestID: message.RequestID, Error: err.Error()}); err != nil {
+					log.ErrorF("Write message to [%s] error : %s", clientIP, err.Error())
+				}
+				entry.Status, entry.Error = subjectErrorStatus(err), err.Error()
+				bg.logMessage(entry, start, message.Data)
+				continue
+			}
+
+			// 超过限流的消息不转发，回复错误
+			if bg.limiter != nil && !bg.limiter.allow(c, clientIP, userID, message.Subject) {
+				if err := wc.pushMessage(&Message{RequestID: message.RequestID, Error: ErrTooManyRequests.Error()}); err != nil {
+					log.ErrorF("Write message to [%s] error : %s", clientIP, err.Error())
+				}
+				entry.Status, entry.Error = nHttp.StatusTooManyRequests, ErrTooManyRequests.Error()
+				bg.logMessage(entry, start, message.Data)
+				continue
+			}
+
+			// 通过指定 Reply 为 [WS_CONN.连接ID] ，由上面的订阅接收并且回复给用户
+			// 已认证的连接在消息头中携带身份
+			msg := &nats.Msg{
+				Subject: message.Subject,
+				Reply:   connSubject,
+				Data:    message.Data,
+			}
+			identity.setHeader(msg)
+			if message.Codec != PayloadCodecRaw {
+				setHeader(msg, PayloadCodecHeader, message.Codec)
+			}
+
+			// 携带请求 ID 的消息使用独立的回复主题，并随消息头转发请求 ID 及剩余时间预算，
+			// 超时未回复时向客户端回复错误
+			seq := ""
+			if message.RequestID != "" {
+				seq = wc.pending.add(message.RequestID, message.Subject, len(message.Data), bg.reqTimeout, func(request *pendingRequest) {
+					log.DebugF("WebSocket connection [%s] request [%s] timeout", clientIP, request.requestID)
+					if err := wc.pushMessage(&Message{RequestID: request.requestID, Error: ErrRequestTimeout.Error()}); err != nil {
+						log.ErrorF("Write message to [%s] error : %s", clientIP, err.Error())
+					}
+					bg.logMessage(&AccessLogEntry{
+						ClientIP:  clientIP,
+						UserID:    userID,
+						Subject:   request.subject,
+						Status:    nHttp.StatusGatewayTimeout,
+						BytesIn:   int64(request.size),
+						RequestID: request.requestID,
+						Error:     ErrRequestTimeout.Error(),
+					}, request.start, nil)
+				})
+				msg.Reply = ws.connSubject(wc.id, seq)
+				setHeader(msg, RequestIDHeader, message.RequestID)
+				client.SetDeadlineBudget(msg, bg.reqTimeout)
+			}
+
+			if err := c.PublishMsg(msg); err != nil {
+				log.ErrorF("WebSocket publish a message to [%s] subject error : %s", message.Subject, err.Error())
+				if request, ok := wc.pending.take(seq); ok {
+					if err := wc.pushMessage(&Message{RequestID: request.requestID, Error: ErrRequestFailed.Error()}); err != nil {
+						log.ErrorF("Write message to [%s] error : %s", clientIP, err.Error())
+					}
+				}
+				entry.Status, entry.Error = requestErrorStatus(err), err.Error()
+				bg.logMessage(entry, start, message.Data)
+				continue
+			}
+			// 不需要回复的消息在发布后记录
+			if seq == "" {
+				entry.Status = nHttp.StatusAccepted
+				bg.logMessage(entry, start, message.Data)
+			}
+		}
+	}
+}
+
+// 连接回复主题 [WS_CONN.连接ID] ，携带请求 ID 的请求使用 [WS_CONN.连接ID.序号]
+func (ws *webSocket) connSubject(connID string, tokens ...string) string {
+	return strings.Join(append([]string{fmt.Sprintf("WS_CONN.%s", connID)}, tokens...), client.SubjectSeparator)
+}
+
+// 设置消息头
+func setHeader(msg *nats.Msg, key, value string) {
+	if msg.Header == nil {
+		msg.Header = nHttp.Header{}
+	}
+	msg.Header.Set(key, value)
+}
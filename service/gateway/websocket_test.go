@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 启动网关的 HTTP 服务并返回 WebSocket 地址
+func newTestServer(t *testing.T, eg *engineGateway) string {
+	t.Helper()
+
+	server := httptest.NewServer(eg.engine)
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + WebSocketPath
+}
+
+func dialTest(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// 读取一帧，超时返回 nil
+func readTest(t *testing.T, conn *websocket.Conn, timeout time.Duration) []byte {
+	t.Helper()
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func TestWebSocketRejectsPushSubjects(t *testing.T) {
+	c := newTestClient(t)
+	eg := newTestEngineGateway(t, c, NewWebSocketGateway("127.0.0.1:0"))
+	url := newTestServer(t, eg)
+
+	sender := dialTest(t, url)
+	receiver := dialTest(t, url)
+
+	for _, subject := range []string{BroadcastPushSubject, UserPushSubject("alice"), GroupPushSubject("red"), GroupJoinSubject, "WS_CONN.x"} {
+		frame, _ := json.Marshal(&Message{Subject: subject, Data: []byte("spoof"), RequestID: "r1"})
+		if err := sender.WriteMessage(websocket.TextMessage, frame); err != nil {
+			t.Fatal(err)
+		}
+
+		reply := &Message{}
+		if err := json.Unmarshal(readTest(t, sender, time.Second), reply); err != nil {
+			t.Fatalf("%s : %v", subject, err)
+		}
+		if reply.Error != ErrReservedSubject.Error() {
+			t.Errorf("%s reply error = %q , want %q", subject, reply.Error, ErrReservedSubject.Error())
+		}
+	}
+
+	if data := readTest(t, receiver, 200*time.Millisecond); data != nil {
+		t.Errorf("receiver got a spoofed push : %s", data)
+	}
+}